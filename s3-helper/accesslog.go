@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// accessRecord is a single object request written to the access log sink
+type accessRecord struct {
+	Time     time.Time `json:"timestamp"`
+	Key      string    `json:"key"`
+	Bytes    int64     `json:"bytes"`
+	Status   int       `json:"status"`
+	ClientIP string    `json:"client_ip"`
+	// CloudFront request ID, when CloudFront fronts the helper
+	CloudFrontID string `json:"cf_id,omitempty"`
+
+	// only in the combined format
+	Request   string `json:"-"`
+	Referer   string `json:"-"`
+	UserAgent string `json:"-"`
+}
+
+// Access log formats
+const (
+	accessLogJSON     = "json"
+	accessLogCombined = "combined"
+)
+
+// checkAccessLogFormat validates an access log format
+func checkAccessLogFormat(format string) error {
+	if format != accessLogJSON && format != accessLogCombined {
+		return fmt.Errorf("unknown access log format %q", format)
+	}
+	return nil
+}
+
+// accessLogger batches access records and flushes them to a sink in the
+// background so the request path never blocks on it
+type accessLogger struct {
+	records chan accessRecord
+	stop    chan struct{}
+	done    chan struct{}
+	batch   int
+	flush   func([]accessRecord) error
+}
+
+// How often a partial batch is flushed
+const accessLogFlushInterval = 5 * time.Second
+
+// The access log, nil when disabled
+var accessLog *accessLogger
+
+// newAccessLogger creates an access logger for sink, which is either
+// "stdout", a file path (optionally prefixed with "file:"), an http(s)
+// URL that batches are POSTed to or an s3://bucket/prefix URL that each
+// batch is stored under as an object of its own.  Records are written as
+// newline delimited JSON, or as Apache combined log lines with the
+// combined format.
+func newAccessLogger(sink string, batch int, format string) (*accessLogger, error) {
+	if batch <= 0 {
+		batch = 1
+	}
+	al := &accessLogger{
+		records: make(chan accessRecord, batch*4),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		batch:   batch,
+	}
+	encode, contentType := encodeAccessRecords, "application/x-ndjson"
+	if format == accessLogCombined {
+		encode, contentType = encodeCombinedRecords, "text/plain"
+	}
+
+	if strings.HasPrefix(sink, "s3://") {
+		u, err := url.Parse(sink)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("no bucket in %q", sink)
+		}
+		bucket, prefix := u.Host, strings.Trim(u.Path, "/")
+		al.flush = func(recs []accessRecord) error {
+			return putAccessRecords(bucket, accessLogKey(prefix, format, time.Now()), contentType, encode(recs))
+		}
+	} else if strings.HasPrefix(sink, "http://") || strings.HasPrefix(sink, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		al.flush = func(recs []accessRecord) error {
+			resp, err := client.Post(sink, contentType, bytes.NewReader(encode(recs)))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+			}
+			return nil
+		}
+	} else {
+		f := os.Stdout
+		if sink != "stdout" {
+			var err error
+			f, err = os.OpenFile(strings.TrimPrefix(sink, "file:"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+		}
+		al.flush = func(recs []accessRecord) error {
+			_, err := f.Write(encode(recs))
+			return err
+		}
+	}
+
+	go al.run()
+	return al, nil
+}
+
+// accessLogKey names the object a batch flushed at t is stored as, under
+// prefix by date like S3's own server access logs
+func accessLogKey(prefix, format string, t time.Time) string {
+	ext := "json"
+	if format == accessLogCombined {
+		ext = "log"
+	}
+	key := t.UTC().Format("2006/01/02/150405.000000000") + "-" + randomHex(4) + "." + ext
+	if prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key
+}
+
+// putAccessRecords stores a batch of access records in bucket, which is
+// reached and signed for like the objects being served
+func putAccessRecords(bucket, key, contentType string, body []byte) error {
+	req, err := http.NewRequest("PUT", s3ObjectURL(bucket, "/"+key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if req, err = signRequestFor(req, conf.S3Region); err != nil {
+		return err
+	}
+	req.Header.Set("Host", req.URL.Host)
+	resp, err := s3Client.Load().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func encodeAccessRecords(recs []accessRecord) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		enc.Encode(rec)
+	}
+	return buf.Bytes()
+}
+
+// encodeCombinedRecords formats records as Apache combined log lines,
+// host ident authuser [date] "request" status bytes "referer" "user-agent"
+func encodeCombinedRecords(recs []accessRecord) []byte {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		size := "-"
+		if rec.Bytes > 0 {
+			size = strconv.FormatInt(rec.Bytes, 10)
+		}
+		fmt.Fprintf(&buf, "%s - - [%s] \"%s\" %d %s \"%s\" \"%s\"\n",
+			rec.ClientIP, rec.Time.Format("02/Jan/2006:15:04:05 -0700"), combinedEscape(rec.Request),
+			rec.Status, size, combinedEscape(orDash(rec.Referer)), combinedEscape(orDash(rec.UserAgent)))
+	}
+	return buf.Bytes()
+}
+
+// combinedEscape escapes quotes, backslashes and control characters the
+// way Apache does, so that a field can't break out of its quotes
+func combinedEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// emit queues a record, dropping it if the queue is full
+func (al *accessLogger) emit(rec accessRecord) {
+	if al == nil {
+		return
+	}
+	select {
+	case al.records <- rec:
+	default:
+		metricAccessLogDropped.Add(1)
+	}
+}
+
+func (al *accessLogger) run() {
+	defer close(al.done)
+
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+
+	recs := make([]accessRecord, 0, al.batch)
+	write := func() {
+		if len(recs) == 0 {
+			return
+		}
+		if err := al.flush(recs); err != nil {
+			log.Error().
+				Str("error", err.Error()).
+				Int("records", len(recs)).
+				Msg("Failed to flush access log")
+		}
+		recs = recs[:0]
+	}
+
+	for {
+		select {
+		case rec := <-al.records:
+			recs = append(recs, rec)
+			if len(recs) >= al.batch {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case <-al.stop:
+			for {
+				select {
+				case rec := <-al.records:
+					recs = append(recs, rec)
+				default:
+					write()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close flushes any queued records and stops the logger
+func (al *accessLogger) close() {
+	if al == nil {
+		return
+	}
+	close(al.stop)
+	<-al.done
+}
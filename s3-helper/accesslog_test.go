@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCombinedAccessLog(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	prev := accessLog
+	t.Cleanup(func() { accessLog = prev })
+	accessLog = &accessLogger{records: make(chan accessRecord, 10)}
+
+	r := httptest.NewRequest("GET", "/show/ep1.ts?x=1", nil)
+	r.Header.Set("User-Agent", `player "beta"`)
+	forwardToS3(httptest.NewRecorder(), r)
+	rec := <-accessLog.records
+	rec.Time = time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)
+
+	want := `192.0.2.1 - - [12/Oct/2026:10:00:00 +0000] "GET /show/ep1.ts?x=1 HTTP/1.1" 200 10 "-" "player \"beta\""` + "\n"
+	if got := string(encodeCombinedRecords([]accessRecord{rec})); got != want {
+		t.Errorf("got  %s want %s", got, want)
+	}
+
+	// nothing sent is a dash, and control characters can't end the line
+	rec = accessRecord{Time: rec.Time, ClientIP: "10.0.0.1", Request: "GET /\n HTTP/1.1", Status: 304}
+	want = `10.0.0.1 - - [12/Oct/2026:10:00:00 +0000] "GET /\x0a HTTP/1.1" 304 - "-" "-"` + "\n"
+	if got := string(encodeCombinedRecords([]accessRecord{rec})); got != want {
+		t.Errorf("got  %s want %s", got, want)
+	}
+
+	if err := checkAccessLogFormat("common"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestAccessLogS3Sink(t *testing.T) {
+	var mu sync.Mutex
+	puts := map[string]string{}
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		puts[r.URL.Path] = string(body)
+		mu.Unlock()
+	}))
+
+	al, err := newAccessLogger("s3://logs/access/", 2, accessLogJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/a/1.ts", "/a/2.ts", "/a/3.ts"} {
+		al.emit(accessRecord{Time: time.Now(), Key: key, Status: 200})
+	}
+	al.close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(puts) == 0 {
+		t.Fatal("no batch stored")
+	}
+	var lines int
+	for path, body := range puts {
+		if !strings.HasPrefix(path, "/logs/access/") || !strings.HasSuffix(path, ".json") {
+			t.Errorf("batch stored as %s", path)
+		}
+		lines += strings.Count(body, "\n")
+	}
+	if lines != 3 {
+		t.Errorf("got %d records, want 3", lines)
+	}
+}
+
+func TestAccessLogS3SinkNeedsBucket(t *testing.T) {
+	if _, err := newAccessLogger("s3:///access", 1, accessLogJSON); err == nil {
+		t.Error("no error for a sink without a bucket")
+	}
+}
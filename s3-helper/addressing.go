@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// s3VirtualHost is the virtual-hosted style host of bucket
+func s3VirtualHost(bucket string) string {
+	return fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, conf.S3Region)
+}
+
+// checkVirtualHosted makes sure the configured bucket can be addressed
+// virtual-hosted style
+func checkVirtualHosted() error {
+	if conf.S3Endpoint != "" || len(conf.S3Endpoints) > 0 {
+		return fmt.Errorf("virtual-hosted addressing is not available with a custom endpoint")
+	}
+	return checkVirtualHostedBucket(conf.S3Bucket)
+}
+
+// checkVirtualHostedBucket makes sure bucket, the configured one or that
+// of a route, can be addressed virtual-hosted style
+func checkVirtualHostedBucket(bucket string) error {
+	// the wildcard certificate only covers one level
+	if strings.Contains(bucket, ".") && s3Scheme() == "https" {
+		return fmt.Errorf("bucket %q contains dots, which TLS doesn't allow in virtual-hosted addressing", bucket)
+	}
+	return nil
+}
+
+// pathStyleFallback returns req addressed path-style and signed afresh
+// when it failed to resolve its virtual host, as happens while the DNS
+// of a new bucket propagates.  It returns false for any other failure.
+func pathStyleFallback(req *http.Request, err error) (*http.Request, bool) {
+	if !conf.AddressingFallback || err == nil {
+		return nil, false
+	}
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return nil, false
+	}
+	suffix := fmt.Sprintf(".s3.%s.amazonaws.com", conf.S3Region)
+	host := req.URL.Hostname()
+	bucket := strings.TrimSuffix(host, suffix)
+	if bucket == host || bucket == "" {
+		return nil, false
+	}
+	rest := "/" + bucket + req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		rest += "?" + req.URL.RawQuery
+	}
+	r, serr := retarget(req, fmt.Sprintf("%s://s3.%s.amazonaws.com", req.URL.Scheme, conf.S3Region), rest)
+	if serr != nil {
+		return nil, false
+	}
+	metricAddressingFallbacks.Add(1)
+	log.Warn().
+		Str("host", req.URL.Host).
+		Str("error", err.Error()).
+		Msg("Virtual host didn't resolve, falling back to path-style")
+	return r, true
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestPathStyleFallback(t *testing.T) {
+	s := &hostSigner{}
+	useSigner(t, s)
+	defer func(on bool, region string) { conf.AddressingFallback, conf.S3Region = on, region }(conf.AddressingFallback, conf.S3Region)
+	conf.AddressingFallback = true
+	conf.S3Region = "us-east-1"
+
+	req, _ := http.NewRequest("GET", "https://media.s3.us-east-1.amazonaws.com/show/ep1.ts?versionId=3", nil)
+	r, ok := pathStyleFallback(req, &net.DNSError{Err: "no such host", Name: req.URL.Host})
+	if !ok {
+		t.Fatal("no fallback for a DNS error")
+	}
+	if got := r.URL.String(); got != "https://s3.us-east-1.amazonaws.com/media/show/ep1.ts?versionId=3" {
+		t.Errorf("URL = %q", got)
+	}
+	if r.Host != "s3.us-east-1.amazonaws.com" || len(s.signed) != 1 || s.signed[0] != r.Host {
+		t.Errorf("Host %q signed for %q", r.Host, s.signed)
+	}
+
+	if _, ok := pathStyleFallback(req, net.ErrClosed); ok {
+		t.Error("fallback for a non-DNS error")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// startAdmin serves the admin endpoints on addr.  Failing to bind, e.g.
+// because the port is taken, only takes the admin endpoints down unless
+// AdminRequired is set, media keeps being served either way.  It reports
+// whether the listener is up.
+func startAdmin(addr string, handler http.Handler) bool {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg(fmt.Sprintf("Failure starting up admin listener on %v", addr))
+		if conf.AdminRequired {
+			os.Exit(1)
+		}
+		log.Warn().Msg("Continuing without admin endpoints")
+		return false
+	}
+
+	log.Info().Msg(fmt.Sprintf("Accepting admin connections on %v", addr))
+	go func() {
+		if err := http.Serve(ln, handler); err != nil {
+			log.Error().Msg(fmt.Sprintf("Admin listener failed %v", err))
+		}
+	}()
+	return true
+}
+
+// Clients allowed on the admin listener, any when empty
+var adminAllow []*net.IPNet
+
+// initAdminAllow sets up the clients allowed on the admin listener
+func initAdminAllow() {
+	nets, err := parseCIDRs(conf.AdminCIDRs)
+	if err != nil {
+		exitConfig("S3_ADMIN_CIDRS", err)
+	}
+	adminAllow = nets
+}
+
+// checkAdminClient turns away clients outside AdminCIDRs with a 403
+func checkAdminClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminAllow) > 0 && !ipAllowed(adminAllow, clientIP(r)) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Warn().
+				Str("path", r.URL.Path).
+				Str("client", clientIP(r)).
+				Msg("Rejected admin request from a client not allowed to")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
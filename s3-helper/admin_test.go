@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestAdminBindFailureTolerated(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	if startAdmin(taken.Addr().String(), admin) {
+		t.Error("admin listener reported up on a port in use")
+	}
+
+	// pick a free port and hand it over
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+	if !startAdmin(addr, admin) {
+		t.Fatalf("admin listener on %s not started", addr)
+	}
+	resp, err := http.Get("http://" + addr + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("admin endpoint answered %q", body)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Path of the endpoint streaming several objects as one archive
+const archivePath = "/__s3helper/archive"
+
+// archiveRequest lists the objects to put in an archive, as a POSTed JSON
+// body.  GETs give them as repeated "key" query parameters instead.
+type archiveRequest struct {
+	Keys   []string `json:"keys"`
+	Name   string   `json:"name"`
+	Format string   `json:"format"`
+}
+
+// archiveEntry is an object going into an archive, as S3 described it
+type archiveEntry struct {
+	key      string
+	name     string
+	size     int64
+	modified time.Time
+}
+
+// parseArchiveRequest reads the keys, archive name and format from a GET's
+// query or a POST's JSON body
+func parseArchiveRequest(r *http.Request) (archiveRequest, error) {
+	var ar archiveRequest
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		ar = archiveRequest{Keys: q["key"], Name: q.Get("name"), Format: q.Get("format")}
+	case "POST":
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&ar); err != nil {
+			return ar, fmt.Errorf("invalid JSON body: %v", err)
+		}
+	}
+	if ar.Format == "" {
+		ar.Format = "zip"
+	}
+	if ar.Format != "zip" && ar.Format != "tar" {
+		return ar, fmt.Errorf("unknown format %q", ar.Format)
+	}
+	if ar.Name == "" {
+		ar.Name = "archive"
+	}
+	if strings.ContainsAny(ar.Name, "/\\") {
+		return ar, fmt.Errorf("invalid name %q", ar.Name)
+	}
+	if len(ar.Keys) == 0 {
+		return ar, fmt.Errorf("no keys")
+	}
+	if len(ar.Keys) > conf.ArchiveMaxEntries {
+		return ar, fmt.Errorf("%d keys, at most %d are allowed", len(ar.Keys), conf.ArchiveMaxEntries)
+	}
+	seen := make(map[string]bool)
+	for i, key := range ar.Keys {
+		if !strings.HasPrefix(key, "/") {
+			key = "/" + key
+		}
+		// entry names must not climb out of where the archive is unpacked
+		for _, part := range strings.Split(key, "/") {
+			if part == ".." {
+				return ar, fmt.Errorf("invalid key %q", key)
+			}
+		}
+		// nor smuggle a query in, the key is escaped on its way to S3
+		if err := checkObjectKey(key); err != nil {
+			return ar, err
+		}
+		if seen[key] {
+			return ar, fmt.Errorf("duplicate key %q", key)
+		}
+		seen[key] = true
+		ar.Keys[i] = key
+	}
+	return ar, nil
+}
+
+// statArchiveEntries looks up the size of every object with a HEAD, so
+// that missing objects and oversized archives are refused before anything
+// is streamed.  It returns the status to answer with on failure.
+func statArchiveEntries(keys []string) ([]archiveEntry, int, error) {
+	entries := make([]archiveEntry, 0, len(keys))
+	var total int64
+	for _, key := range keys {
+		req, err := newS3Request("HEAD", key, nil)
+		if err == errNoCredentials {
+			return nil, http.StatusServiceUnavailable, err
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		resp, err := doS3(req)
+		if err != nil {
+			return nil, http.StatusBadGateway, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp.StatusCode, fmt.Errorf("%s: Response Status Code: %d", key, resp.StatusCode)
+		}
+		if resp.ContentLength < 0 {
+			return nil, http.StatusBadGateway, fmt.Errorf("%s: no Content-Length", key)
+		}
+		total += resp.ContentLength
+		if total > conf.ArchiveMaxBytes {
+			return nil, http.StatusRequestEntityTooLarge,
+				fmt.Errorf("archive would exceed %d bytes", conf.ArchiveMaxBytes)
+		}
+		modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		entries = append(entries, archiveEntry{
+			key:      key,
+			name:     strings.TrimPrefix(key, "/"),
+			size:     resp.ContentLength,
+			modified: modified,
+		})
+	}
+	return entries, 0, nil
+}
+
+// archiveWriter adds entries to a zip or tar archive as they stream in
+type archiveWriter interface {
+	add(e archiveEntry) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+// add stores the entry uncompressed, media doesn't get any smaller
+func (z zipArchive) add(e archiveEntry) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Store, Modified: e.modified})
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (t tarArchive) add(e archiveEntry) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{
+		Name:     e.name,
+		Mode:     0644,
+		Size:     e.size,
+		ModTime:  e.modified,
+		Typeflag: tar.TypeReg,
+	})
+	return t.Writer, err
+}
+
+// copyArchiveEntry streams one object into the archive, failing unless it
+// has exactly the size its HEAD promised
+func copyArchiveEntry(aw archiveWriter, e archiveEntry) error {
+	req, err := newS3Request("GET", e.key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doS3(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	dst, err := aw.add(e)
+	if err != nil {
+		return err
+	}
+	n, err := copyBody(dst, io.LimitReader(resp.Body, e.size))
+	if err == nil && n != e.size {
+		err = fmt.Errorf("got %d of %d bytes", n, e.size)
+	}
+	return err
+}
+
+// archiveHandler streams the requested objects as a single zip or tar
+// archive, fetching them from S3 one after the other so memory use stays
+// bounded whatever their size.  It goes by maintenance and the request
+// limits like object requests do.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", serverName)
+	if maintenance.on.Load() {
+		serveMaintenance(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		rejectMethodAllowing(w, r, []string{"GET", "POST"})
+		return
+	}
+	release, ok := admit(w, r, archivePath)
+	if !ok {
+		return
+	}
+	defer release()
+	logger := log.With().Str("archive", archivePath).Str("client", clientIP(r)).Logger()
+
+	ar, err := parseArchiveRequest(r)
+	if err != nil {
+		w.WriteHeader(400)
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("Rejected archive request")
+		return
+	}
+	entries, status, err := statArchiveEntries(ar.Keys)
+	if err == errNoCredentials {
+		credentialsUnavailable(w)
+		logger.Warn().Msg("No valid credentials, asked client to retry")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(status)
+		logger.Error().
+			Str("error", err.Error()).
+			Int("statuscode", status).
+			Msg("Failed to look up archive entries")
+		return
+	}
+
+	var aw archiveWriter
+	filename := ar.Name + "." + ar.Format
+	switch ar.Format {
+	case "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+		aw = tarArchive{tar.NewWriter(w)}
+	default:
+		w.Header().Set("Content-Type", "application/zip")
+		aw = zipArchive{zip.NewWriter(w)}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.WriteHeader(http.StatusOK)
+
+	// past the header a failure can only be signalled by cutting the
+	// archive short
+	for _, e := range entries {
+		if err := copyArchiveEntry(aw, e); err != nil {
+			logger.Error().
+				Str("error", err.Error()).
+				Str("object", e.key).
+				Msg("Failed to add object to archive")
+			abortConnection(w)
+			return
+		}
+	}
+	if err := aw.Close(); err != nil {
+		abortConnection(w)
+		return
+	}
+	logger.Info().
+		Int("entries", len(entries)).
+		Str("filename", filename).
+		Msg(fmt.Sprintf("Streamed archive of %d objects", len(entries)))
+}
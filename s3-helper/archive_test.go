@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// mockObjects serves objects from a map, counting the requests
+func mockObjects(objects map[string]string, requests *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", "Wed, 14 Oct 2026 10:00:00 GMT")
+		if r.Method != "HEAD" {
+			io.WriteString(w, body)
+		}
+	})
+}
+
+func TestArchiveZip(t *testing.T) {
+	var requests atomic.Int32
+	mockS3(t, mockObjects(map[string]string{"/bucket/a/1.ts": "one", "/bucket/a/2.ts": "two"}, &requests))
+	conf.ArchiveMaxEntries = 10
+	conf.ArchiveMaxBytes = 1 << 20
+
+	w := httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("GET", archivePath+"?key=/a/1.ts&key=a/2.ts&name=clip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a/1.ts": "one", "a/2.ts": "two"}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if want[f.Name] != string(b) {
+			t.Errorf("%s = %q, want %q", f.Name, b, want[f.Name])
+		}
+		delete(want, f.Name)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing entries %v", want)
+	}
+}
+
+func TestArchiveGates(t *testing.T) {
+	var requests atomic.Int32
+	mockS3(t, mockObjects(map[string]string{"/bucket/a/1.ts": "one"}, &requests))
+	conf.ArchiveMaxEntries = 10
+	conf.ArchiveMaxBytes = 1 << 20
+	conf.MaintenanceRetryAfter = 0
+	conf.OverloadStatus = http.StatusServiceUnavailable
+
+	// in maintenance nothing goes to S3
+	maintenance.setAdmin(true)
+	w := httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("GET", archivePath+"?key=/a/1.ts", nil))
+	maintenance.setAdmin(false)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("in maintenance: got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("PUT", archivePath, nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("PUT: got %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	// with every in-flight slot taken
+	prev := inflightSlots
+	inflightSlots = make(chan struct{}, 1)
+	inflightSlots <- struct{}{}
+	w = httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("GET", archivePath+"?key=/a/1.ts", nil))
+	inflightSlots = prev
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("over max_inflight: got %d", w.Code)
+	}
+
+	if n := requests.Load(); n != 0 {
+		t.Errorf("%d requests reached S3", n)
+	}
+}
+
+func TestArchiveKeys(t *testing.T) {
+	var requests atomic.Int32
+	mockS3(t, mockObjects(map[string]string{"/bucket/a/1 b.ts": "one"}, &requests))
+	conf.ArchiveMaxEntries = 2
+	conf.ArchiveMaxBytes = 1 << 20
+
+	// keys are escaped on their way to S3
+	w := httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("GET", archivePath+"?key=/a/1%20b.ts&format=tar", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("key with a space: got %d", w.Code)
+	}
+	requests.Store(0)
+
+	for _, target := range []string{
+		"?key=/a/1.ts%3Flist-type%3D2",
+		"?key=/a/1.ts%23x",
+		"?key=/a/",
+		"?key=/",
+		"?key=/a/../../etc/passwd",
+		"?key=/a/1.ts&key=a/1.ts",
+		"?key=/a/1.ts&key=/a/2.ts&key=/a/3.ts",
+	} {
+		w := httptest.NewRecorder()
+		archiveHandler(w, httptest.NewRequest("GET", archivePath+target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, w.Code)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("%d requests reached S3", n)
+	}
+}
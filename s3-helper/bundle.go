@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// When the process started, for the uptime in diagnostic bundles
+var processStart = time.Now()
+
+// Length of the CPU profile in a diagnostic bundle, unless asked for
+// another with ?seconds=
+const (
+	bundleCPUSeconds    = 30
+	bundleCPUSecondsMax = 300
+)
+
+// bundleMetadata describes the process a diagnostic bundle comes from
+type bundleMetadata struct {
+	Version    string       `json:"version"`
+	Go         string       `json:"go"`
+	GOMAXPROCS int          `json:"gomaxprocs"`
+	Started    time.Time    `json:"started"`
+	Uptime     string       `json:"uptime"`
+	Stats      processStats `json:"stats"`
+	Config     Config       `json:"config"`
+}
+
+// bundleHandler answers with a zip of a CPU profile taken over the next
+// 30 seconds, the heap, goroutine and block profiles and metadata.json,
+// for collecting everything a support case needs in one go.  Blocking is
+// only sampled while the CPU profile runs.
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	seconds := bundleCPUSeconds
+	if s := r.URL.Query().Get("seconds"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > bundleCPUSecondsMax {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		seconds = n
+	}
+
+	var cpu bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpu); err != nil {
+		// only one CPU profile can run at a time
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("Collecting diagnostic bundle over %ds", seconds))
+	runtime.SetBlockProfileRate(1)
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+	runtime.SetBlockProfileRate(0)
+	if r.Context().Err() != nil {
+		log.Warn().Msg("Diagnostic bundle abandoned by client")
+		return
+	}
+
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=s3helper-bundle-%s.zip", now.UTC().Format("20060102T150405Z")))
+	metadata := bundleMetadata{
+		Version:    version,
+		Go:         runtime.Version(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Started:    processStart,
+		Uptime:     now.Sub(processStart).Round(time.Second).String(),
+		Stats:      collectStats(),
+		Config:     redactedConfig(),
+	}
+	profile := func(name string) func(io.Writer) error {
+		return func(w io.Writer) error { return pprof.Lookup(name).WriteTo(w, 0) }
+	}
+	files := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"cpu.pprof", func(w io.Writer) error { _, err := w.Write(cpu.Bytes()); return err }},
+		{"heap.pprof", profile("heap")},
+		{"goroutine.pprof", profile("goroutine")},
+		{"block.pprof", profile("block")},
+		{"metadata.json", func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(metadata)
+		}},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: now})
+		if err == nil {
+			err = f.write(fw)
+		}
+		if err != nil {
+			log.Error().
+				Str("error", err.Error()).
+				Str("entry", f.name).
+				Msg("Failed to write diagnostic bundle")
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg("Failed to write diagnostic bundle")
+		return
+	}
+	log.Info().Msg("Sent diagnostic bundle")
+}
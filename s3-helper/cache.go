@@ -0,0 +1,429 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Upper bound on the number of cached objects
+const cacheMaxEntries = 10000
+
+// cacheEntry holds the response headers of an object, or of a range of
+// it, as last seen from S3, and the body when small enough to be cached
+type cacheEntry struct {
+	path    string
+	status  int
+	header  http.Header
+	etag    string
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	// how long the entry stays fresh, see cacheTTL
+	ttl time.Duration
+	// where the entry is in the LRU list
+	elem *list.Element
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// usable reports whether the entry is fresh or stale by less than maxStale
+func (e *cacheEntry) usable(now time.Time, maxStale time.Duration) bool {
+	return now.Before(e.expires.Add(maxStale))
+}
+
+// objectCache is an in-memory cache of object metadata, and optionally of
+// small object bodies and ranges.  Whole objects are keyed by path, ranges
+// by path and range.
+type objectCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// the TTL of objects no CacheTTLByPath or CacheTTLByContentType rule
+	// matches
+	ttl time.Duration
+
+	// keys of the cached ranges of each path
+	ranges map[string]map[string]bool
+	// ranges merged by object when rangeMax is set, up to rangeMax bytes
+	// for each
+	partials map[string]*partialObject
+	rangeMax int64
+
+	// bodies up to maxObject bytes are kept, up to maxBytes in total
+	maxObject int64
+	maxBytes  int64
+	size      int64
+
+	// expired entries are kept around this long to serve on errors
+	maxStale time.Duration
+
+	// the entries and merged ranges, most recently used first
+	lru *list.List
+}
+
+// lruItem is what the LRU list holds: the key of an entry, or the path of
+// an object's merged ranges
+type lruItem struct {
+	key     string
+	partial bool
+}
+
+// The object cache, nil when caching is disabled
+var cache *objectCache
+
+func newObjectCache(ttl time.Duration, maxObject, maxBytes int64, maxStale time.Duration) *objectCache {
+	return &objectCache{
+		entries:   make(map[string]*cacheEntry),
+		ranges:    make(map[string]map[string]bool),
+		partials:  make(map[string]*partialObject),
+		ttl:       ttl,
+		maxObject: maxObject,
+		maxBytes:  maxBytes,
+		maxStale:  maxStale,
+		lru:       list.New(),
+	}
+}
+
+// initCache sets up the object cache when CacheTTL or a TTL rule is set.
+// Rules enable it on their own, for just the objects they match when
+// there is no CacheTTL.
+func initCache() {
+	if conf.CacheTTL <= 0 && len(conf.CacheTTLByPath) == 0 && len(conf.CacheTTLByContentType) == 0 {
+		return
+	}
+	var maxStale time.Duration
+	if conf.ServeStaleOnError {
+		maxStale = conf.CacheMaxStale
+	}
+	cache = newObjectCache(conf.CacheTTL, conf.CacheMaxObjectSize, conf.CacheMaxBytes, maxStale)
+	if conf.CacheTTL > 0 {
+		log.Info().Msg(fmt.Sprintf("Caching object metadata for %v", conf.CacheTTL))
+	} else {
+		log.Info().Msg("Caching object metadata of objects matching a TTL rule only")
+	}
+	if conf.CacheMaxObjectSize > 0 {
+		log.Info().Msg(fmt.Sprintf("Caching objects up to %d bytes", conf.CacheMaxObjectSize))
+	}
+	if conf.CacheRangeMaxBytes > 0 {
+		cache.rangeMax = conf.CacheRangeMaxBytes
+		log.Info().Msg(fmt.Sprintf("Merging cached ranges up to %d bytes per object", conf.CacheRangeMaxBytes))
+	}
+}
+
+// cacheKey is the cache key of a range of the object at path, the whole
+// object when byterange is empty
+func cacheKey(path, byterange string) string {
+	if byterange == "" {
+		return path
+	}
+	return path + "\x00" + byterange
+}
+
+// cacheable reports whether a body of length n can be cached
+func (c *objectCache) cacheable(n int64) bool {
+	return c != nil && n >= 0 && n <= c.maxObject && n <= c.maxBytes
+}
+
+// lookup returns the entry for key whether it is fresh or not
+func (c *objectCache) lookup(key string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e.elem)
+	}
+	return e, ok
+}
+
+// get returns the fresh entry for key, if any
+func (c *objectCache) get(key string) (*cacheEntry, bool) {
+	e, ok := c.lookup(key)
+	if !ok || !e.fresh(time.Now()) {
+		return nil, false
+	}
+	return e, true
+}
+
+// getStale returns the entry for key, even an expired one, as long as it
+// expired no more than maxStale ago
+func (c *objectCache) getStale(key string) (*cacheEntry, bool) {
+	e, ok := c.lookup(key)
+	if !ok || !e.usable(time.Now(), c.maxStale) {
+		return nil, false
+	}
+	return e, true
+}
+
+// set stores the status, headers and body, if not nil, of a response for
+// the object at path or a range of it, replacing whatever was cached for
+// that before.  Cached copies of an older version of the object are
+// dropped.
+func (c *objectCache) set(path, byterange string, status int, header http.Header, body []byte) {
+	if c == nil {
+		return
+	}
+	if body != nil && !c.cacheable(int64(len(body))) {
+		body = nil
+	}
+	if byterange != "" && body == nil {
+		return
+	}
+	// a TTL of zero keeps the object out of the cache altogether
+	ttl := cacheTTL(path, header, c.ttl)
+	if ttl <= 0 {
+		c.delete(path)
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		path:    path,
+		status:  status,
+		header:  header.Clone(),
+		etag:    header.Get("ETag"),
+		body:    body,
+		stored:  now,
+		expires: now.Add(ttl),
+		ttl:     ttl,
+	}
+	key := cacheKey(path, byterange)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidate(path, e.etag)
+	c.remove(key)
+	c.evict(int64(len(body)))
+	e.elem = c.lru.PushFront(lruItem{key: key})
+	c.entries[key] = e
+	c.size += int64(len(body))
+	if byterange != "" {
+		if c.ranges[path] == nil {
+			c.ranges[path] = make(map[string]bool)
+		}
+		c.ranges[path][key] = true
+	}
+}
+
+// refresh marks the entry for key as fresh again after S3 confirmed it
+// is unchanged
+func (c *objectCache) refresh(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		now := time.Now()
+		e2 := *e
+		e2.stored = now
+		e2.expires = now.Add(e.ttl)
+		c.entries[key] = &e2
+		c.lru.MoveToFront(e.elem)
+	}
+}
+
+// delete drops the object at path, and all its ranges, from the cache
+func (c *objectCache) delete(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidate(path, "")
+}
+
+// purge drops the object at key, whole and its ranges, or every object
+// under a prefix when key ends in "*".  It returns the number of entries
+// dropped.
+func (c *objectCache) purge(key string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries) + len(c.partials)
+	if prefix := strings.TrimSuffix(key, "*"); prefix != key {
+		for k, e := range c.entries {
+			if strings.HasPrefix(e.path, prefix) {
+				c.remove(k)
+			}
+		}
+		for path := range c.partials {
+			if strings.HasPrefix(path, prefix) {
+				c.removePartial(path)
+			}
+		}
+	} else {
+		c.invalidate(key, "")
+	}
+	return n - len(c.entries) - len(c.partials)
+}
+
+// invalidate drops the cached copies of the object at path, whole or
+// ranges, that don't belong to the version with the given ETag.  Must be
+// called with the lock held.
+func (c *objectCache) invalidate(path, etag string) {
+	if e, ok := c.entries[path]; ok && (etag == "" || e.etag != etag) {
+		c.remove(path)
+	}
+	for key := range c.ranges[path] {
+		if e, ok := c.entries[key]; !ok || etag == "" || e.etag != etag {
+			c.remove(key)
+		}
+	}
+	if p, ok := c.partials[path]; ok && (etag == "" || p.etag != etag) {
+		c.removePartial(path)
+	}
+}
+
+// remove drops key from the cache.  Must be called with the lock held.
+func (c *objectCache) remove(key string) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.size -= int64(len(e.body))
+	c.lru.Remove(e.elem)
+	delete(c.entries, key)
+	if key != e.path {
+		delete(c.ranges[e.path], key)
+		if len(c.ranges[e.path]) == 0 {
+			delete(c.ranges, e.path)
+		}
+	}
+}
+
+// evict makes room for a new entry with a body of n bytes, dropping the
+// least recently used entries and merged ranges.  Must be called with the
+// lock held.
+func (c *objectCache) evict(n int64) {
+	for c.lru.Len() > 0 && (c.lru.Len() >= cacheMaxEntries || c.size+n > c.maxBytes) {
+		item := c.lru.Back().Value.(lruItem)
+		if item.partial {
+			c.removePartial(item.key)
+		} else {
+			c.remove(item.key)
+		}
+	}
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 7232 requires for If-None-Match
+func etagMatch(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Values of the cache status header
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheStale       = "STALE"
+	cacheRevalidated = "REVALIDATED"
+)
+
+// setCacheStatus tells the client how the cache handled the request,
+// nothing is said when caching is disabled
+func setCacheStatus(w http.ResponseWriter, status string) {
+	if cache == nil || conf.CacheStatusHeader == "" {
+		return
+	}
+	w.Header().Set(conf.CacheStatusHeader, status)
+}
+
+// setAge sets the Age header of a response served from e
+func setAge(w http.ResponseWriter, e *cacheEntry) {
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+}
+
+// serveCached writes a cached object to the client
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry) {
+	setAge(w, e)
+	for name, hflag := range headerForward {
+		if hflag {
+			if v := e.header.Get(name); v != "" {
+				w.Header().Set(name, v)
+			}
+		}
+	}
+	if e.status == http.StatusOK && e.body != nil && e.header.Get("Content-Encoding") == "" {
+		addPrefetchHints(w.Header(), r.URL.Path, e.header.Get("Content-Type"), e.body)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	if r.Method != "HEAD" {
+		w.Write(e.body)
+	}
+}
+
+// serveStale serves an expired copy of the object at upath in place of a
+// failed S3 request for the whole object, returning false if there is none
+// to serve
+func serveStale(w http.ResponseWriter, r *http.Request, upath string, logger zerolog.Logger) bool {
+	if !conf.ServeStaleOnError {
+		return false
+	}
+	e, ok := cache.getStale(upath)
+	if !ok || e.body == nil {
+		return false
+	}
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	setCacheStatus(w, cacheStale)
+	serveCached(w, r, e)
+	metricStaleServed.Add(1)
+	logger.Warn().
+		Dur("stale", time.Since(e.expires)).
+		Msg("S3 unavailable, served stale copy from cache")
+	return true
+}
+
+// purgeHandler drops objects from the cache after they were overwritten in
+// S3, e.g. "POST /cache/purge?key=/show/ep1/manifest.m3u8" for a single
+// object or "key=/show/ep1/*" for everything under a prefix.  It answers
+// with the number of entries dropped.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PURGE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	n := cache.purge(key)
+	log.Info().
+		Str("key", key).
+		Int("purged", n).
+		Msg(fmt.Sprintf("Purged %d cache entries", n))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": n})
+}
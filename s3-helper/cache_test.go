@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cachedObject serves one object with an ETag, counting the requests that
+// reach it and answering If-None-Match with a 304
+func cachedObject(t *testing.T, fetches *atomic.Int32, fail *atomic.Bool) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if fail != nil && fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "video/mp2t")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	conf.CacheStatusHeader = "X-Cache"
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch, etag string
+		want              bool
+	}{
+		{`"v1"`, `"v1"`, true},
+		{`W/"v1"`, `"v1"`, true},
+		{`"v1"`, `W/"v1"`, true},
+		{`"v0", "v1"`, `"v1"`, true},
+		{`*`, `"v1"`, true},
+		{`"v2"`, `"v1"`, false},
+		{`"v1"`, ``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatch(tt.ifNoneMatch, tt.etag); got != tt.want {
+			t.Errorf("etagMatch(%s, %s) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestETagShortCircuit(t *testing.T) {
+	prevConf, prevCache := conf, cache
+	t.Cleanup(func() { conf, cache = prevConf, prevCache })
+	conf.ETagShortCircuit = true
+	cache = newObjectCache(time.Minute, 0, 0, 0)
+	cache.set("/show/ep1.ts", "", http.StatusOK, http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Mon, 12 Oct 2026 10:00:00 GMT"},
+	}, nil)
+
+	// a match is answered without S3, which isn't reachable from here
+	w := serve("GET", "/show/ep1.ts", http.Header{"If-None-Match": {`W/"v1"`}})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("got %d, want a 304", w.Code)
+	}
+	if w.Header().Get("ETag") != `"v1"` || w.Header().Get("Last-Modified") == "" {
+		t.Errorf("304 headers %v", w.Header())
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("304 with a body %q", w.Body.String())
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	var fetches atomic.Int32
+	cachedObject(t, &fetches, nil)
+	cache = newObjectCache(time.Minute, 1024, 1<<20, 0)
+
+	if w := serve("GET", "/show/ep1.ts", nil); w.Header().Get("X-Cache") != cacheMiss {
+		t.Errorf("first request %s, want a MISS", w.Header().Get("X-Cache"))
+	}
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Header().Get("X-Cache") != cacheHit || w.Body.String() != "0123456789" {
+		t.Errorf("second request %s %q, want a HIT with the body", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if w.Header().Get("Age") == "" {
+		t.Error("cached response without an Age")
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("S3 asked %d times, want once", n)
+	}
+
+	// no header at all when it is turned off
+	conf.CacheStatusHeader = ""
+	if w := serve("GET", "/show/ep1.ts", nil); len(w.Header()["X-Cache"]) != 0 {
+		t.Errorf("cache status %q sent with the header off", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheServesStale(t *testing.T) {
+	var fetches atomic.Int32
+	var fail atomic.Bool
+	cachedObject(t, &fetches, &fail)
+	conf.ServeStaleOnError = true
+	conf.S3Retries = RetryConfig{}
+	cache = newObjectCache(time.Millisecond, 1024, 1<<20, time.Minute)
+
+	serve("GET", "/show/ep1.ts", nil)
+	time.Sleep(5 * time.Millisecond)
+	fail.Store(true)
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("got %d %q, want the stale copy", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Warning") == "" || w.Header().Get("X-Cache") != cacheStale {
+		t.Errorf("stale copy served with Warning %q and status %q", w.Header().Get("Warning"), w.Header().Get("X-Cache"))
+	}
+
+	// ranges aren't served from a stale copy
+	w = serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-1"}})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("ranged request got %d, want S3's 500", w.Code)
+	}
+}
+
+func TestCacheRevalidates(t *testing.T) {
+	var fetches atomic.Int32
+	cachedObject(t, &fetches, nil)
+	cache = newObjectCache(time.Millisecond, 1024, 1<<20, 0)
+
+	serve("GET", "/show/ep1.ts", nil)
+	time.Sleep(5 * time.Millisecond)
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Header().Get("X-Cache") != cacheRevalidated || w.Body.String() != "0123456789" {
+		t.Errorf("expired copy %s %q, want it REVALIDATED", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("S3 asked %d times, want twice", n)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	var fetches atomic.Int32
+	cachedObject(t, &fetches, nil)
+	cache = newObjectCache(time.Minute, 1024, 1<<20, 0)
+
+	for _, status := range []string{cacheMiss, cacheHit} {
+		w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=2-5"}})
+		if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+			t.Errorf("got %d %q, want a 206 of 2345", w.Code, w.Body.String())
+		}
+		if cr := w.Header().Get("Content-Range"); cr != "bytes 2-5/10" {
+			t.Errorf("Content-Range %q", cr)
+		}
+		if w.Header().Get("X-Cache") != status {
+			t.Errorf("range request %s, want a %s", w.Header().Get("X-Cache"), status)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("S3 asked %d times, want once", n)
+	}
+
+	// another range is a separate entry
+	w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=-3"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "789" {
+		t.Errorf("got %d %q, want a 206 of 789", w.Code, w.Body.String())
+	}
+}
+
+func TestMergedRanges(t *testing.T) {
+	const object = "0123456789abcdefghijklmnopqrstuvwxyzABCD"
+	var asked []string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.Header.Get("Range")+" "+r.Header.Get("If-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(object))
+	}))
+	conf.CacheStatusHeader = "X-Cache"
+	cache = newObjectCache(time.Minute, 1024, 1<<20, 0)
+	cache.rangeMax = 30
+
+	get := func(rng string) *httptest.ResponseRecorder {
+		return serve("GET", "/show/ep1.ts", http.Header{"Range": {rng}})
+	}
+	get("bytes=0-9")
+	get("bytes=20-24")
+	asked = nil
+
+	// only the gaps between and after what is cached come from S3
+	w := get("bytes=5-29")
+	if w.Code != http.StatusPartialContent || w.Body.String() != object[5:30] {
+		t.Errorf("got %d %q, want a 206 of %q", w.Code, w.Body.String(), object[5:30])
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 5-29/40" || w.Header().Get("X-Cache") != cachePartial {
+		t.Errorf("Content-Range %q with status %q", cr, w.Header().Get("X-Cache"))
+	}
+	if strings.Join(asked, ",") != `bytes=10-19 "v1",bytes=25-29 "v1"` {
+		t.Errorf("S3 asked for %q, want the two gaps pinned to the cached version", asked)
+	}
+
+	// now merged, so served without S3
+	asked = nil
+	if w := get("bytes=0-29"); w.Body.String() != object[:30] || len(asked) != 0 {
+		t.Errorf("got %q asking S3 for %q", w.Body.String(), asked)
+	}
+}
+
+func TestPartialObjectAdd(t *testing.T) {
+	p := &partialObject{}
+	p.add(10, []byte("abcde"), 20)
+	p.add(0, []byte("01234"), 20)
+	// touching spans merge
+	p.add(15, []byte("fgh"), 20)
+	if len(p.spans) != 2 || p.spans[1].first != 10 || string(p.spans[1].data) != "abcdefgh" || p.size != 13 {
+		t.Fatalf("spans %+v of %d bytes", p.spans, p.size)
+	}
+
+	// over the limit the span furthest from the new one goes
+	p.add(30, []byte("0123456789"), 20)
+	if len(p.spans) != 2 || p.spans[0].first != 10 || p.size != 18 {
+		t.Errorf("spans %+v of %d bytes, want the one at 0 dropped", p.spans, p.size)
+	}
+
+	pieces := p.pieces(8, 32)
+	var got []string
+	for _, s := range pieces {
+		got = append(got, fmt.Sprintf("%d:%s", s.first, s.data))
+	}
+	if strings.Join(got, " ") != "8: 10:abcdefgh 18: 30:012" {
+		t.Errorf("pieces %q", got)
+	}
+}
+
+func TestRequestCacheDirectives(t *testing.T) {
+	var fetches atomic.Int32
+	cachedObject(t, &fetches, nil)
+	cache = newObjectCache(time.Minute, 1024, 1<<20, 0)
+	serve("GET", "/show/ep1.ts", nil)
+
+	// no-cache has even a fresh copy revalidated
+	for _, h := range []http.Header{
+		{"Cache-Control": {"max-age=0, no-cache"}},
+		{"Pragma": {"no-cache"}},
+	} {
+		w := serve("GET", "/show/ep1.ts", h)
+		if w.Header().Get("X-Cache") != cacheRevalidated || w.Body.String() != "0123456789" {
+			t.Errorf("%v: %s %q, want it REVALIDATED", h, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+	if n := fetches.Load(); n != 3 {
+		t.Errorf("S3 asked %d times, want 3", n)
+	}
+
+	// no-store leaves the cache alone both ways
+	w := serve("GET", "/show/ep2.ts", http.Header{"Cache-Control": {"no-store"}})
+	if w.Header().Get("X-Cache") != cacheMiss || w.Body.String() != "0123456789" {
+		t.Errorf("no-store request %s %q, want a MISS", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if _, ok := cache.get("/show/ep2.ts"); ok {
+		t.Error("no-store response cached")
+	}
+	if w := serve("GET", "/show/ep1.ts", http.Header{"Cache-Control": {"no-store"}}); w.Header().Get("X-Cache") != cacheMiss {
+		t.Errorf("no-store request %s, want it fetched afresh", w.Header().Get("X-Cache"))
+	}
+
+	// Pragma only counts without a Cache-Control
+	if w := serve("GET", "/show/ep1.ts", http.Header{"Cache-Control": {"max-age=60"}, "Pragma": {"no-cache"}}); w.Header().Get("X-Cache") != cacheHit {
+		t.Errorf("Pragma overrode Cache-Control, %s", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var fetches atomic.Int32
+	cachedObject(t, &fetches, nil)
+	cache = newObjectCache(time.Minute, 1024, 1<<20, 0)
+	for _, target := range []string{"/show/ep1.ts", "/show/ep2.ts", "/other/ep1.ts"} {
+		serve("GET", target, nil)
+	}
+	serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-1"}})
+
+	purge := func(method, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		purgeHandler(w, httptest.NewRequest(method, "/cache/purge?key="+key, nil))
+		return w
+	}
+	if w := purge("GET", "/show/ep1.ts"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got %d, want a 405", w.Code)
+	}
+	if w := purge("POST", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("no key got %d, want a 400", w.Code)
+	}
+
+	// the object goes along with its range
+	if w := purge("PURGE", "/show/ep1.ts"); w.Body.String() != "{\"purged\":2}\n" {
+		t.Errorf("purged %s, want 2", w.Body.String())
+	}
+	if w := purge("POST", "/show/*"); w.Body.String() != "{\"purged\":1}\n" {
+		t.Errorf("purged %s under the prefix, want 1", w.Body.String())
+	}
+	if _, ok := cache.get("/other/ep1.ts"); !ok {
+		t.Error("object outside the prefix purged")
+	}
+	if w := serve("GET", "/show/ep2.ts", nil); w.Header().Get("X-Cache") != cacheMiss {
+		t.Errorf("purged object a %s, want a MISS", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newObjectCache(time.Minute, 10, 30, 0)
+	body := []byte("0123456789")
+	for _, path := range []string{"/a.ts", "/b.ts", "/c.ts"} {
+		c.set(path, "", 200, http.Header{}, body)
+	}
+	// a is used again, leaving b the least recently used
+	c.get("/a.ts")
+	c.set("/d.ts", "", 200, http.Header{}, body)
+	c.set("/e.ts", "", 200, http.Header{}, body)
+
+	for path, want := range map[string]bool{"/a.ts": true, "/b.ts": false, "/c.ts": false, "/d.ts": true, "/e.ts": true} {
+		if _, ok := c.entries[path]; ok != want {
+			t.Errorf("%s cached %v, want %v", path, ok, want)
+		}
+	}
+	if c.lru.Len() != 3 || c.size != 30 {
+		t.Errorf("%d entries of %d bytes, want 3 of 30", c.lru.Len(), c.size)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestCacheDirectives parses the no-cache and no-store directives of a
+// request's Cache-Control, falling back to Pragma: no-cache for HTTP/1.0
+// clients when there is none.  no-cache has a cached copy revalidated
+// with S3 before it is served, no-store keeps the request away from the
+// cache altogether.
+func requestCacheDirectives(h http.Header) (noCache, noStore bool) {
+	cc := h.Values("Cache-Control")
+	if len(cc) == 0 {
+		for _, v := range h.Values("Pragma") {
+			for _, d := range strings.Split(v, ",") {
+				noCache = noCache || strings.EqualFold(strings.TrimSpace(d), "no-cache")
+			}
+		}
+		return noCache, false
+	}
+	for _, v := range cc {
+		for _, d := range strings.Split(v, ",") {
+			// no-cache may list header names, which don't matter to us
+			name := strings.TrimSpace(strings.SplitN(d, "=", 2)[0])
+			switch strings.ToLower(name) {
+			case "no-cache":
+				noCache = true
+			case "no-store":
+				noStore = true
+			}
+		}
+	}
+	return noCache, noStore
+}
+
+// responseMaxAge returns the max-age directive of a response's
+// Cache-Control, if it has a valid one
+func responseMaxAge(h http.Header) (time.Duration, bool) {
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if !strings.EqualFold(name, "max-age") {
+				continue
+			}
+			secs, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || secs < 0 {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// cacheTTLRule overrides CacheTTL for the objects it matches.  Path rules
+// take a pattern as for metrics path buckets, content type rules a media
+// type or a "type/*" wildcard.
+type cacheTTLRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// parseCacheTTLRules parses a comma separated list of pattern=duration
+// pairs, e.g. "*.m3u8=5s,*.ts=6h"
+func parseCacheTTLRules(s string) ([]cacheTTLRule, error) {
+	var rules []cacheTTLRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("expected pattern=duration, got %q", item)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid duration in %q", item)
+		}
+		pattern := strings.TrimSpace(kv[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		rules = append(rules, cacheTTLRule{Pattern: pattern, TTL: ttl})
+	}
+	return rules, nil
+}
+
+// contentTypeMatch matches a Content-Type against a media type or a
+// "type/*" wildcard, ignoring parameters and case
+func contentTypeMatch(pattern, contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	pattern = strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mt, pattern[:len(pattern)-1])
+	}
+	return mt == pattern
+}
+
+// cacheTTL returns how long a response for the object at upath is cached
+// for.  The first matching path rule wins, then the first matching
+// content type rule, otherwise it is def.
+func cacheTTL(upath string, header http.Header, def time.Duration) time.Duration {
+	for _, r := range conf.CacheTTLByPath {
+		if pathMatch(r.Pattern, upath) {
+			return r.TTL
+		}
+	}
+	if ct := header.Get("Content-Type"); ct != "" {
+		for _, r := range conf.CacheTTLByContentType {
+			if contentTypeMatch(r.Pattern, ct) {
+				return r.TTL
+			}
+		}
+	}
+	return def
+}
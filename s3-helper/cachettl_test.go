@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheTTLRules(t *testing.T) {
+	prev := conf
+	defer func() { conf = prev }()
+	var err error
+	if conf.CacheTTLByPath, err = parseCacheTTLRules("*.m3u8=5s, /live/=0s"); err != nil {
+		t.Fatal(err)
+	}
+	if conf.CacheTTLByContentType, err = parseCacheTTLRules("video/*=6h"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, contentType string
+		want              time.Duration
+	}{
+		{"/show/index.m3u8", "video/mp2t", 5 * time.Second},
+		{"/live/seg1.ts", "video/mp2t", 0},
+		{"/show/seg1.ts", "video/MP2T; charset=binary", 6 * time.Hour},
+		{"/show/poster.jpg", "image/jpeg", time.Minute},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Content-Type": {tt.contentType}}
+		if got := cacheTTL(tt.path, h, time.Minute); got != tt.want {
+			t.Errorf("cacheTTL(%q, %q) = %v, want %v", tt.path, tt.contentType, got, tt.want)
+		}
+	}
+	if _, err := parseCacheTTLRules("*.m3u8"); err == nil {
+		t.Error("rule without a TTL parsed")
+	}
+}
+
+func TestCacheEnabledByRulesAlone(t *testing.T) {
+	prevConf, prevCache := conf, cache
+	defer func() { conf, cache = prevConf, prevCache }()
+	conf.CacheTTL = 0
+	conf.CacheMaxBytes = 1 << 20
+	conf.CacheTTLByPath, _ = parseCacheTTLRules("*.m3u8=5s")
+	cache = nil
+	initCache()
+	if cache == nil {
+		t.Fatal("no cache with a TTL rule and no cache_ttl")
+	}
+
+	h := http.Header{"Etag": {`"abc"`}}
+	cache.set("/show/index.m3u8", "", http.StatusOK, h, nil)
+	cache.set("/show/seg1.ts", "", http.StatusOK, h, nil)
+	if _, ok := cache.get("/show/index.m3u8"); !ok {
+		t.Error("object matching the rule not cached")
+	}
+	if _, ok := cache.get("/show/seg1.ts"); ok {
+		t.Error("object matching no rule cached without cache_ttl")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Header allowlisted clients can use to ask for extra latency
+const chaosLatencyHeader = "X-Chaos-Latency"
+
+// chaosEnabled is only set by the -chaos flag, so the chaos settings can't
+// take effect from the config by accident
+var chaosEnabled bool
+
+// Clients allowed to use the chaos header
+var chaosAllow []*net.IPNet
+
+// initChaos validates the chaos settings and reports loudly when chaos is
+// active
+func initChaos() {
+	if conf.ChaosAllowCIDRs != "" {
+		nets, err := parseCIDRs(conf.ChaosAllowCIDRs)
+		if err != nil {
+			exitConfig("S3_CHAOS_ALLOW_CIDRS", err)
+		}
+		chaosAllow = nets
+	}
+	if conf.ChaosErrorRate < 0 || conf.ChaosErrorRate > 1 {
+		exitConfig("S3_CHAOS_ERROR_RATE", fmt.Errorf("%v is not between 0 and 1", conf.ChaosErrorRate))
+	}
+
+	if !chaosEnabled {
+		if conf.ChaosLatency > 0 || conf.ChaosErrorRate > 0 || chaosAllow != nil {
+			log.Warn().Msg("Chaos settings are ignored without the -chaos flag")
+		}
+		return
+	}
+	log.Warn().
+		Dur("latency", conf.ChaosLatency).
+		Float64("error_rate", conf.ChaosErrorRate).
+		Str("allow", conf.ChaosAllowCIDRs).
+		Msg("CHAOS TESTING IS ACTIVE, requests will be delayed and failed on purpose")
+}
+
+// chaosError reports whether this request should fail on purpose
+func chaosError() bool {
+	return chaosEnabled && conf.ChaosErrorRate > 0 && rand.Float64() < conf.ChaosErrorRate
+}
+
+// chaosDelay sleeps for the configured latency, or for the latency an
+// allowlisted client asked for
+func chaosDelay(r *http.Request, logger zerolog.Logger) {
+	if !chaosEnabled {
+		return
+	}
+	delay := conf.ChaosLatency
+	if v := r.Header.Get(chaosLatencyHeader); v != "" && ipAllowed(chaosAllow, clientIP(r)) {
+		if d, err := time.ParseDuration(v); err == nil {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		logger.Debug().Dur("delay", delay).Msg("Chaos latency")
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"strings"
+)
+
+// Checksum headers S3 returns for objects uploaded with a checksum, in
+// order of preference
+var checksumHeaders = []struct {
+	header string
+	hash   func() hash.Hash
+}{
+	{"X-Amz-Checksum-Sha256", sha256.New},
+	{"X-Amz-Checksum-Sha1", sha1.New},
+	{"X-Amz-Checksum-Crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	{"X-Amz-Checksum-Crc32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// checksumVerifier computes an object's checksum as its body streams
+// through, to compare with the one S3 has for it
+type checksumVerifier struct {
+	hash.Hash
+	algo string
+	want string
+	// counts mismatches
+	failures *expvar.Int
+}
+
+// newChecksumVerifier returns a verifier for the checksum S3 reported in
+// header, nil when there is none.  Checksums of multipart uploads are
+// checksums of the parts' checksums, "<checksum>-<parts>", and can't be
+// verified against the body.
+func newChecksumVerifier(header http.Header) *checksumVerifier {
+	for _, c := range checksumHeaders {
+		want := header.Get(c.header)
+		if want == "" || strings.Contains(want, "-") {
+			continue
+		}
+		return &checksumVerifier{
+			Hash: c.hash(),
+			algo: strings.ToLower(strings.TrimPrefix(c.header, "X-Amz-Checksum-")),
+			want: want,
+
+			failures: metricChecksumFailures,
+		}
+	}
+	return nil
+}
+
+// newContentMD5Verifier returns a verifier for the MD5 of legacy objects
+// without a checksum, nil when there is none to be had.  S3 doesn't return
+// a Content-MD5 on GETs, but the ETag of an object uploaded in one part
+// is its MD5 in hex unless it is encrypted with KMS or a customer key.
+// Multipart ETags end in "-<parts>".  A Content-MD5 is used when there
+// is one, as some S3-compatible stores return it.
+func newContentMD5Verifier(header http.Header) *checksumVerifier {
+	want := header.Get("Content-Md5")
+	if sum, err := base64.StdEncoding.DecodeString(want); err != nil || len(sum) != md5.Size {
+		want = etagMD5(header)
+	}
+	if want == "" {
+		return nil
+	}
+	return &checksumVerifier{Hash: md5.New(), algo: "md5", want: want, failures: metricContentMD5Failures}
+}
+
+// etagMD5 returns the MD5 an object's ETag stands for, base64 encoded
+// like a Content-MD5, or "" when the ETag isn't one
+func etagMD5(header http.Header) string {
+	if sse := header.Get("X-Amz-Server-Side-Encryption"); strings.HasPrefix(sse, "aws:kms") {
+		return ""
+	}
+	if header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return ""
+	}
+	etag := strings.Trim(header.Get("ETag"), `"`)
+	sum, err := hex.DecodeString(etag)
+	if err != nil || len(sum) != md5.Size {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// got returns the checksum of what was written so far, encoded like S3's
+func (v *checksumVerifier) got() string {
+	return base64.StdEncoding.EncodeToString(v.Sum(nil))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChecksumVerified(t *testing.T) {
+	body := []byte("0123456789")
+	sum := sha256.Sum256(body)
+	checksum := base64.StdEncoding.EncodeToString(sum[:])
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Checksum-Mode") != "ENABLED" {
+			t.Error("checksums not asked for")
+		}
+		if r.URL.Path == "/bucket/corrupt.ts" {
+			w.Header().Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+		} else {
+			w.Header().Set("X-Amz-Checksum-Sha256", checksum)
+		}
+		w.Write(body)
+	}))
+	conf.VerifyChecksums = true
+
+	before := metricChecksumFailures.Value()
+	if w := serve("GET", "/show/ep1.ts", nil); w.Body.String() != string(body) {
+		t.Errorf("got %q", w.Body.String())
+	}
+	if n := metricChecksumFailures.Value() - before; n != 0 {
+		t.Errorf("%d checksum failures on a matching body", n)
+	}
+
+	logs := captureLog(t)
+	serve("GET", "/corrupt.ts", nil)
+	if n := metricChecksumFailures.Value() - before; n != 1 {
+		t.Errorf("%d checksum failures counted, want 1", n)
+	}
+	if fields := logged(logs, "Checksum mismatch on body from S3"); fields == nil || fields["algorithm"] != "sha256" {
+		t.Errorf("mismatch logged as %v", fields)
+	}
+}
+
+func TestContentMD5Verifier(t *testing.T) {
+	body := []byte("segment data")
+	sum := md5.Sum(body)
+	hexETag := `"` + hex.EncodeToString(sum[:]) + `"`
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"single part ETag", http.Header{"Etag": {hexETag}}, b64},
+		{"Content-MD5", http.Header{"Content-Md5": {b64}, "Etag": {`"abc-2"`}}, b64},
+		{"multipart ETag", http.Header{"Etag": {`"` + hex.EncodeToString(sum[:]) + `-3"`}}, ""},
+		{"KMS", http.Header{"Etag": {hexETag}, "X-Amz-Server-Side-Encryption": {"aws:kms"}}, ""},
+		{"SSE-C", http.Header{"Etag": {hexETag}, "X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}}, ""},
+		{"SSE-S3", http.Header{"Etag": {hexETag}, "X-Amz-Server-Side-Encryption": {"AES256"}}, b64},
+		{"no ETag", http.Header{}, ""},
+	}
+	for _, tt := range tests {
+		v := newContentMD5Verifier(tt.header)
+		if tt.want == "" {
+			if v != nil {
+				t.Errorf("%s: got a verifier for %q", tt.name, v.want)
+			}
+			continue
+		}
+		if v == nil {
+			t.Errorf("%s: no verifier", tt.name)
+			continue
+		}
+		v.Write(body)
+		if v.want != tt.want || v.got() != tt.want {
+			t.Errorf("%s: want %q, got %q computed %q", tt.name, tt.want, v.want, v.got())
+		}
+	}
+}
+
+func TestChecksumMismatchNotCached(t *testing.T) {
+	body := "segment data"
+	sum := md5.Sum([]byte("other data"))
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		io.WriteString(w, body)
+	}))
+	conf.VerifyContentMD5 = true
+	cache = newObjectCache(time.Minute, 1<<20, 1<<20, 0)
+
+	before := metricContentMD5Failures.Value()
+	forwardToS3(httptest.NewRecorder(), httptest.NewRequest("GET", "/show/ep1.ts", nil))
+	if metricContentMD5Failures.Value() != before+1 {
+		t.Error("mismatch not counted")
+	}
+	if e, ok := cache.lookup("/show/ep1.ts"); ok && e.body != nil {
+		t.Error("body with a bad MD5 cached")
+	}
+}
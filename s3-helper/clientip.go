@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Proxies in front of us, e.g. nginx or CloudFront, whose X-Forwarded-For
+// is taken for the client address
+var trustedProxies []*net.IPNet
+
+// initTrustedProxies sets up the proxies X-Forwarded-For is trusted from
+func initTrustedProxies() {
+	if conf.TrustedProxyCIDRs == "" {
+		return
+	}
+	nets, err := parseCIDRs(conf.TrustedProxyCIDRs)
+	if err != nil {
+		exitConfig("S3_TRUSTED_PROXY_CIDRS", err)
+	}
+	trustedProxies = nets
+	log.Info().Msg(fmt.Sprintf("Taking client addresses from X-Forwarded-For of %s", conf.TrustedProxyCIDRs))
+}
+
+// clientIP returns the address of the client behind r.  That is the host
+// part of its remote address, unless it is a trusted proxy.  Then it is
+// the last address in X-Forwarded-For not of a trusted proxy, as earlier
+// ones are whatever the client sent.  The rate limits, access lists and
+// access log all go by it.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if len(trustedProxies) == 0 || !ipAllowed(trustedProxies, host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !ipAllowed(trustedProxies, hop) {
+			break
+		}
+	}
+	return host
+}
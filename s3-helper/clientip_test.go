@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	prev := trustedProxies
+	defer func() { trustedProxies = prev }()
+
+	tests := []struct {
+		trusted, remote, xff, want string
+	}{
+		{"", "192.0.2.1:40000", "198.51.100.7", "192.0.2.1"},
+		{"10.0.0.0/8", "192.0.2.1:40000", "198.51.100.7", "192.0.2.1"},
+		{"10.0.0.0/8", "10.0.0.2:40000", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.0/8", "10.0.0.2:40000", "203.0.113.9, 198.51.100.7, 10.0.0.3", "198.51.100.7"},
+		{"10.0.0.0/8", "10.0.0.2:40000", "", "10.0.0.2"},
+		{"10.0.0.0/8", "10.0.0.2:40000", "not-an-ip, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.0/8", "10.0.0.2:40000", "10.0.0.5", "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		trustedProxies, _ = parseCIDRs(tt.trusted)
+		r := httptest.NewRequest("GET", "/show/ep1.ts", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("trusted %q, from %s with %q: got %s, want %s", tt.trusted, tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitPerForwardedClient(t *testing.T) {
+	prevConf, prevProxies := conf, trustedProxies
+	defer func() { conf, trustedProxies = prevConf, prevProxies }()
+	trustedProxies, _ = parseCIDRs("10.0.0.0/8")
+	conf.ClientRateLimit = 1
+	conf.ClientRateBurst = 1
+	conf.ThrottleStatus = 429
+
+	// two clients behind the same proxy each get their own burst
+	for _, client := range []string{"198.51.100.7", "198.51.100.8"} {
+		r := httptest.NewRequest("GET", "/show/ep1.ts", nil)
+		r.RemoteAddr = "10.0.0.2:40000"
+		r.Header.Set("X-Forwarded-For", client)
+		release, ok := admit(httptest.NewRecorder(), r, r.URL.Path)
+		if !ok {
+			t.Errorf("%s throttled", client)
+			continue
+		}
+		release()
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Request header CloudFront sets on origin requests, identifying the
+// viewer request it is made for
+const cloudFrontIDHeader = "X-Amz-Cf-Id"
+
+// cloudFrontID returns the CloudFront request ID of r, empty when the
+// request didn't come through CloudFront
+func cloudFrontID(r *http.Request) string {
+	return r.Header.Get(cloudFrontIDHeader)
+}
+
+// tagCloudFrontID passes the CloudFront request ID on to S3 in the
+// User-Agent, which ends up in S3 server access logs.  The User-Agent
+// isn't signed so it can be set after signing.
+func tagCloudFrontID(req *http.Request, id string) {
+	if id == "" || !conf.CloudFrontForwardID {
+		return
+	}
+	req.Header.Set("User-Agent", serverName+" cf-id/"+id)
+}
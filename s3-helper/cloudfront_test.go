@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCloudFrontID(t *testing.T) {
+	var userAgent string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	logs := captureLog(t)
+	cf := http.Header{"X-Amz-Cf-Id": {"abc123=="}}
+
+	serve("GET", "/show/ep1.ts", cf)
+	if fields := logged(logs, "Request started"); fields == nil || fields["cf-id"] != "abc123==" {
+		t.Errorf("logged as %v, want the cf-id", fields)
+	}
+	if userAgent == serverName+" cf-id/abc123==" {
+		t.Error("cf-id passed on to S3 without cloudfront_forward_id")
+	}
+
+	conf.CloudFrontForwardID = true
+	serve("GET", "/show/ep1.ts", cf)
+	if userAgent != serverName+" cf-id/abc123==" {
+		t.Errorf("User-Agent %q, want the cf-id in it", userAgent)
+	}
+
+	// nothing to pass on without CloudFront in front
+	serve("GET", "/show/ep1.ts", nil)
+	if userAgent == serverName+" cf-id/" {
+		t.Errorf("User-Agent %q for a request without a cf-id", userAgent)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Supported content codings, in order of preference
+var compressionCodecs = []string{"br", "gzip"}
+
+// Content types compressed by default, entries ending in "/" match a
+// whole family
+const compressTypesDefault = "text/,application/json,application/xml,application/dash+xml," +
+	"application/vnd.apple.mpegurl,application/x-mpegurl,image/svg+xml"
+
+// parseCodecs validates a comma separated list of codecs, keeping them in
+// our order of preference
+func parseCodecs(s string) ([]string, error) {
+	enabled := make(map[string]bool)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		known := false
+		for _, codec := range compressionCodecs {
+			known = known || codec == c
+		}
+		if !known {
+			return nil, fmt.Errorf("unsupported codec %q", c)
+		}
+		enabled[c] = true
+	}
+
+	var codecs []string
+	for _, codec := range compressionCodecs {
+		if enabled[codec] {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs, nil
+}
+
+// compressSize reports whether a response of length bytes is worth
+// compressing, between CompressMinBytes and CompressMaxBytes when the
+// latter is set.  A length of -1 means it isn't known, and such streamed
+// responses are left to the content type check alone.
+func compressSize(length int64) bool {
+	if length < 0 {
+		return true
+	}
+	if length < conf.CompressMinBytes {
+		return false
+	}
+	return conf.CompressMaxBytes <= 0 || length <= conf.CompressMaxBytes
+}
+
+// compressible reports whether responses of contentType may be compressed
+func compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range conf.CompressTypes {
+		if mt == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mt, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the most preferred enabled codec the client
+// accepts, or "" when the response should go out as is
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q > 0
+	}
+
+	for _, codec := range conf.CompressionCodecs {
+		if ok, listed := accepted[codec]; ok || (!listed && accepted["*"]) {
+			return codec
+		}
+	}
+	return ""
+}
+
+// Compression level picking each codec's own default
+const compressionLevelDefault = -1
+
+// checkCompressionLevel validates level against the range of every codec
+// in codecs
+func checkCompressionLevel(level int, codecs []string) error {
+	if level == compressionLevelDefault {
+		return nil
+	}
+	for _, codec := range codecs {
+		min, max := gzip.HuffmanOnly, gzip.BestCompression
+		if codec == "br" {
+			min, max = brotli.BestSpeed, brotli.BestCompression
+		}
+		if level < min || level > max {
+			return fmt.Errorf("level %d out of range %d to %d for %s", level, min, max, codec)
+		}
+	}
+	return nil
+}
+
+// resetWriteCloser is an encoder that can be reused on another writer
+type resetWriteCloser interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Encoders at CompressionLevel by codec, their windows and tables are too
+// large to allocate for every response
+var compressorPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		level := conf.CompressionLevel
+		if level == compressionLevelDefault {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(io.Discard, level)
+	}},
+	"gzip": {New: func() interface{} {
+		// the level was validated at startup
+		zw, _ := gzip.NewWriterLevel(io.Discard, conf.CompressionLevel)
+		return zw
+	}},
+}
+
+// pooledCompressor hands its encoder back to the pool once closed
+type pooledCompressor struct {
+	resetWriteCloser
+	pool *sync.Pool
+}
+
+func (pc *pooledCompressor) Close() error {
+	err := pc.resetWriteCloser.Close()
+	pc.resetWriteCloser.Reset(io.Discard)
+	pc.pool.Put(pc.resetWriteCloser)
+	return err
+}
+
+// newCompressor wraps w with an encoder for the given codec, which must
+// be closed to flush it and return it to its pool
+func newCompressor(codec string, w io.Writer) io.WriteCloser {
+	pool, ok := compressorPools[codec]
+	if !ok {
+		return nil
+	}
+	enc := pool.Get().(resetWriteCloser)
+	enc.Reset(w)
+	return &pooledCompressor{resetWriteCloser: enc, pool: pool}
+}
+
+// addVary adds names to the Vary header of a response, skipping any that
+// are already listed
+func addVary(h http.Header, names ...string) {
+	listed := make(map[string]bool)
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			listed[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name != "" && !listed[name] {
+			h.Add("Vary", name)
+			listed[name] = true
+		}
+	}
+}
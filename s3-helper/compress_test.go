@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	defer func(c []string) { conf.CompressionCodecs = c }(conf.CompressionCodecs)
+	conf.CompressionCodecs = []string{"br", "gzip"}
+
+	tests := map[string]string{
+		"":                   "",
+		"gzip":               "gzip",
+		"gzip, deflate, br":  "br",
+		"br;q=0, gzip":       "gzip",
+		"*":                  "br",
+		"br;q=0, *":          "gzip",
+		"identity":           "",
+		"deflate, compress":  "",
+		"GZIP;q=0.5":         "gzip",
+		"br;q=0, gzip;q=0.0": "",
+	}
+	for accept, want := range tests {
+		if got := negotiateEncoding(accept); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressedResponse(t *testing.T) {
+	manifest := strings.Repeat("#EXTINF:6.0,\nseg.ts\n", 50)
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(manifest))
+	}))
+	conf.CompressionCodecs = []string{"br", "gzip"}
+	conf.CompressTypes = strings.Split(compressTypesDefault, ",")
+
+	decoders := map[string]func(io.Reader) io.Reader{
+		"br": func(r io.Reader) io.Reader { return brotli.NewReader(r) },
+		"gzip": func(r io.Reader) io.Reader {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return zr
+		},
+	}
+	for codec, decode := range decoders {
+		w := serve("GET", "/show/index.m3u8", http.Header{"Accept-Encoding": {codec}})
+		if w.Header().Get("Content-Encoding") != codec || w.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: Content-Encoding %q with length %q", codec,
+				w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"))
+		}
+		if w.Header().Get("ETag") != `W/"v1"` {
+			t.Errorf("%s: ETag %s, want it weakened", codec, w.Header().Get("ETag"))
+		}
+		if body, _ := io.ReadAll(decode(w.Body)); string(body) != manifest {
+			t.Errorf("%s: decoded %d bytes, want the manifest", codec, len(body))
+		}
+	}
+
+	// ranges go out as they are
+	w := serve("GET", "/show/index.m3u8", http.Header{"Accept-Encoding": {"br"}, "Range": {"bytes=0-9"}})
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("ranged response compressed with %s", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestIncompressibleType(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write([]byte("0123456789"))
+	}))
+	conf.CompressionCodecs = []string{"br", "gzip"}
+	conf.CompressTypes = strings.Split(compressTypesDefault, ",")
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"Accept-Encoding": {"br, gzip"}})
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "0123456789" {
+		t.Errorf("video compressed with %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompressSizeRange(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sizes := map[string]int{"/bucket/small.json": 500, "/bucket/medium.json": 1200, "/bucket/large.json": 1900}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strings.Repeat("x", sizes[r.URL.Path])))
+	}))
+	conf.CompressionCodecs = []string{"gzip"}
+	conf.CompressTypes = strings.Split(compressTypesDefault, ",")
+	conf.CompressMinBytes = 1000
+	conf.CompressMaxBytes = 1500
+
+	for target, want := range map[string]string{"/small.json": "", "/medium.json": "gzip", "/large.json": ""} {
+		w := serve("GET", target, http.Header{"Accept-Encoding": {"gzip"}})
+		if got := w.Header().Get("Content-Encoding"); got != want {
+			t.Errorf("%s compressed with %q, want %q", target, got, want)
+		}
+	}
+
+	// streamed bodies of unknown length go by content type
+	if !compressSize(-1) {
+		t.Error("unknown length not compressed")
+	}
+}
+
+func TestVary(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".json") {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "video/mp2t")
+		}
+		w.Write([]byte(strings.Repeat("x", 2000)))
+	}))
+	conf.CompressionCodecs = []string{"gzip"}
+	conf.CompressTypes = strings.Split(compressTypesDefault, ",")
+	conf.VaryHeaders = []string{"origin", " Origin", "Accept-Encoding"}
+
+	// a client that can't take gzip still needs to know it varies
+	w := serve("GET", "/show/data.json", nil)
+	if vary := w.Header().Values("Vary"); strings.Join(vary, ",") != "Origin,Accept-Encoding" {
+		t.Errorf("Vary %q, want Origin and Accept-Encoding once each", vary)
+	}
+
+	conf.VaryHeaders = []string{"Origin"}
+	w = serve("GET", "/show/ep1.ts", http.Header{"Accept-Encoding": {"gzip"}})
+	if vary := w.Header().Values("Vary"); strings.Join(vary, ",") != "Origin" {
+		t.Errorf("Vary %q for an incompressible type, want only Origin", vary)
+	}
+}
+
+// manifestBody is a media playlist of the size compression is aimed at
+func manifestBody() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:6\n")
+	for i := 0; buf.Len() < 64<<10; i++ {
+		fmt.Fprintf(&buf, "#EXTINF:6.006,\n/show/ep1/seg-%05d.ts\n", i)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkCompressionLevels(b *testing.B) {
+	body := manifestBody()
+	encoders := []struct {
+		codec  string
+		levels []int
+		new    func(level int) resetWriteCloser
+	}{
+		{"gzip", []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression},
+			func(level int) resetWriteCloser {
+				zw, _ := gzip.NewWriterLevel(io.Discard, level)
+				return zw
+			}},
+		{"br", []int{brotli.BestSpeed, brotli.DefaultCompression, brotli.BestCompression},
+			func(level int) resetWriteCloser { return brotli.NewWriterLevel(io.Discard, level) }},
+	}
+	for _, e := range encoders {
+		for _, level := range e.levels {
+			b.Run(fmt.Sprintf("%s-%d", e.codec, level), func(b *testing.B) {
+				enc := e.new(level)
+				var out bytes.Buffer
+				b.SetBytes(int64(len(body)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					out.Reset()
+					enc.Reset(&out)
+					enc.Write(body)
+					enc.Close()
+				}
+				b.ReportMetric(float64(len(body))/float64(out.Len()), "ratio")
+			})
+		}
+	}
+}
+
+func BenchmarkNewCompressor(b *testing.B) {
+	prev := conf.CompressionLevel
+	b.Cleanup(func() { conf.CompressionLevel = prev })
+	conf.CompressionLevel = compressionLevelDefault
+	body := manifestBody()
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			zw := newCompressor("gzip", io.Discard)
+			zw.Write(body)
+			zw.Close()
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			zw, _ := gzip.NewWriterLevel(io.Discard, conf.CompressionLevel)
+			zw.Write(body)
+			zw.Close()
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// ifRangeCondition works out how a client's If-Range is checked with S3.
+// A strong ETag becomes If-Match and a date If-Unmodified-Since, so a 412
+// tells us the object changed.  A weak ETag can never match strongly, so
+// like anything unparseable it means the range is ignored, reported by
+// ok being false.
+func ifRangeCondition(ifRange string) (name, value string, ok bool) {
+	ifRange = strings.TrimSpace(ifRange)
+	switch {
+	case ifRange == "":
+		return "", "", true
+	case strings.HasPrefix(ifRange, "W/"):
+		return "", "", false
+	case strings.HasPrefix(ifRange, `"`):
+		return "If-Match", ifRange, true
+	}
+	if _, err := http.ParseTime(ifRange); err == nil {
+		return "If-Unmodified-Since", ifRange, true
+	}
+	return "", "", false
+}
+
+// ifRangeChanged reports whether S3 failed the If-Range condition of r2,
+// in which case the object changed and the client gets all of it instead
+// of the range.  r2 loses its range and condition so it can be sent again
+// like any retry, and the 412 is closed.
+func ifRangeChanged(resp *http.Response, err error, r2 *http.Request, ifRangeName string, logger zerolog.Logger) bool {
+	if err != nil || resp.StatusCode != http.StatusPreconditionFailed || ifRangeName == "" {
+		return false
+	}
+	ifRange := r2.Header.Get(ifRangeName)
+	if ifRange == "" {
+		return false
+	}
+	resp.Body.Close()
+	r2.Header.Del("Range")
+	r2.Header.Del(ifRangeName)
+	logger.Info().
+		Str("if-range", ifRange).
+		Msg("If-Range didn't match, fetching the whole object")
+	return true
+}
+
+// writeNotModified answers a conditional request with a 304 carrying the
+// validators from header
+func writeNotModified(w http.ResponseWriter, header http.Header) {
+	for _, name := range []string{"ETag", "Last-Modified", "Date"} {
+		if v := header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// changedObject serves a 10 byte object whose ETag is now "v2", recording
+// the If-Match of each request
+func changedObject(t *testing.T, ifMatch *[]string) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*ifMatch = append(*ifMatch, r.Header.Get("If-Match"))
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	var ifMatch []string
+	changedObject(t, &ifMatch)
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"v2"`}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "0123" {
+		t.Errorf("got %d %q, want the range", w.Code, w.Body.String())
+	}
+	if len(ifMatch) != 1 || ifMatch[0] != `"v2"` {
+		t.Errorf("S3 got If-Match %q", ifMatch)
+	}
+}
+
+func TestIfRangeWeakGetsWholeObject(t *testing.T) {
+	var ifMatch []string
+	changedObject(t, &ifMatch)
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-3"}, "If-Range": {`W/"v2"`}})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("got %d %q, want the whole object", w.Code, w.Body.String())
+	}
+	if len(ifMatch) != 1 || ifMatch[0] != "" {
+		t.Errorf("S3 got If-Match %q, want one plain GET", ifMatch)
+	}
+}
+
+func TestIfRangeChangedRefetched(t *testing.T) {
+	var ifMatch []string
+	changedObject(t, &ifMatch)
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"v1"`}})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("got %d %q, want the whole changed object", w.Code, w.Body.String())
+	}
+	if len(ifMatch) != 2 || ifMatch[0] != `"v1"` || ifMatch[1] != "" {
+		t.Errorf("S3 got If-Match %q, want the condition then a plain GET", ifMatch)
+	}
+}
+
+func TestIfNoneMatchWeak(t *testing.T) {
+	var ifMatch []string
+	changedObject(t, &ifMatch)
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"If-None-Match": {`W/"v2"`}})
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != `"v2"` {
+		t.Errorf("got %d with ETag %q, want a 304", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestIfRangeRefetchRetried(t *testing.T) {
+	var ifMatch []string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		// the refetch is turned away once before it gets through
+		if len(ifMatch) == 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"v1"`}})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("got %d %q, want the whole changed object", w.Code, w.Body.String())
+	}
+	if len(ifMatch) != 3 || ifMatch[0] != `"v1"` || ifMatch[1] != "" || ifMatch[2] != "" {
+		t.Errorf("S3 got If-Match %q, want the condition then two plain GETs", ifMatch)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Config sources larger than this are refused
+const configSourceMaxBytes = 1 << 20
+
+// How long fetching a remote config source may take
+const configFetchTimeout = 10 * time.Second
+
+// configCacheDefault is where the last fetched remote config is kept, to
+// start from when the source can't be reached
+func configCacheDefault() string {
+	return filepath.Join(os.TempDir(), "s3-helper-config.env")
+}
+
+// loadConfigSource reads NAME=value settings, e.g. S3_BUCKET=media, from
+// a file or an http(s):// or s3:// URL into the environment the config
+// is read from.  Variables already set in the environment win.  A remote
+// source is copied to cacheFile, which is used instead when it can't be
+// fetched.
+func loadConfigSource(src, cacheFile string) error {
+	u, err := url.Parse(src)
+	remote := err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "s3")
+
+	var body []byte
+	from := src
+	if !remote {
+		body, err = os.ReadFile(src)
+	} else {
+		body, err = fetchConfigSource(u)
+		if err == nil && cacheFile != "" {
+			if werr := os.WriteFile(cacheFile, body, 0600); werr != nil {
+				log.Warn().
+					Str("error", werr.Error()).
+					Msg("Could not keep a copy of the config at " + cacheFile)
+			}
+		}
+		if err != nil && cacheFile != "" {
+			log.Warn().
+				Str("error", err.Error()).
+				Msg(fmt.Sprintf("Could not fetch config from %s, using the copy at %s", u.Redacted(), cacheFile))
+			body, err = os.ReadFile(cacheFile)
+			from = cacheFile
+		}
+		if from == src {
+			from = u.Redacted()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := applyConfigSource(body)
+	if err != nil {
+		return fmt.Errorf("%s: %v", from, err)
+	}
+	log.Info().Msg(fmt.Sprintf("Loaded %d settings from %s", n, from))
+	return nil
+}
+
+// applyConfigSource sets the variables of a config source that aren't set
+// already, skipping blank lines and comments.  It returns how many it set.
+func applyConfigSource(body []byte) (int, error) {
+	n := 0
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(text, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return n, fmt.Errorf("line %d: expected NAME=value", line)
+		}
+		value := strings.TrimSpace(kv[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		os.Setenv(name, value)
+		n++
+	}
+	return n, sc.Err()
+}
+
+// fetchConfigSource fetches a remote config source.  s3://bucket/key is
+// fetched signed, with the region and credentials the environment or the
+// instance provides, as the config that would say otherwise isn't loaded
+// yet.
+func fetchConfigSource(u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "s3" {
+		region, _, err := resolveRegion()
+		if err != nil {
+			return nil, err
+		}
+		creds := envCredentials()
+		if creds.AccessKeyID == "" {
+			if creds, err = imdsCredentials(); err != nil {
+				return nil, err
+			}
+		}
+		s3u := fmt.Sprintf("https://s3.%s.amazonaws.com/%s%s", region, u.Host, u.EscapedPath())
+		if req, err = http.NewRequest("GET", s3u, nil); err != nil {
+			return nil, err
+		}
+		req = v4Signer{}.Sign(req, region, "s3", creds)
+	}
+
+	client := &http.Client{Timeout: configFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, configSourceMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > configSourceMaxBytes {
+		return nil, fmt.Errorf("config exceeds %d bytes", configSourceMaxBytes)
+	}
+	return body, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unsetenv unsets the variables for the test, restoring them after
+func unsetenv(t *testing.T, names ...string) {
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestConfigSourceFile(t *testing.T) {
+	unsetenv(t, "S3HELPER_TEST_BUCKET", "S3HELPER_TEST_PATH")
+	t.Setenv("S3HELPER_TEST_REGION", "eu-west-1")
+	src := filepath.Join(t.TempDir(), "s3helper.env")
+	os.WriteFile(src, []byte("# settings\nS3HELPER_TEST_BUCKET = media\n\n"+
+		"S3HELPER_TEST_PATH=\"/vod\"\nS3HELPER_TEST_REGION=us-east-1\n"), 0600)
+
+	if err := loadConfigSource(src, ""); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"S3HELPER_TEST_BUCKET": "media",
+		"S3HELPER_TEST_PATH":   "/vod",
+		// set already, the environment wins
+		"S3HELPER_TEST_REGION": "eu-west-1",
+	} {
+		if v := os.Getenv(name); v != want {
+			t.Errorf("%s=%q, want %q", name, v, want)
+		}
+	}
+
+	os.WriteFile(src, []byte("S3HELPER_TEST_BUCKET\n"), 0600)
+	if err := loadConfigSource(src, ""); err == nil {
+		t.Error("line without a value accepted")
+	}
+}
+
+func TestConfigSourceURLCached(t *testing.T) {
+	unsetenv(t, "S3HELPER_TEST_BUCKET")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("S3HELPER_TEST_BUCKET=media\n"))
+	}))
+	cacheFile := filepath.Join(t.TempDir(), "config.env")
+
+	if err := loadConfigSource(srv.URL+"/s3helper.env", cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	if v := os.Getenv("S3HELPER_TEST_BUCKET"); v != "media" {
+		t.Errorf("S3HELPER_TEST_BUCKET=%q", v)
+	}
+
+	// once unreachable the copy is used
+	srv.Close()
+	os.Unsetenv("S3HELPER_TEST_BUCKET")
+	if err := loadConfigSource(srv.URL+"/s3helper.env", cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	if v := os.Getenv("S3HELPER_TEST_BUCKET"); v != "media" {
+		t.Errorf("from the copy S3HELPER_TEST_BUCKET=%q", v)
+	}
+	if err := loadConfigSource(srv.URL+"/s3helper.env", ""); err == nil {
+		t.Error("unreachable config without a copy accepted")
+	}
+}
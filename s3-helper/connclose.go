@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Window over which the share of S3 responses closing their connection is
+// judged, and the fewest responses to judge it by
+const (
+	connCloseWindow      = time.Minute
+	connCloseMinRequests = 20
+)
+
+// connCloseWatch counts S3 responses that came with Connection: close
+// while we keep connections alive.  The transport never reuses those
+// connections, but when most responses do it something in between, e.g.
+// a proxy, is likely defeating keep-alives.
+type connCloseWatch struct {
+	mu     sync.Mutex
+	start  time.Time
+	total  int64
+	closed int64
+}
+
+var connCloses = &connCloseWatch{}
+
+// record counts a response, warning about the previous window once its
+// time is up
+func (cw *connCloseWatch) record(resp *http.Response) {
+	if !conf.S3KeepAlives {
+		return
+	}
+	if resp.Close {
+		metricUpstreamConnClose.Add(1)
+	}
+	if conf.ConnCloseWarnRate <= 0 {
+		return
+	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	now := time.Now()
+	if cw.start.IsZero() {
+		cw.start = now
+	}
+	if now.Sub(cw.start) >= connCloseWindow {
+		if cw.total >= connCloseMinRequests && float64(cw.closed) >= conf.ConnCloseWarnRate*float64(cw.total) {
+			log.Warn().
+				Int64("closed", cw.closed).
+				Int64("responses", cw.total).
+				Msg(fmt.Sprintf("S3 closed the connection after %d of %d responses in the last %v, check for a proxy defeating keep-alives",
+					cw.closed, cw.total, now.Sub(cw.start).Round(time.Second)))
+		}
+		cw.start, cw.total, cw.closed = now, 0, 0
+	}
+	cw.total++
+	if resp.Close {
+		cw.closed++
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnCloseCounted(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			w.Header().Set("Connection", "close")
+		}
+		w.Write([]byte("ok"))
+	}))
+	conf.S3KeepAlives = true
+	s3Client.Store(newS3Client())
+	before := metricUpstreamConnClose.Value()
+
+	serve("GET", "/show/ep1.ts", nil)
+	serve("GET", "/show/index.m3u8", nil)
+	if n := metricUpstreamConnClose.Value() - before; n != 1 {
+		t.Errorf("counted %d closes, want 1", n)
+	}
+}
+
+func TestConnCloseWarning(t *testing.T) {
+	prevConf, prevWatch := conf, connCloses
+	t.Cleanup(func() { conf, connCloses = prevConf, prevWatch })
+	conf.S3KeepAlives = true
+	conf.ConnCloseWarnRate = 0.5
+	logs := captureLog(t)
+
+	closing := &http.Response{Close: true}
+	for _, n := range []int{connCloseMinRequests - 1, connCloseMinRequests} {
+		logs.Reset()
+		connCloses = &connCloseWatch{}
+		for i := 0; i < n; i++ {
+			connCloses.record(closing)
+		}
+		// the window is up with the next response
+		connCloses.start = connCloses.start.Add(-connCloseWindow)
+		connCloses.record(&http.Response{})
+
+		warned := logs.Len() > 0
+		if want := n >= connCloseMinRequests; warned != want {
+			t.Errorf("%d closes in a window: warned %v, want %v", n, warned, want)
+		}
+		if connCloses.total != 1 || connCloses.closed != 0 {
+			t.Errorf("window not restarted, %d/%d", connCloses.closed, connCloses.total)
+		}
+	}
+
+	// a minority of closes is fine
+	logs.Reset()
+	connCloses = &connCloseWatch{start: time.Now().Add(-connCloseWindow), total: 100, closed: 10}
+	connCloses.record(closing)
+	if logs.Len() > 0 {
+		t.Errorf("warned about 10%% of responses closing:\n%s", logs)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countedTransport is an S3 transport that knows how many connections it
+// has open, so a replaced one can be closed down once they are done
+type countedTransport struct {
+	*http.Transport
+	open atomic.Int64
+}
+
+// countedConn decrements the open S3 connection counts once closed
+type countedConn struct {
+	net.Conn
+	open *atomic.Int64
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		metricS3Conns.Add(-1)
+		c.open.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// countConns wraps a dial function so the connections it opens are
+// counted in open and the s3_conns metric
+func countConns(open *atomic.Int64, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		metricS3Conns.Add(1)
+		open.Add(1)
+		return &countedConn{Conn: conn, open: open}, nil
+	}
+}
+
+// queueTimeoutError is returned when no response arrived within
+// S3Timeout, which includes waiting for a free connection
+type queueTimeoutError struct {
+	err error
+}
+
+func (e queueTimeoutError) Error() string   { return "timed out waiting for S3: " + e.err.Error() }
+func (e queueTimeoutError) Timeout() bool   { return true }
+func (e queueTimeoutError) Temporary() bool { return true }
+
+// doS3 sends a request with the shared S3 client, failing over to the
+// other endpoints or regions when there are several or to path-style
+// addressing when a virtual host doesn't resolve.  It holds one of the
+// MaxS3Concurrency slots until the response body is closed.
+func doS3(req *http.Request) (*http.Response, error) {
+	return holdS3Slot(req, func(req *http.Request) (*http.Response, error) {
+		if endpoints != nil {
+			return endpoints.doPooled(req)
+		}
+		if replicas != nil {
+			return replicas.doReplicated(req)
+		}
+		resp, err := sendS3(req)
+		if r, ok := pathStyleFallback(req, err); ok {
+			resp, err = sendS3(r)
+		}
+		return resp, err
+	})
+}
+
+// doS3Once is doS3 without any failover, for uploads.  Their body is used
+// up by the first attempt, and a POST of the multipart upload API mustn't
+// reach S3 twice.
+func doS3Once(req *http.Request) (*http.Response, error) {
+	return holdS3Slot(req, sendS3)
+}
+
+// holdS3Slot sends req with send while holding one of the
+// MaxS3Concurrency slots, until the response body is closed
+func holdS3Slot(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	release, err := acquireS3Slot(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := send(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	connCloses.record(resp)
+	resp.Body = &slotBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// sendS3 sends a request with the shared S3 client.  With MaxConnsPerHost
+// set requests may queue for a connection, so waiting for one and for the
+// first response headers is limited to S3Timeout.  The timer is stopped
+// as those arrive, before Do returns, so it can't cut a body short.
+func sendS3(req *http.Request) (*http.Response, error) {
+	if conf.MaxConnsPerHost <= 0 || conf.S3Timeout <= 0 {
+		return s3Client.Load().Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(conf.S3Timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { timer.Stop() },
+	})
+	resp, err := s3Client.Load().Do(req.WithContext(ctx))
+	timer.Stop()
+	if timedOut.Load() {
+		// the headers made it just as the timer went off, the body
+		// would fail to read
+		if err == nil {
+			resp.Body.Close()
+			err = ctx.Err()
+		}
+		return nil, queueTimeoutError{err}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of a request to S3 once its body is
+// closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestS3TimeoutSparesBody(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+	conf.MaxConnsPerHost = 1
+	conf.S3Timeout = 100 * time.Millisecond
+
+	req, _ := http.NewRequest("GET", s3URL("/a/1.ts"), nil)
+	resp, err := sendS3(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "first second" {
+		t.Errorf("got %q, %v: body cut short by the timeout", body, err)
+	}
+}
+
+func TestS3TimeoutWaitingForHeaders(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	conf.MaxConnsPerHost = 1
+	conf.S3Timeout = 100 * time.Millisecond
+
+	req, _ := http.NewRequest("GET", s3URL("/a/1.ts"), nil)
+	_, err := sendS3(req)
+	var qerr queueTimeoutError
+	if !errors.As(err, &qerr) {
+		t.Errorf("got %v, want a queue timeout", err)
+	}
+}
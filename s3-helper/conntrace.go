@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// connTrace records how the connection for an S3 request was come by:
+// whether an idle one was reused, where it goes and how long the DNS
+// lookup and TLS handshake took when it was new
+type connTrace struct {
+	mu       sync.Mutex
+	reused   bool
+	remoteIP string
+	dns      time.Duration
+	tls      time.Duration
+
+	dnsStart, tlsStart time.Time
+}
+
+// traceConns reports whether S3 connections are traced for a request,
+// which is when its logger logs at debug level or metrics are on
+func traceConns(logger zerolog.Logger) bool {
+	return conf.MetricsEnabled || logger.Debug().Enabled()
+}
+
+// trace returns req with its connection being traced
+func (ct *connTrace) trace(req *http.Request) *http.Request {
+	t := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			ct.mu.Lock()
+			ct.dnsStart = time.Now()
+			ct.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			ct.mu.Lock()
+			ct.dns = time.Since(ct.dnsStart)
+			ct.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			ct.mu.Lock()
+			ct.tlsStart = time.Now()
+			ct.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			ct.mu.Lock()
+			ct.tls = time.Since(ct.tlsStart)
+			ct.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			ct.mu.Lock()
+			defer ct.mu.Unlock()
+			ct.reused = info.Reused
+			ct.remoteIP = ""
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+					ct.remoteIP = host
+				}
+			}
+			// a reused connection had no lookup or handshake this time
+			if info.Reused {
+				ct.dns, ct.tls = 0, 0
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), t))
+}
+
+// record logs the connection of the final attempt at debug level and
+// counts it when metrics are on.  ct may be nil.
+func (ct *connTrace) record(logger zerolog.Logger) {
+	if ct == nil {
+		return
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.remoteIP == "" {
+		return
+	}
+	logger.Debug().
+		Bool("conn-reused", ct.reused).
+		Str("remote-ip", ct.remoteIP).
+		Dur("dns", ct.dns).
+		Dur("tls", ct.tls).
+		Msg("S3 connection")
+	if conf.MetricsEnabled {
+		if ct.reused {
+			metricS3ConnsReused.Add(1)
+		} else {
+			metricS3ConnsNew.Add(1)
+			metricS3DNSMillis.Add(ct.dns.Milliseconds())
+			metricS3TLSMillis.Add(ct.tls.Milliseconds())
+		}
+	}
+}
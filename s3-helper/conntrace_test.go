@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestConnectionsTraced(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	conf.MetricsEnabled = true
+	conf.S3KeepAlives = true
+	s3Client.Store(newS3Client())
+	logs := captureLog(t)
+	reused, fresh := metricS3ConnsReused.Value(), metricS3ConnsNew.Value()
+
+	serve("GET", "/show/ep1.ts", nil)
+	fields := logged(logs, "S3 connection")
+	if fields == nil || fields["conn-reused"] != false || fields["remote-ip"] != "127.0.0.1" {
+		t.Errorf("first connection logged as %v", fields)
+	}
+	logs.Reset()
+	serve("GET", "/show/ep1.ts", nil)
+	if fields := logged(logs, "S3 connection"); fields == nil || fields["conn-reused"] != true {
+		t.Errorf("second connection logged as %v, want it reused", fields)
+	}
+	if metricS3ConnsNew.Value()-fresh != 1 || metricS3ConnsReused.Value()-reused != 1 {
+		t.Errorf("counted %d new and %d reused connections, want one each",
+			metricS3ConnsNew.Value()-fresh, metricS3ConnsReused.Value()-reused)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// trackingReader remembers the last error its underlying reader returned,
+// so a failed copy can be blamed on the right side
+type trackingReader struct {
+	io.Reader
+	err error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
+
+// Size of body copy buffers unless CopyBufferSize says otherwise, the same
+// as io.Copy uses
+const copyBufferSizeDefault = 32 << 10
+
+// copyBufPool holds CopyBufferSize byte buffers for copying bodies, so
+// streaming doesn't allocate one per request
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		size := conf.CopyBufferSize
+		if size <= 0 {
+			size = copyBufferSizeDefault
+		}
+		b := make([]byte, size)
+		return &b
+	},
+}
+
+// copyBody copies src to dst through a pooled buffer.  The buffer goes
+// back to the pool only once the copy is done with it.
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	bp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bp)
+	return io.CopyBuffer(dst, src, *bp)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// brokenClient is a client connection that goes away on the first write
+type brokenClient struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenClient) Write([]byte) (int, error) {
+	return 0, errors.New("write: broken pipe")
+}
+
+// expectAbort fails the test unless f aborts the client connection, which
+// a recorder has none of to hijack
+func expectAbort(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("got %v, want the connection aborted", err)
+		}
+	}()
+	f()
+}
+
+// frontend serves forwardToS3 until the test ends.  A handler aborting
+// its connection is no longer tracked by the server, so closing it doesn't
+// wait for that handler to return and they are waited for here.
+func frontend(t *testing.T) *httptest.Server {
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		forwardToS3(w, r)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+	})
+	return srv
+}
+
+func TestClientDisconnectCounted(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	disconnects, readErrors := metricClientDisconnects.Value(), metricUpstreamReadErrors.Value()
+
+	expectAbort(t, func() {
+		forwardToS3(brokenClient{httptest.NewRecorder()}, httptest.NewRequest("GET", "/show/ep1.ts", nil))
+	})
+	if metricClientDisconnects.Value() != disconnects+1 || metricUpstreamReadErrors.Value() != readErrors {
+		t.Error("client disconnect not counted as one")
+	}
+}
+
+func TestUpstreamReadErrorCounted(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("01234"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	disconnects, readErrors := metricClientDisconnects.Value(), metricUpstreamReadErrors.Value()
+
+	expectAbort(t, func() { serve("GET", "/show/ep1.ts", nil) })
+	if metricUpstreamReadErrors.Value() != readErrors+1 || metricClientDisconnects.Value() != disconnects {
+		t.Error("short read from S3 not counted as an upstream error")
+	}
+}
+
+func TestTruncatedBodyResetsConnection(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a chunked body breaking off leaves nothing to tell it apart
+		// from a complete one but the connection reset
+		w.Write([]byte("01234"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	front := frontend(t)
+
+	resp, err := http.Get(front.URL + "/show/ep1.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("read %q as a complete body", body)
+	}
+}
+
+// bodyReader streams src the way a response body does, without the
+// WriteTo that would let io.CopyBuffer skip the buffer
+type bodyReader struct{ io.Reader }
+
+// clientWriter writes to the client, without the ReadFrom of io.Discard
+type clientWriter struct{ io.Writer }
+
+func BenchmarkCopyBufferSizes(b *testing.B) {
+	segment := make([]byte, 4<<20)
+	for _, size := range []int{32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			buf := make([]byte, size)
+			b.SetBytes(int64(len(segment)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				io.CopyBuffer(clientWriter{io.Discard}, bodyReader{bytes.NewReader(segment)}, buf)
+			}
+		})
+	}
+}
+
+func BenchmarkCopyBody(b *testing.B) {
+	segment := make([]byte, 1<<20)
+	b.SetBytes(int64(len(segment)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copyBody(clientWriter{io.Discard}, bodyReader{bytes.NewReader(segment)})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+)
+
+// newCorrelationID returns the ID a request to S3 is tagged with when
+// CorrelationHeader is set, its trace ID when it has one
+func newCorrelationID(traceID string) string {
+	if conf.CorrelationHeader == "" {
+		return ""
+	}
+	if traceID != "" {
+		return traceID
+	}
+	return randomHex(16)
+}
+
+// tagCorrelationID sets CorrelationHeader on a request to S3.  S3 server
+// access logs only record the User-Agent and Referer, which are left
+// unsigned like the CloudFront ID, the ID being added to the former.  Any
+// other header only shows up in logs of a proxy in between.  The request
+// is signed again for it, but go-aws-auth only signs Host, Content-* and
+// X-Amz-* headers, so only an x-amz-* name, which S3 requires to be
+// signed, ends up covered by the signature.
+func tagCorrelationID(req *http.Request, id string) (*http.Request, error) {
+	if id == "" {
+		return req, nil
+	}
+	name := http.CanonicalHeaderKey(conf.CorrelationHeader)
+	switch name {
+	case "User-Agent":
+		ua := req.Header.Get("User-Agent")
+		if ua == "" {
+			ua = serverName
+		}
+		req.Header.Set("User-Agent", ua+" req/"+id)
+		return req, nil
+	case "Referer":
+		req.Header.Set(name, id)
+		return req, nil
+	}
+	req.Header.Set(name, id)
+	clearSignature(req)
+	return signRequest(req)
+}
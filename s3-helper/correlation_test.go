@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCorrelationHeader(t *testing.T) {
+	var got http.Header
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	logs := captureLog(t)
+
+	conf.CorrelationHeader = "user-agent"
+	conf.CloudFrontForwardID = true
+	serve("GET", "/show/ep1.ts", http.Header{"X-Amz-Cf-Id": {"abc123=="}})
+	fields := logged(logs, "Request started")
+	id, _ := fields["correlation-id"].(string)
+	if len(id) != 32 || got.Get("User-Agent") != serverName+" cf-id/abc123== req/"+id {
+		t.Errorf("User-Agent %q with correlation-id %q", got.Get("User-Agent"), id)
+	}
+
+	// any other header is signed along with the request
+	logs.Reset()
+	useSigner(t, regionSigner{})
+	conf.CorrelationHeader = "X-Request-Id"
+	conf.TracingEnabled = true
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	serve("GET", "/show/ep1.ts", http.Header{"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"}})
+	if got.Get("X-Request-Id") != traceID || got.Get("Authorization") == "" {
+		t.Errorf("S3 got X-Request-Id %q, Authorization %q, want the trace ID signed",
+			got.Get("X-Request-Id"), got.Get("Authorization"))
+	}
+	if fields := logged(logs, "Request started"); fields["correlation-id"] != traceID {
+		t.Errorf("logged as %v", fields)
+	}
+	if strings.Contains(got.Get("User-Agent"), "req/") {
+		t.Errorf("User-Agent %q tagged too", got.Get("User-Agent"))
+	}
+}
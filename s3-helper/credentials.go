@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crunchyroll/go-aws-auth"
+	"github.com/rs/zerolog/log"
+)
+
+// errNoCredentials is returned while there are no valid credentials to
+// sign with, typically for a moment while instance role credentials are
+// being rotated
+var errNoCredentials = errors.New("no valid credentials, refresh in progress")
+
+// Seconds clients are told to wait before retrying while credentials
+// are unavailable
+const credentialRetryAfter = "1"
+
+// Instance role credentials are refreshed this long before they expire,
+// and failed refreshes tried again this often
+const (
+	credentialRefreshAhead = 5 * time.Minute
+	credentialRetryDelay   = 5 * time.Second
+)
+
+// credentialStore holds the credentials S3 requests are signed with.
+// Static credentials come from the environment, otherwise the instance
+// role's are fetched from the metadata service and kept current.
+type credentialStore struct {
+	mu    sync.RWMutex
+	creds awsauth.Credentials
+	// when the current gap without valid credentials started
+	gapStart time.Time
+}
+
+var credentials = &credentialStore{}
+
+// credentialsValid reports whether c can be signed with at t
+func credentialsValid(c awsauth.Credentials, t time.Time) bool {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return false
+	}
+	return c.Expiration.IsZero() || t.Before(c.Expiration)
+}
+
+// get returns the current credentials, or errNoCredentials when they are
+// missing or expired
+func (cs *credentialStore) get() (awsauth.Credentials, error) {
+	now := time.Now()
+	cs.mu.RLock()
+	c := cs.creds
+	inGap := !cs.gapStart.IsZero()
+	cs.mu.RUnlock()
+	if credentialsValid(c, now) {
+		return c, nil
+	}
+
+	if !inGap {
+		cs.mu.Lock()
+		if cs.gapStart.IsZero() {
+			cs.gapStart = now
+			log.Warn().Msg("No valid credentials, answering 503 until they are refreshed")
+		}
+		cs.mu.Unlock()
+	}
+	return c, errNoCredentials
+}
+
+// set replaces the current credentials, closing any gap without them
+func (cs *credentialStore) set(c awsauth.Credentials) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.creds = c
+	if !cs.gapStart.IsZero() {
+		log.Warn().Msg(fmt.Sprintf("Credentials refreshed after %v without them",
+			time.Since(cs.gapStart).Round(time.Millisecond)))
+		cs.gapStart = time.Time{}
+	}
+}
+
+// expiration returns when the current credentials expire
+func (cs *credentialStore) expiration() time.Time {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.creds.Expiration
+}
+
+// refresh fetches new instance role credentials
+func (cs *credentialStore) refresh() error {
+	c, err := imdsCredentials()
+	if err != nil {
+		return err
+	}
+	cs.set(c)
+	log.Info().Msg(fmt.Sprintf("Refreshed instance role credentials, valid until %s",
+		c.Expiration.Format(time.RFC3339)))
+	return nil
+}
+
+// run keeps instance role credentials fresh, refreshing them ahead of
+// their expiry and retrying whenever that fails
+func (cs *credentialStore) run() {
+	for {
+		wait := time.Until(cs.expiration()) - credentialRefreshAhead
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		for {
+			err := cs.refresh()
+			if err == nil {
+				break
+			}
+			log.Error().
+				Str("error", err.Error()).
+				Msg("Failed to refresh instance role credentials")
+			time.Sleep(credentialRetryDelay)
+		}
+		if cs.expiration().IsZero() {
+			return
+		}
+	}
+}
+
+// credentialsUnavailable answers a request that can't be signed right now
+// with a 503, telling the client to retry shortly
+func credentialsUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", credentialRetryAfter)
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// imdsCredentials fetches the instance role's credentials from the
+// metadata service
+func imdsCredentials() (awsauth.Credentials, error) {
+	var c awsauth.Credentials
+	client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{}}
+	token, _ := imdsToken(client)
+
+	get := func(p string) ([]byte, error) {
+		req, err := http.NewRequest("GET", imdsEndpoint+"/latest/meta-data/iam/security-credentials/"+p, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 4096))
+	}
+
+	b, err := get("")
+	if err != nil {
+		return c, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+	if role == "" {
+		return c, fmt.Errorf("no instance role")
+	}
+	if b, err = get(role); err != nil {
+		return c, err
+	}
+
+	var doc struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return c, err
+	}
+	c = awsauth.Credentials{
+		AccessKeyID:     doc.AccessKeyID,
+		SecretAccessKey: doc.SecretAccessKey,
+		SecurityToken:   doc.Token,
+		Expiration:      doc.Expiration,
+	}
+	return c, nil
+}
+
+// envCredentials returns the static credentials set in the environment.
+// The session token is also taken from AWS_SECURITY_TOKEN, the name older
+// SDKs and tools use.
+func envCredentials() awsauth.Credentials {
+	token := os.Getenv("AWS_SESSION_TOKEN")
+	if token == "" {
+		token = os.Getenv("AWS_SECURITY_TOKEN")
+	}
+	return awsauth.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SecurityToken:   token,
+	}
+}
+
+// initCredentials loads static credentials from the environment, or
+// starts keeping instance role credentials fresh when there are none.
+// Finding no credentials at all exits when RequireCredentials is set,
+// rather than answering every request with a 503.
+func initCredentials() {
+	if conf.AnonymousAccess {
+		return
+	}
+	if c := envCredentials(); c.AccessKeyID != "" {
+		if !credentialsValid(c, time.Now()) {
+			log.Error().Msg("AWS_ACCESS_KEY_ID is set without AWS_SECRET_ACCESS_KEY")
+			if conf.RequireCredentials {
+				os.Exit(1)
+			}
+		}
+		credentials.set(c)
+		log.Info().Msg("Using credentials from the environment")
+		return
+	}
+
+	if err := credentials.refresh(); err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg("Failed to fetch instance role credentials")
+		if conf.RequireCredentials {
+			os.Exit(1)
+		}
+		log.Warn().Msg("Continuing without credentials, will keep trying")
+	}
+	go credentials.run()
+}
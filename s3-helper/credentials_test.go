@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crunchyroll/go-aws-auth"
+)
+
+// mockIMDS serves instance role credentials from creds in place of the
+// metadata service until the test ends, with a nil result failing
+func mockIMDS(t *testing.T, creds func() *awsauth.Credentials) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			w.Write([]byte("token"))
+		case "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("role\n"))
+		case "/latest/meta-data/iam/security-credentials/role":
+			c := creds()
+			if c == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"AccessKeyId":     c.AccessKeyID,
+				"SecretAccessKey": c.SecretAccessKey,
+				"Token":           c.SecurityToken,
+				"Expiration":      c.Expiration,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	prevEndpoint, prevCreds := imdsEndpoint, credentials
+	t.Cleanup(func() {
+		srv.Close()
+		imdsEndpoint, credentials = prevEndpoint, prevCreds
+	})
+	imdsEndpoint = srv.URL
+	credentials = &credentialStore{}
+}
+
+func TestCredentialsRefreshedBeforeExpiry(t *testing.T) {
+	var fetches atomic.Int32
+	mockIMDS(t, func() *awsauth.Credentials {
+		if fetches.Add(1) == 1 {
+			// due for a refresh in a moment
+			return &awsauth.Credentials{AccessKeyID: "first", SecretAccessKey: "secret",
+				Expiration: time.Now().Add(credentialRefreshAhead + 50*time.Millisecond)}
+		}
+		return &awsauth.Credentials{AccessKeyID: "second", SecretAccessKey: "secret"}
+	})
+
+	if err := credentials.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		// credentials without an expiry end the refreshing
+		credentials.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("credentials not refreshed")
+	}
+	if c, err := credentials.get(); err != nil || c.AccessKeyID != "second" {
+		t.Errorf("got %q, %v, want the refreshed credentials", c.AccessKeyID, err)
+	}
+}
+
+func TestFailedRefreshKeepsCredentials(t *testing.T) {
+	mockIMDS(t, func() *awsauth.Credentials { return nil })
+	credentials.set(awsauth.Credentials{AccessKeyID: "current", SecretAccessKey: "secret",
+		Expiration: time.Now().Add(time.Hour)})
+
+	if err := credentials.refresh(); err == nil {
+		t.Fatal("refresh succeeded against a failing metadata service")
+	}
+	if c, err := credentials.get(); err != nil || c.AccessKeyID != "current" {
+		t.Errorf("got %q, %v, want the credentials still in use", c.AccessKeyID, err)
+	}
+}
+
+func TestNoCredentialsAnswered503(t *testing.T) {
+	var requests atomic.Int32
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	mockIMDS(t, func() *awsauth.Credentials { return nil })
+	conf.AnonymousAccess = false
+	credentials.set(awsauth.Credentials{AccessKeyID: "expired", SecretAccessKey: "secret",
+		Expiration: time.Now().Add(-time.Minute)})
+
+	if _, err := credentials.get(); err != errNoCredentials {
+		t.Fatalf("got %v for expired credentials, want errNoCredentials", err)
+	}
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != credentialRetryAfter {
+		t.Errorf("got %d with Retry-After %q, want a 503 asking to retry", w.Code, w.Header().Get("Retry-After"))
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("S3 asked %d times without credentials", n)
+	}
+}
+
+// TestMissingCredentialsExit runs initCredentials in a child process, as
+// it exits when credentials are required but can't be found
+func TestMissingCredentialsExit(t *testing.T) {
+	if mode := os.Getenv("S3HELPER_TEST_CREDENTIALS"); mode != "" {
+		conf.AnonymousAccess = false
+		conf.RequireCredentials = mode != "optional"
+		imdsEndpoint = "http://127.0.0.1:1"
+		initCredentials()
+		return
+	}
+
+	for _, tc := range []struct {
+		mode, keyID string
+		exits       bool
+	}{
+		{"required", "", true},
+		{"required", "AKIDEXAMPLE", true},
+		{"optional", "", false},
+		{"optional", "AKIDEXAMPLE", false},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMissingCredentialsExit$")
+		cmd.Env = append(os.Environ(), "S3HELPER_TEST_CREDENTIALS="+tc.mode,
+			"AWS_ACCESS_KEY_ID="+tc.keyID, "AWS_SECRET_ACCESS_KEY=")
+		err := cmd.Run()
+		var exit *exec.ExitError
+		if exited := errors.As(err, &exit) && exit.ExitCode() == 1; exited != tc.exits {
+			t.Errorf("%s credentials with key ID %q: got %v, want exit %v", tc.mode, tc.keyID, err, tc.exits)
+		}
+	}
+}
+
+func TestEnvCredentialsSecurityToken(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_SECURITY_TOKEN", "legacy")
+	if got := envCredentials().SecurityToken; got != "legacy" {
+		t.Errorf("token = %q, want AWS_SECURITY_TOKEN", got)
+	}
+
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	if got := envCredentials().SecurityToken; got != "session" {
+		t.Errorf("token = %q, want AWS_SESSION_TOKEN to win", got)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A delete has to name the key it deletes a second time, in this header
+// or query parameter, so a stray DELETE doesn't take an object with it
+const (
+	confirmDeleteHeader = "X-S3-Confirm-Delete"
+	confirmDeleteParam  = "confirm-delete"
+)
+
+// Clients allowed to delete
+var deleteAllow []*net.IPNet
+
+// initDeletes sets up the clients allowed to delete
+func initDeletes() {
+	if !conf.AllowDeletes {
+		return
+	}
+	nets, err := parseCIDRs(conf.DeleteCIDRs)
+	if err != nil {
+		exitConfig("S3_DELETE_CIDRS", err)
+	}
+	if len(nets) == 0 {
+		exitConfig("S3_DELETE_CIDRS", fmt.Errorf("deletes are allowed but no clients are"))
+	}
+	deleteAllow = nets
+	log.Info().Msg(fmt.Sprintf("Accepting deletes from %s", conf.DeleteCIDRs))
+}
+
+// isDelete reports whether r is a delete we handle
+func isDelete(r *http.Request) bool {
+	return conf.AllowDeletes && r.Method == "DELETE"
+}
+
+// deleteConfirmed reports whether r names the key it deletes again
+func deleteConfirmed(r *http.Request) bool {
+	confirm := r.Header.Get(confirmDeleteHeader)
+	if confirm == "" {
+		confirm = r.URL.Query().Get(confirmDeleteParam)
+	}
+	return confirm != "" && confirm == r.URL.Path
+}
+
+// serveDelete deletes an object in S3 for a confirmed request and answers
+// with S3's response.  Only a DeleteObject of the escaped key goes to S3,
+// without any query the client sent.  Every delete is logged with the
+// client for audit, and the object is dropped from the cache.
+func serveDelete(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	logger := log.With().Str("object", upath).Str("method", r.Method).Str("client", clientIP(r)).Logger()
+
+	if !ipAllowed(deleteAllow, clientIP(r)) {
+		w.WriteHeader(http.StatusForbidden)
+		logger.Warn().Msg("Rejected delete from a client not allowed to")
+		return
+	}
+	if err := checkObjectKey(upath); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("Rejected delete")
+		return
+	}
+	if !deleteConfirmed(r) {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		logger.Warn().Msg("Rejected delete without " + confirmDeleteHeader + " naming the key")
+		return
+	}
+
+	req, err := newS3Request("DELETE", upath, nil)
+	if err == errNoCredentials {
+		credentialsUnavailable(w)
+		logger.Warn().Msg("No valid credentials, asked client to retry")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("Rejected delete")
+		return
+	}
+	resp, err := doS3(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		logger.Error().
+			Str("error", err.Error()).
+			Msg("Failed to delete from S3")
+		return
+	}
+	defer resp.Body.Close()
+
+	relayResponse(w, resp)
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		metricDeletes.Add(1)
+		cache.delete(upath)
+		logger.Info().
+			Int("statuscode", resp.StatusCode).
+			Msg("Deleted from S3")
+		return
+	}
+	logger.Error().
+		Int("statuscode", resp.StatusCode).
+		Msg("S3 refused delete")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// allowDeletes from 192.0.2.0/24 until the test ends
+func allowDeletes(t *testing.T) {
+	prev := deleteAllow
+	t.Cleanup(func() { deleteAllow = prev })
+	conf.AllowDeletes = true
+	deleteAllow, _ = parseCIDRs("192.0.2.0/24")
+}
+
+func TestDeleteConfirmed(t *testing.T) {
+	var method, path, rawPath, query string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, rawPath, query = r.Method, r.URL.Path, r.URL.EscapedPath(), r.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	allowDeletes(t)
+	cache = newObjectCache(time.Minute, 1<<20, 1<<20, 0)
+	cache.set("/show/ep 1.ts", "", 200, http.Header{}, []byte("old"))
+
+	w := serve("DELETE", "/show/ep%201.ts?versionId=abc", http.Header{confirmDeleteHeader: {"/show/ep 1.ts"}})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got %d, want S3's 204", w.Code)
+	}
+	if method != "DELETE" || path != "/bucket/show/ep 1.ts" || rawPath != "/bucket/show/ep%201.ts" || query != "" {
+		t.Errorf("S3 got %s %s (%s) with query %q, want a DeleteObject of the key alone", method, path, rawPath, query)
+	}
+	if _, ok := cache.lookup("/show/ep 1.ts"); ok {
+		t.Error("deleted object still cached")
+	}
+}
+
+func TestDeleteRejected(t *testing.T) {
+	var calls int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	allowDeletes(t)
+
+	for _, c := range []struct {
+		name, target, confirm string
+		want                  int
+	}{
+		{"bucket", "/", "/", 400},
+		{"prefix", "/show/", "/show/", 400},
+		{"query in key", "/show/ep1.ts%3Fversions", "/show/ep1.ts?versions", 400},
+		{"unconfirmed", "/show/ep1.ts", "", 428},
+		{"confirmed for another key", "/show/ep1.ts", "/show/ep2.ts", 428},
+	} {
+		h := http.Header{}
+		if c.confirm != "" {
+			h.Set(confirmDeleteHeader, c.confirm)
+		}
+		if w := serve("DELETE", c.target, h); w.Code != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+
+	// an empty path can't come from a client but is refused all the same
+	r := httptest.NewRequest("DELETE", "/", nil)
+	r.URL.Path = ""
+	r.Header.Set(confirmDeleteHeader, "")
+	w := httptest.NewRecorder()
+	forwardToS3(w, r)
+	if w.Code != 400 {
+		t.Errorf("empty key: got %d, want 400", w.Code)
+	}
+
+	r = httptest.NewRequest("DELETE", "/show/ep1.ts", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set(confirmDeleteHeader, "/show/ep1.ts")
+	w = httptest.NewRecorder()
+	forwardToS3(w, r)
+	if w.Code != 403 {
+		t.Errorf("client not allowed: got %d, want 403", w.Code)
+	}
+	if calls != 0 {
+		t.Errorf("S3 got %d requests", calls)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// processStats is a snapshot of resource usage for spotting goroutine,
+// file descriptor and memory leaks
+type processStats struct {
+	Goroutines  int    `json:"goroutines"`
+	OpenFDs     int    `json:"open_fds"`
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapObjects uint64 `json:"heap_objects"`
+	NumGC       uint32 `json:"num_gc"`
+}
+
+// collectStats takes a snapshot of the process' resource usage, OpenFDs is
+// -1 where the platform can't tell
+func collectStats() processStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return processStats{
+		Goroutines:  runtime.NumGoroutine(),
+		OpenFDs:     openFDs(),
+		HeapAlloc:   ms.HeapAlloc,
+		HeapInuse:   ms.HeapInuse,
+		HeapObjects: ms.HeapObjects,
+		NumGC:       ms.NumGC,
+	}
+}
+
+// runDiagnostics logs resource usage every interval at debug level
+func runDiagnostics(interval time.Duration) {
+	for range time.Tick(interval) {
+		s := collectStats()
+		log.Debug().
+			Int("goroutines", s.Goroutines).
+			Int("open-fds", s.OpenFDs).
+			Uint64("heap-alloc", s.HeapAlloc).
+			Uint64("heap-inuse", s.HeapInuse).
+			Uint64("heap-objects", s.HeapObjects).
+			Uint32("num-gc", s.NumGC).
+			Msg("Diagnostics")
+	}
+}
+
+// statsHandler dumps the current resource usage as JSON
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collectStats())
+}
+
+// initDiagnostics starts the periodic diagnostics log when enabled
+func initDiagnostics() {
+	if conf.DiagnosticsInterval <= 0 {
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("Logging diagnostics every %v", conf.DiagnosticsInterval))
+	go runDiagnostics(conf.DiagnosticsInterval)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+func TestStatsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest("GET", "/stats", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var s processStats
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Goroutines < 1 || s.HeapAlloc == 0 || s.HeapObjects == 0 {
+		t.Errorf("implausible stats %+v", s)
+	}
+}
+
+func TestOpenFDs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if n := openFDs(); n != -1 {
+			t.Errorf("got %d open files, want -1 off Linux", n)
+		}
+		return
+	}
+	// other tests' connections may still be closing, so leave some slack
+	before := openFDs()
+	for i := 0; i < 8; i++ {
+		f, err := os.Open(os.Args[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+	}
+	if n := openFDs(); n < before+4 {
+		t.Errorf("%d open files after opening 8 more, had %d", n, before)
+	}
+}
+
+func TestBundleHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	bundleHandler(w, httptest.NewRequest("GET", "/debug/bundle?seconds=1", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("got %d with Content-Type %q", w.Code, ct)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var metadata bundleMetadata
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name == "metadata.json" {
+			rc, _ := f.Open()
+			err := json.NewDecoder(rc).Decode(&metadata)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if strings.Join(names, " ") != "cpu.pprof heap.pprof goroutine.pprof block.pprof metadata.json" {
+		t.Errorf("bundle holds %q", names)
+	}
+	if metadata.Go != runtime.Version() || metadata.Stats.Goroutines == 0 {
+		t.Errorf("metadata %+v", metadata)
+	}
+
+	for _, seconds := range []string{"0", "301", "x"} {
+		w := httptest.NewRecorder()
+		bundleHandler(w, httptest.NewRequest("GET", "/debug/bundle?seconds="+seconds, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("seconds=%s got %d, want a 400", seconds, w.Code)
+		}
+	}
+
+	// only one CPU profile at a time
+	if err := pprof.StartCPUProfile(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	defer pprof.StopCPUProfile()
+	w = httptest.NewRecorder()
+	bundleHandler(w, httptest.NewRequest("GET", "/debug/bundle?seconds=1", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("got %d during another profile, want a 409", w.Code)
+	}
+}
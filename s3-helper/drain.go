@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// drainState tracks whether we are being drained for a deploy.  While we
+// are /readyz fails so load balancers stop sending us requests, and
+// keep-alives are off so clients already connected move on as their
+// requests finish.
+type drainState struct {
+	mu       sync.Mutex
+	draining bool
+	since    time.Time
+	// fires the shutdown asked for with the drain, if any
+	timer *time.Timer
+}
+
+var drain = &drainState{}
+
+// The main server, whose keep-alives are turned off while draining
+var mainServer *http.Server
+
+// Signalled to shut down the way SIGTERM does once a drain's delay is up
+var drainShutdown = make(chan struct{}, 1)
+
+// start drains, shutting down after the delay unless it is zero.  A drain
+// under way only has its shutdown rescheduled.
+func (d *drainState) start(after time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		d.since = time.Now()
+		if mainServer != nil {
+			mainServer.SetKeepAlivesEnabled(false)
+		}
+		log.Warn().Msg("Draining, readiness checks fail from now on")
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if after > 0 {
+		d.timer = time.AfterFunc(after, func() {
+			log.Warn().Msg("Drained, shutting down")
+			select {
+			case drainShutdown <- struct{}{}:
+			default:
+			}
+		})
+		log.Warn().Msg(fmt.Sprintf("Shutting down in %v", after))
+	}
+}
+
+// stop ends a drain, calling off its shutdown if it isn't under way yet
+func (d *drainState) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.draining = false
+	if mainServer != nil {
+		mainServer.SetKeepAlivesEnabled(true)
+	}
+	log.Warn().Msg(fmt.Sprintf("Undrained after %v, ready again", time.Since(d.since).Round(time.Second)))
+}
+
+// status reports whether we are draining and since when
+func (d *drainState) status() (bool, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining, d.since
+}
+
+// readyzHandler answers readiness checks, failing them while draining
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if draining, _ := drain.status(); draining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "draining\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// drainHandler starts draining on a POST, shutting down after
+// ?shutdown_after=<duration> when given
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var after time.Duration
+	if v := r.URL.Query().Get("shutdown_after"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid shutdown_after", http.StatusBadRequest)
+			return
+		}
+		after = d
+	}
+	drain.start(after)
+	writeDrainStatus(w)
+}
+
+// undrainHandler ends a drain on a POST
+func undrainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	drain.stop()
+	writeDrainStatus(w)
+}
+
+// writeDrainStatus answers with the drain state as JSON
+func writeDrainStatus(w http.ResponseWriter) {
+	draining, since := drain.status()
+	status := struct {
+		Draining bool       `json:"draining"`
+		Since    *time.Time `json:"since,omitempty"`
+	}{Draining: draining}
+	if draining {
+		status.Since = &since
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	t.Cleanup(drain.stop)
+	admin := http.NewServeMux()
+	admin.Handle("/readyz", http.HandlerFunc(readyzHandler))
+	admin.Handle("/admin/drain", http.HandlerFunc(drainHandler))
+	admin.Handle("/admin/undrain", http.HandlerFunc(undrainHandler))
+	call := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	if w := call("GET", "/readyz"); w.Code != 200 {
+		t.Errorf("ready: got %d", w.Code)
+	}
+	if w := call("GET", "/admin/drain"); w.Code != 405 {
+		t.Errorf("GET drain: got %d, want 405", w.Code)
+	}
+	if w := call("POST", "/admin/drain?shutdown_after=soon"); w.Code != 400 {
+		t.Errorf("bad shutdown_after: got %d, want 400", w.Code)
+	}
+
+	w := call("POST", "/admin/drain?shutdown_after=20ms")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"draining":true`) {
+		t.Errorf("drain: got %d %s", w.Code, w.Body.String())
+	}
+	if w := call("GET", "/readyz"); w.Code != 503 {
+		t.Errorf("draining: readyz got %d, want 503", w.Code)
+	}
+	w = call("POST", "/admin/undrain")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"draining":false`) {
+		t.Errorf("undrain: got %d %s", w.Code, w.Body.String())
+	}
+	if w := call("GET", "/readyz"); w.Code != 200 {
+		t.Errorf("undrained: readyz got %d", w.Code)
+	}
+	// the undrain called off the shutdown
+	select {
+	case <-drainShutdown:
+		t.Error("shut down after undrain")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	call("POST", "/admin/drain?shutdown_after=1ms")
+	select {
+	case <-drainShutdown:
+	case <-time.After(time.Second):
+		t.Error("no shutdown after the drain")
+	}
+}
+
+func TestAdminClientsChecked(t *testing.T) {
+	prev := adminAllow
+	t.Cleanup(func() { adminAllow = prev })
+	adminAllow, _ = parseCIDRs("10.0.0.0/8")
+	h := checkAdminClient(http.HandlerFunc(readyzHandler))
+
+	for remote, want := range map[string]int{"10.1.2.3:1234": 200, "192.0.2.1:1234": 403} {
+		r := httptest.NewRequest("GET", "/readyz", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", remote, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// endpointPool spreads objects over several S3-compatible backends holding
+// the same data.  Each key goes to the endpoint ranking highest for it by
+// rendezvous hashing, so it keeps hitting the same backend and its cache,
+// and only the keys of an endpoint that goes down move elsewhere.
+type endpointPool struct {
+	mu        sync.Mutex
+	endpoints []string
+	// endpoints that failed are passed over until then
+	downUntil map[string]time.Time
+}
+
+// The pool of S3Endpoints, nil with a single endpoint or none
+var endpoints *endpointPool
+
+// parseEndpoints parses a comma separated list of endpoint URLs
+func parseEndpoints(s string) ([]string, error) {
+	var eps []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimRight(strings.TrimSpace(item), "/")
+		if item == "" {
+			continue
+		}
+		u, err := url.Parse(item)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q", item)
+		}
+		eps = append(eps, item)
+	}
+	return eps, nil
+}
+
+func newEndpointPool(eps []string) *endpointPool {
+	return &endpointPool{endpoints: eps, downUntil: make(map[string]time.Time)}
+}
+
+// endpointScore ranks an endpoint for key, the highest score wins.  FNV
+// on its own barely tells apart endpoints differing in a port digit, so
+// its sum is mixed further with the splitmix64 finalizer.
+func endpointScore(endpoint, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(endpoint))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// rank returns the endpoints in the order key should try them, those that
+// are up first
+func (p *endpointPool) rank(key string) []string {
+	now := time.Now()
+	ranked := append([]string(nil), p.endpoints...)
+	sort.Slice(ranked, func(i, j int) bool {
+		return endpointScore(ranked[i], key) > endpointScore(ranked[j], key)
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return !now.Before(p.downUntil[ranked[i]]) && now.Before(p.downUntil[ranked[j]])
+	})
+	return ranked
+}
+
+// pick returns the endpoint key goes to
+func (p *endpointPool) pick(key string) string {
+	return p.rank(key)[0]
+}
+
+// markDown passes over an endpoint for EndpointDownFor
+func (p *endpointPool) markDown(endpoint string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().After(p.downUntil[endpoint]) {
+		log.Warn().Msg(fmt.Sprintf("S3 endpoint %s is down, passing over it for %v", endpoint, conf.EndpointDownFor))
+	}
+	p.downUntil[endpoint] = time.Now().Add(conf.EndpointDownFor)
+}
+
+// markUp clears an endpoint that answered again
+func (p *endpointPool) markUp(endpoint string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.downUntil[endpoint]; ok {
+		delete(p.downUntil, endpoint)
+		log.Info().Msg(fmt.Sprintf("S3 endpoint %s is back up", endpoint))
+	}
+}
+
+// endpointOf returns the pool endpoint req is addressed to, with the rest
+// of its URL
+func (p *endpointPool) endpointOf(req *http.Request) (string, string, bool) {
+	u := req.URL.String()
+	for _, ep := range p.endpoints {
+		if strings.HasPrefix(u, ep+"/") {
+			return ep, u[len(ep):], true
+		}
+	}
+	return "", "", false
+}
+
+// retarget copies req for another endpoint, signed afresh as the host is
+// part of the signature
+func retarget(req *http.Request, endpoint, rest string) (*http.Request, error) {
+	u, err := url.Parse(endpoint + rest)
+	if err != nil {
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	readdress(r, u)
+	clearSignature(r)
+	return signRequest(r)
+}
+
+// endpointFailed reports whether an endpoint's answer counts against it
+func endpointFailed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// doPooled sends req to the endpoints in turn, starting with the one it
+// is addressed to, until one answers without failing.  The last failure
+// is returned when they all do.
+func (p *endpointPool) doPooled(req *http.Request) (*http.Response, error) {
+	first, rest, ok := p.endpointOf(req)
+	if !ok {
+		return sendS3(req)
+	}
+	key := strings.SplitN(rest, "?", 2)[0]
+	order := []string{first}
+	for _, ep := range p.rank(key) {
+		if ep != first {
+			order = append(order, ep)
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for i, ep := range order {
+		r := req
+		if i > 0 {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if r, err = retarget(req, ep, rest); err != nil {
+				return nil, err
+			}
+			metricEndpointFailovers.Add(1)
+		}
+		resp, err = sendS3(r)
+		if !endpointFailed(resp, err) {
+			p.markUp(ep)
+			return resp, nil
+		}
+		p.markDown(ep)
+	}
+	return resp, err
+}
+
+// initEndpoints sets up the endpoint pool when there are several
+func initEndpoints() {
+	if len(conf.S3Endpoints) < 2 {
+		return
+	}
+	endpoints = newEndpointPool(conf.S3Endpoints)
+	log.Info().Msg(fmt.Sprintf("Spreading objects over %d S3 endpoints", len(conf.S3Endpoints)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetargetSignsForNewHost(t *testing.T) {
+	s := &hostSigner{}
+	useSigner(t, s)
+
+	req, _ := http.NewRequest("GET", "http://a.example.com:9000/bucket/key", nil)
+	req.Header.Set("Host", "a.example.com:9000")
+	r, err := retarget(req, "http://b.example.com:9000", "/bucket/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Host != "b.example.com:9000" || r.Header.Get("Host") != "b.example.com:9000" {
+		t.Errorf("Host = %q, header %q", r.Host, r.Header.Get("Host"))
+	}
+	if len(s.signed) != 1 || s.signed[0] != "b.example.com:9000" {
+		t.Errorf("signed for %q", s.signed)
+	}
+	if req.Host != "a.example.com:9000" {
+		t.Errorf("original request changed to %q", req.Host)
+	}
+}
+
+func TestPooledFailover(t *testing.T) {
+	useSigner(t, &hostSigner{})
+	defer func(d time.Duration) { conf.EndpointDownFor = d }(conf.EndpointDownFor)
+	conf.EndpointDownFor = time.Minute
+
+	var hosts []string
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		if !strings.Contains(r.Header.Get("Authorization"), r.Host) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer good.Close()
+	initTestS3Client(t)
+
+	p := newEndpointPool([]string{bad.URL, good.URL})
+	req, _ := http.NewRequest("GET", bad.URL+"/bucket/key", nil)
+	req, _ = signRequest(req)
+	resp, err := p.doPooled(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d after failover", resp.StatusCode)
+	}
+	if want := strings.TrimPrefix(good.URL, "http://"); len(hosts) != 1 || hosts[0] != want {
+		t.Errorf("second endpoint saw Host %q, want %q", hosts, want)
+	}
+	if p.pick("bucket/key") != good.URL {
+		t.Errorf("failed endpoint not passed over")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// What EnforceRange does about a range S3 answered with the whole object
+const (
+	enforceRangeOff   = ""
+	enforceRangeError = "error"
+	enforceRangeApply = "apply"
+)
+
+// checkEnforceRange validates EnforceRange
+func checkEnforceRange(mode string) error {
+	switch mode {
+	case enforceRangeOff, enforceRangeError, enforceRangeApply:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, expected %q or %q", mode, enforceRangeError, enforceRangeApply)
+}
+
+// rangeIgnored reports whether S3 answered a range it should have honored
+// with the whole object.  A failed If-Range rightly gets the whole object.
+func rangeIgnored(resp *http.Response, byterange, ifRangeName string) bool {
+	return byterange != "" && ifRangeName == "" && resp.StatusCode == http.StatusOK
+}
+
+// enforceRange reports whether EnforceRange deals with a range S3 ignored
+// in answer to method.  Only GETs are failed for it, the whole object a
+// HEAD describes costs nothing, but in apply mode a HEAD gets the headers
+// the GET would.
+func enforceRange(method string) bool {
+	switch conf.EnforceRange {
+	case enforceRangeError:
+		return method == "GET"
+	case enforceRangeApply:
+		return method == "GET" || method == "HEAD"
+	}
+	return false
+}
+
+// applyRange turns a 200 with the whole object into the 206 for a single
+// byte range of it, skipping the body up to the range and cutting it off
+// after.  An unsatisfiable range gets a 416 instead, and it fails when
+// the range can't be applied, e.g. a multipart one or a body of unknown
+// length.  The answer to a HEAD has no body, only its status and headers
+// are changed.
+func applyRange(resp *http.Response, byterange string, head bool) (int, error) {
+	total := resp.ContentLength
+	if total < 0 {
+		return http.StatusBadGateway, fmt.Errorf("whole object of unknown length")
+	}
+	first, last, ok := parseByteRange(byterange)
+	if !ok {
+		spec := strings.TrimSpace(strings.TrimPrefix(byterange, "bytes="))
+		n, err := strconv.ParseInt(strings.TrimPrefix(spec, "-"), 10, 64)
+		if !strings.HasPrefix(spec, "-") || err != nil || n <= 0 {
+			return http.StatusBadGateway, fmt.Errorf("range %q can't be applied", byterange)
+		}
+		first, last = total-n, total-1
+		if first < 0 {
+			first = 0
+		}
+	}
+	if first >= total {
+		return http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range %q starts past the end", byterange)
+	}
+	if last < 0 || last >= total {
+		last = total - 1
+	}
+
+	n := last - first + 1
+	if !head {
+		if _, err := io.CopyN(io.Discard, resp.Body, first); err != nil {
+			metricUpstreamReadErrors.Add(1)
+			return http.StatusBadGateway, err
+		}
+		resp.Body = &prefixedBody{Reader: io.LimitReader(resp.Body, n), Closer: resp.Body}
+	}
+	resp.StatusCode = http.StatusPartialContent
+	resp.ContentLength = n
+	resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, total))
+	return http.StatusPartialContent, nil
+}
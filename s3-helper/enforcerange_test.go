@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// ignoresRanges answers every request with the whole object
+func ignoresRanges(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != "HEAD" {
+			w.Write([]byte(body))
+		}
+	})
+}
+
+func TestEnforceRange(t *testing.T) {
+	tests := []struct {
+		mode, method, rng string
+		status            int
+		contentRange      string
+		body              string
+	}{
+		{enforceRangeOff, "GET", "bytes=2-4", http.StatusOK, "", "0123456789"},
+		{enforceRangeError, "GET", "bytes=2-4", http.StatusBadGateway, "", ""},
+		{enforceRangeError, "HEAD", "bytes=2-4", http.StatusOK, "", ""},
+		{enforceRangeApply, "GET", "bytes=2-4", http.StatusPartialContent, "bytes 2-4/10", "234"},
+		{enforceRangeApply, "GET", "bytes=-3", http.StatusPartialContent, "bytes 7-9/10", "789"},
+		{enforceRangeApply, "GET", "bytes=8-", http.StatusPartialContent, "bytes 8-9/10", "89"},
+		{enforceRangeApply, "GET", "bytes=20-", http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+		{enforceRangeApply, "HEAD", "bytes=2-4", http.StatusPartialContent, "bytes 2-4/10", ""},
+	}
+	for _, tt := range tests {
+		mockS3(t, ignoresRanges("0123456789"))
+		conf.EnforceRange = tt.mode
+
+		r := httptest.NewRequest(tt.method, "/show/ep1.ts", nil)
+		r.Header.Set("Range", tt.rng)
+		w := httptest.NewRecorder()
+		forwardToS3(w, r)
+
+		name := tt.mode + " " + tt.method + " " + tt.rng
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", name, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%s: Content-Range %q, want %q", name, got, tt.contentRange)
+		}
+		if got := w.Body.String(); got != tt.body {
+			t.Errorf("%s: body %q, want %q", name, got, tt.body)
+		}
+		if tt.method == "HEAD" && tt.status == http.StatusPartialContent && w.Header().Get("Content-Length") != "3" {
+			t.Errorf("%s: Content-Length %q", name, w.Header().Get("Content-Length"))
+		}
+	}
+}
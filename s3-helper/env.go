@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// envString reads a string environment variable, returning def when unset
+// or empty
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envBool reads a boolean environment variable, returning def when unset
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		exitConfig(name, err)
+	}
+	return b
+}
+
+// exitConfig reports an invalid config value and exits
+func exitConfig(name string, err error) {
+	log.Error().Msg(fmt.Sprintf("Invalid %s: %v", name, err))
+	os.Exit(1)
+}
+
+// envInt reads an integer environment variable, returning def when unset
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		exitConfig(name, err)
+	}
+	return n
+}
+
+// envDuration reads a duration environment variable, returning def when unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		exitConfig(name, err)
+	}
+	return d
+}
+
+// envFloat reads a floating point environment variable, returning def when
+// unset
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		exitConfig(name, err)
+	}
+	return f
+}
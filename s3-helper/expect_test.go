@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawExchange sends req on a fresh connection to srv, then body once a
+// 100 Continue arrives, and returns the status lines read back
+func rawExchange(t *testing.T, srv *httptest.Server, req, body string) []string {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	var statuses []string
+	for {
+		status, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %v: %v", statuses, err)
+		}
+		statuses = append(statuses, strings.TrimSpace(status))
+		if strings.Contains(status, " 100 ") {
+			// the blank line ending the interim response
+			br.ReadString('\n')
+			conn.Write([]byte(body))
+			continue
+		}
+		return statuses
+	}
+}
+
+func TestExpectContinueOnGet(t *testing.T) {
+	var expect []string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect = append(expect, r.Header.Get("Expect"))
+		w.Write([]byte("segment"))
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(forwardToS3))
+	defer srv.Close()
+
+	// the body is announced but never sent, a hang unless answered at once
+	statuses := rawExchange(t, srv, "GET /show/ep1.ts HTTP/1.1\r\nHost: media\r\n"+
+		"Expect: 100-continue\r\nContent-Length: 5\r\n\r\n", "")
+	if len(statuses) != 1 || !strings.Contains(statuses[0], " 200 ") {
+		t.Errorf("got %v, want a 200 without a 100 Continue", statuses)
+	}
+	if len(expect) != 1 || expect[0] != "" {
+		t.Errorf("S3 got Expect %q", expect)
+	}
+}
+
+func TestExpectContinueOnUpload(t *testing.T) {
+	var got string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+	}))
+	allowUploads(t, 4)
+	uploadAllow, _ = parseCIDRs("127.0.0.0/8")
+	srv := httptest.NewServer(http.HandlerFunc(forwardToS3))
+	defer srv.Close()
+
+	statuses := rawExchange(t, srv, "PUT /show/ep1.ts HTTP/1.1\r\nHost: media\r\n"+
+		"Expect: 100-continue\r\nContent-Length: 4\r\n\r\n", "part")
+	if len(statuses) != 2 || !strings.Contains(statuses[1], " 200 ") {
+		t.Errorf("got %v, want a 100 Continue and a 200", statuses)
+	}
+	if got != "part" {
+		t.Errorf("S3 got body %q", got)
+	}
+
+	statuses = rawExchange(t, srv, "PUT /show/ep1.ts HTTP/1.1\r\nHost: media\r\n"+
+		"Expect: 100-continue\r\nContent-Length: 5\r\n\r\n", "parts")
+	if len(statuses) != 1 || !strings.Contains(statuses[0], " 413 ") {
+		t.Errorf("got %v, want a 413 without a 100 Continue", statuses)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// headUnsupported reports whether a backend answered a HEAD as if it
+// doesn't implement the method
+func headUnsupported(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented
+}
+
+// headLengthMissing reports whether a backend answered a plain HEAD with a
+// 200 but left out the Content-Length, so the object's size is unknown
+func headLengthMissing(resp *http.Response, byterange string) bool {
+	return byterange == "" && resp.StatusCode == http.StatusOK && resp.ContentLength < 0
+}
+
+// headFallback answers a HEAD the backend refused, or answered without a
+// length, with the headers of a GET for the first byte of the object, or
+// for the client's range when it asked for one.  The returned response
+// looks like the HEAD response S3 would have sent; its body must not be
+// forwarded.  The original response is returned when the GET fails.
+func headFallback(orig *http.Response, upath string, query url.Values, byterange string,
+	logger zerolog.Logger) *http.Response {
+	req, err := newS3Request("GET", upath, query)
+	if err != nil {
+		return orig
+	}
+	if byterange != "" {
+		req.Header.Set("Range", byterange)
+	} else {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+
+	resp, err := doS3(req)
+	if err != nil {
+		logger.Error().
+			Str("error", err.Error()).
+			Msg("HEAD fallback GET failed")
+		return orig
+	}
+	orig.Body.Close()
+	resp.Body.Close()
+
+	// the client asked for a range, so the headers of the ranged GET are
+	// exactly what it would get
+	if byterange != "" {
+		return resp
+	}
+
+	// otherwise turn the one byte partial response back into the full
+	// object's status and length
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+			if total, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				resp.StatusCode = http.StatusOK
+				resp.ContentLength = total
+				resp.Header.Set("Content-Length", strconv.FormatInt(total, 10))
+				resp.Header.Del("Content-Range")
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// an empty object has no first byte
+		resp.StatusCode = http.StatusOK
+		resp.ContentLength = 0
+		resp.Header.Set("Content-Length", "0")
+		resp.Header.Del("Content-Range")
+	}
+	logger.Info().
+		Int("statuscode", resp.StatusCode).
+		Msg("Answered HEAD from a GET")
+	return resp
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noHeadBackend serves a 10 byte object but answers HEAD with a 405
+func noHeadBackend(t *testing.T, object string) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(object))
+	}))
+	conf.HeadFallbackToGet = true
+}
+
+func TestHeadFallback(t *testing.T) {
+	noHeadBackend(t, "0123456789")
+
+	w := serve("HEAD", "/show/ep1.ts", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "10" || w.Header().Get("Content-Range") != "" {
+		t.Errorf("got %d with length %q and range %q, want a 200 of the whole length",
+			w.Code, w.Header().Get("Content-Length"), w.Header().Get("Content-Range"))
+	}
+	if w.Header().Get("ETag") != `"v1"` || w.Body.Len() != 0 {
+		t.Errorf("headers %v with %d bytes", w.Header(), w.Body.Len())
+	}
+
+	w = serve("HEAD", "/show/ep1.ts", http.Header{"Range": {"bytes=2-5"}})
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("ranged HEAD got %d with range %q", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	conf.HeadFallbackToGet = false
+	if w := serve("HEAD", "/show/ep1.ts", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d with the fallback off, want the backend's 405", w.Code)
+	}
+}
+
+func TestHeadFallbackEmptyObject(t *testing.T) {
+	noHeadBackend(t, "")
+
+	w := serve("HEAD", "/show/empty.ts", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "0" {
+		t.Errorf("got %d with length %q, want a 200 of nothing", w.Code, w.Header().Get("Content-Length"))
+	}
+}
+
+func TestHeadLengthFallback(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a HEAD without a body or a length set goes out without one
+		if r.Method == "HEAD" {
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	logs := captureLog(t)
+
+	if w := serve("HEAD", "/show/ep1.ts", nil); w.Header().Get("Content-Length") != "" {
+		t.Errorf("got length %q with the fallback off", w.Header().Get("Content-Length"))
+	}
+	if logged(logs, "Backend answered HEAD without a Content-Length") == nil {
+		t.Error("missing length not warned about")
+	}
+
+	conf.HeadLengthFallback = true
+	w := serve("HEAD", "/show/ep1.ts", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "10" {
+		t.Errorf("got %d with length %q, want a 200 of the whole length", w.Code, w.Header().Get("Content-Length"))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// headCall is an upstream HEAD request shared by everyone asking for the
+// same object at the same time
+type headCall struct {
+	done chan struct{}
+	resp *http.Response
+	err  error
+}
+
+// response hands out a copy of the shared response, with its own headers
+// to modify and an empty body
+func (c *headCall) response() (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	resp := *c.resp
+	resp.Header = c.resp.Header.Clone()
+	resp.Body = http.NoBody
+	return &resp, nil
+}
+
+// headGroup collapses concurrent HEAD requests for the same object into a
+// single upstream request.  As HEAD responses have no body, every caller
+// can be given the same status and headers.
+type headGroup struct {
+	mu    sync.Mutex
+	calls map[string]*headCall
+}
+
+var heads = &headGroup{calls: make(map[string]*headCall)}
+
+// Request headers that change S3's answer to a HEAD, so only requests
+// agreeing on all of them can share one
+var headKeyHeaders = []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// headKey identifies HEAD requests that can share a response
+func headKey(req *http.Request) string {
+	key := req.URL.String()
+	for _, name := range headKeyHeaders {
+		key += "\x00" + req.Header.Get(name)
+	}
+	return key
+}
+
+// do sends req upstream unless an identical HEAD is already under way, in
+// which case it waits for that one's response
+func (g *headGroup) do(req *http.Request) (*http.Response, error) {
+	key := headKey(req)
+
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		metricHeadCoalesced.Add(1)
+		return c.response()
+	}
+	c := &headCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.resp, c.err = doS3(req)
+	if c.err == nil {
+		c.resp.Body.Close()
+	}
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+
+	return c.response()
+}
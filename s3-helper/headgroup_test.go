@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeadKeyConditions(t *testing.T) {
+	plain, _ := http.NewRequest("HEAD", "http://s3.example.com/bucket/key", nil)
+	plain.Header.Set("Range", "bytes=0-99")
+	seen := map[string]string{headKey(plain): "plain"}
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		r := plain.Clone(plain.Context())
+		r.Header.Set(name, `"abc"`)
+		if other, ok := seen[headKey(r)]; ok {
+			t.Errorf("%s shares its key with %s", name, other)
+		}
+		seen[headKey(r)] = name
+	}
+}
+
+func TestHeadGroupKeepsConditionalApart(t *testing.T) {
+	release := make(chan struct{})
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Match") != "" {
+			<-release
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cond, _ := newS3Request("HEAD", "/show/ep1.ts", nil)
+	cond.Header.Set("Range", "bytes=0-99")
+	cond.Header.Set("If-Match", `"old"`)
+	done := make(chan struct{})
+	defer func() {
+		close(release)
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		if resp, err := heads.do(cond); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	// a plain HEAD mustn't wait for, or get, the conditional one's 412
+	plain, _ := newS3Request("HEAD", "/show/ep1.ts", nil)
+	plain.Header.Set("Range", "bytes=0-99")
+	resp, err := heads.do(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("plain HEAD got %d", resp.StatusCode)
+	}
+}
+
+func TestHeadGroupCoalesces(t *testing.T) {
+	var upstream atomic.Int32
+	release := make(chan struct{})
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		<-release
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, _ := newS3Request("HEAD", "/show/ep1.ts", nil)
+	first := make(chan *http.Response)
+	go func() {
+		resp, _ := heads.do(req.Clone(req.Context()))
+		first <- resp
+	}()
+	for upstream.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the first is under way, a second joins it
+	second := make(chan *http.Response)
+	go func() {
+		resp, _ := heads.do(req.Clone(req.Context()))
+		second <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for _, c := range []chan *http.Response{first, second} {
+		resp := <-c
+		if resp == nil || resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"abc"` {
+			t.Errorf("got %v", resp)
+		}
+	}
+	if n := upstream.Load(); n != 1 {
+		t.Errorf("%d upstream requests, want 1", n)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the request latency histogram buckets
+var latencyBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// exemplar is a sample of a histogram bucket tied to the trace it came
+// from, so a latency spike leads straight to a slow request
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+// latencyHistogram counts request durations into latencyBounds buckets,
+// the last one unbounded, keeping the latest traced sample of each
+type latencyHistogram struct {
+	mu        sync.Mutex
+	counts    []uint64
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+}
+
+var requestLatency = newLatencyHistogram()
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{
+		counts:    make([]uint64, len(latencyBounds)+1),
+		exemplars: make([]*exemplar, len(latencyBounds)+1),
+	}
+}
+
+// observe counts a request that took d, traceID is empty when it wasn't
+// traced
+func (h *latencyHistogram) observe(d time.Duration, traceID string) {
+	v := d.Seconds()
+	i := 0
+	for i < len(latencyBounds) && v > latencyBounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = &exemplar{traceID: traceID, value: v, time: time.Now()}
+	}
+}
+
+// formatFloat formats v the way OpenMetrics expects
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes the histogram as name in the text format, OpenMetrics
+// with its unit and exemplars or else the Prometheus one
+func (h *latencyHistogram) write(bw *bufio.Writer, name string, openMetrics bool) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	exemplars := append([]*exemplar(nil), h.exemplars...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+	fmt.Fprintf(bw, "# HELP %s Time taken to answer requests.\n", name)
+	if openMetrics {
+		fmt.Fprintf(bw, "# UNIT %s seconds\n", name)
+	}
+	var cumulative uint64
+	for i, n := range counts {
+		cumulative += n
+		le := math.Inf(1)
+		if i < len(latencyBounds) {
+			le = latencyBounds[i]
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d", name, formatFloat(le), cumulative)
+		if e := exemplars[i]; e != nil && openMetrics {
+			fmt.Fprintf(bw, " # {trace_id=\"%s\"} %s %.3f", e.traceID, formatFloat(e.value),
+				float64(e.time.UnixNano())/1e9)
+		}
+		bw.WriteString("\n")
+	}
+	fmt.Fprintf(bw, "%s_sum %s\n", name, formatFloat(sum))
+	fmt.Fprintf(bw, "%s_count %d\n", name, count)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hostAllowed reports whether the Host of a request is on AllowedHosts.
+// Entries without a port match any port, and ones starting with "*."
+// match any subdomain.  An empty list allows every host.
+func hostAllowed(host string) bool {
+	if len(conf.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = strings.TrimSuffix(h, ".")
+	}
+	for _, allowed := range conf.AllowedHosts {
+		allowed = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(allowed)), ".")
+		if allowed == "" {
+			continue
+		}
+		if allowed == host || allowed == name {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(name, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchdogRequest reports whether r is the watchdog's self-check, which
+// comes from loopback with our own listen address as its Host
+func watchdogRequest(r *http.Request) bool {
+	if r.URL.Path != watchdogPath {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkHost answers requests for a host not on AllowedHosts with a 421
+// Misdirected Request before they reach any handler.  The watchdog's
+// self-check is let through whatever its Host, or it would take the 421s
+// for a hang.
+func checkHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hostAllowed(r.Host) && !watchdogRequest(r) {
+			w.Header().Set("Server", serverName)
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			log.Warn().
+				Str("host", r.Host).
+				Str("object", r.URL.Path).
+				Msg("Rejected request for unknown host")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
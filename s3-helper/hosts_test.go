@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	defer func(hosts []string) { conf.AllowedHosts = hosts }(conf.AllowedHosts)
+	conf.AllowedHosts = []string{"media.example.com", "*.cdn.example.com", "origin.example.com:8080"}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"media.example.com", true},
+		{"MEDIA.example.com.", true},
+		{"media.example.com:443", true},
+		{"a.cdn.example.com", true},
+		{"cdn.example.com", false},
+		{"origin.example.com:8080", true},
+		{"origin.example.com:9090", false},
+		{"other.example.com", false},
+		{"127.0.0.1:8080", false},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.host); got != tt.want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHostLetsWatchdogThrough(t *testing.T) {
+	defer func(hosts []string) { conf.AllowedHosts = hosts }(conf.AllowedHosts)
+	conf.AllowedHosts = []string{"media.example.com"}
+
+	h := checkHost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		remote, path string
+		want         int
+	}{
+		{"127.0.0.1:40000", watchdogPath, http.StatusOK},
+		{"[::1]:40000", watchdogPath, http.StatusOK},
+		{"192.0.2.1:40000", watchdogPath, http.StatusMisdirectedRequest},
+		{"127.0.0.1:40000", "/show/ep1.mp4", http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://127.0.0.1:8080"+tt.path, nil)
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s from %s: got %d, want %d", tt.path, tt.remote, w.Code, tt.want)
+		}
+	}
+}
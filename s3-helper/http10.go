@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// http10 reports whether r comes from an HTTP/1.0 client, which can't
+// take a chunked response and needs a Content-Length
+func http10(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.ProtoMinor == 0
+}
+
+// bufferBody reads a response body of unknown length into memory, up to
+// max bytes, so that it can be sent with a Content-Length
+func bufferBody(resp *http.Response, max int64) error {
+	b, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > max {
+		return fmt.Errorf("body exceeds %d bytes", max)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inflightRequest is an upstream S3 request that hasn't finished yet
+type inflightRequest struct {
+	Key     string    `json:"key"`
+	Range   string    `json:"range,omitempty"`
+	Start   time.Time `json:"start"`
+	Age     string    `json:"age"`
+	Waiters int       `json:"waiters"`
+}
+
+// inflightTracker keeps track of the upstream requests in progress
+type inflightTracker struct {
+	mu   sync.Mutex
+	next uint64
+	reqs map[uint64]*inflightRequest
+}
+
+var inflight = &inflightTracker{reqs: make(map[uint64]*inflightRequest)}
+
+// begin records the start of an upstream request and returns a function
+// to call once it is done
+func (t *inflightTracker) begin(key, byterange string) func() {
+	t.mu.Lock()
+	id := t.next
+	t.next++
+	t.reqs[id] = &inflightRequest{
+		Key:     key,
+		Range:   byterange,
+		Start:   time.Now(),
+		Waiters: 1,
+	}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.reqs, id)
+		t.mu.Unlock()
+	}
+}
+
+// snapshot returns the requests in progress, oldest first
+func (t *inflightTracker) snapshot() []inflightRequest {
+	now := time.Now()
+	t.mu.Lock()
+	reqs := make([]inflightRequest, 0, len(t.reqs))
+	for _, req := range t.reqs {
+		r := *req
+		r.Age = now.Sub(r.Start).String()
+		reqs = append(reqs, r)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].Start.Before(reqs[j].Start)
+	})
+	return reqs
+}
+
+// inflightHandler dumps the upstream requests in progress as JSON
+func inflightHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inflight.snapshot())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The two limits answer differently so clients and CDNs can tell them
+// apart: hitting MaxInflight means we are overloaded and the request is
+// better retried elsewhere, hitting ClientRateLimit means this client
+// should back off.
+const (
+	overloadStatusDefault = http.StatusServiceUnavailable
+	throttleStatusDefault = http.StatusTooManyRequests
+)
+
+// Idle client rate limit buckets are dropped this often
+const clientSweepInterval = time.Minute
+
+// Slots for the requests being handled, nil when MaxInflight is off
+var inflightSlots chan struct{}
+
+// acquireSlot takes one of the MaxInflight slots, returning a function to
+// give it back, or false when they are all taken
+func acquireSlot() (func(), bool) {
+	if inflightSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case inflightSlots <- struct{}{}:
+		return func() { <-inflightSlots }, true
+	default:
+		return nil, false
+	}
+}
+
+// admit applies the client rate limit and then the in-flight limit to r,
+// answering it when it is over either.  Otherwise it returns a function to
+// call once r is done.
+func admit(w http.ResponseWriter, r *http.Request, object string) (func(), bool) {
+	if !clientLimits.allow(clientIP(r), time.Now()) {
+		metricRejectedThrottled.Add(1)
+		rejectRequest(w, conf.ThrottleStatus, conf.ThrottleRetryAfter)
+		log.Warn().
+			Str("object", object).
+			Str("client", clientIP(r)).
+			Msg("Client over its rate limit")
+		return nil, false
+	}
+	release, ok := acquireSlot()
+	if !ok {
+		metricRejectedOverload.Add(1)
+		rejectRequest(w, conf.OverloadStatus, conf.OverloadRetryAfter)
+		log.Warn().
+			Str("object", object).
+			Msg(fmt.Sprintf("Over %d requests in flight", conf.MaxInflight))
+		return nil, false
+	}
+	return release, true
+}
+
+// tokenBucket allows a client ClientRateLimit requests a second on
+// average and ClientRateBurst at once
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// clientLimiter keeps a token bucket per client address
+type clientLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+}
+
+var clientLimits = &clientLimiter{clients: make(map[string]*tokenBucket)}
+
+// refill tops up b for the time since it was last used
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(conf.ClientRateBurst),
+		b.tokens+now.Sub(b.last).Seconds()*conf.ClientRateLimit)
+	b.last = now
+}
+
+// allow takes a token from the client's bucket, false when it is empty
+func (cl *clientLimiter) allow(ip string, now time.Time) bool {
+	if conf.ClientRateLimit <= 0 {
+		return true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	b, ok := cl.clients[ip]
+	if !ok {
+		b = &tokenBucket{tokens: float64(conf.ClientRateBurst), last: now}
+		cl.clients[ip] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets clients whose buckets have filled up again, they start
+// over from a full one anyway
+func (cl *clientLimiter) sweep(now time.Time) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for ip, b := range cl.clients {
+		b.refill(now)
+		if b.tokens >= float64(conf.ClientRateBurst) {
+			delete(cl.clients, ip)
+		}
+	}
+}
+
+// retryAfter formats d as a Retry-After in whole seconds, rounding up
+func retryAfter(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// rejectRequest turns a request away with status, telling the client when
+// to try again
+func rejectRequest(w http.ResponseWriter, status int, after time.Duration) {
+	if after > 0 {
+		w.Header().Set("Retry-After", retryAfter(after))
+	}
+	w.WriteHeader(status)
+}
+
+// checkRejectStatus makes sure a limit answers with an error status
+func checkRejectStatus(status int) error {
+	if status < 400 || status > 599 {
+		return fmt.Errorf("%d is not a 4xx or 5xx status", status)
+	}
+	return nil
+}
+
+// initLimits sets up the concurrency and client rate limits
+func initLimits() {
+	if conf.MaxInflight > 0 {
+		inflightSlots = make(chan struct{}, conf.MaxInflight)
+		log.Info().Msg(fmt.Sprintf("Limiting requests in flight to %d, answering %d over it",
+			conf.MaxInflight, conf.OverloadStatus))
+	}
+	if conf.ClientRateLimit > 0 {
+		log.Info().Msg(fmt.Sprintf("Limiting clients to %v requests/s with bursts of %d, answering %d over it",
+			conf.ClientRateLimit, conf.ClientRateBurst, conf.ThrottleStatus))
+		go func() {
+			for range time.Tick(clientSweepInterval) {
+				clientLimits.sweep(time.Now())
+			}
+		}()
+	}
+}
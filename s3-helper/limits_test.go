@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// limitTest gives the test a fresh client limiter and in-flight slots
+func limitTest(t *testing.T) {
+	prevClients, prevSlots := clientLimits, inflightSlots
+	t.Cleanup(func() { clientLimits, inflightSlots = prevClients, prevSlots })
+	clientLimits = &clientLimiter{clients: make(map[string]*tokenBucket)}
+	inflightSlots = nil
+}
+
+func TestThrottled(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	limitTest(t)
+	conf.ClientRateLimit = 0.001
+	conf.ClientRateBurst = 1
+	conf.ThrottleStatus = throttleStatusDefault
+	conf.ThrottleRetryAfter = 5 * time.Second
+
+	if w := serve("GET", "/show/ep1.ts", nil); w.Code != 200 {
+		t.Fatalf("first request got %d", w.Code)
+	}
+	// refused methods are counted before they are refused
+	for _, method := range []string{"GET", "PUT", "DELETE", "POST"} {
+		w := serve(method, "/show/ep1.ts", nil)
+		if w.Code != 429 {
+			t.Errorf("%s over the rate got %d, want 429", method, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "5" {
+			t.Errorf("%s over the rate got Retry-After %q, want 5", method, got)
+		}
+	}
+}
+
+func TestOverloaded(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	limitTest(t)
+	conf.MaxInflight = 1
+	conf.OverloadStatus = overloadStatusDefault
+	conf.OverloadRetryAfter = 1500 * time.Millisecond
+	inflightSlots = make(chan struct{}, conf.MaxInflight)
+
+	inflightSlots <- struct{}{}
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		w := serve(method, "/show/ep1.ts", nil)
+		if w.Code != 503 {
+			t.Errorf("%s over the in-flight limit got %d, want 503", method, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "2" {
+			t.Errorf("%s over the in-flight limit got Retry-After %q, want 2", method, got)
+		}
+	}
+
+	<-inflightSlots
+	if w := serve("GET", "/show/ep1.ts", nil); w.Code != 200 {
+		t.Errorf("with a slot free got %d", w.Code)
+	}
+	if len(inflightSlots) != 0 {
+		t.Errorf("slot not given back")
+	}
+}
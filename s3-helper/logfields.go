@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// initLogLevel drops everything logged below LogLevel.  Debug lines that
+// are costly to build, e.g. the signing scope, check that they are enabled
+// first.
+func initLogLevel() {
+	level, err := zerolog.ParseLevel(conf.LogLevel)
+	if err != nil || level == zerolog.NoLevel {
+		exitConfig("S3_LOGLEVEL", fmt.Errorf("unknown level %q", conf.LogLevel))
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+// initLogFields tags every line logged from here on with the service and
+// environment, so logs of several deployments can share a store.  The
+// request loggers all derive from the global one and carry them too.
+func initLogFields() {
+	ctx := log.With().Str("service", conf.ServiceName)
+	if conf.Environment != "" {
+		ctx = ctx.Str("env", conf.Environment)
+	}
+	log.Logger = ctx.Logger()
+}
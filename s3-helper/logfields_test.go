@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLogFields(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	logs := captureLog(t)
+	conf.ServiceName = "vod-edge"
+	conf.Environment = "staging"
+	initLogFields()
+
+	serve("GET", "/show/ep1.ts", nil)
+	fields := logged(logs, "Request started")
+	if fields == nil || fields["service"] != "vod-edge" || fields["env"] != "staging" || fields["object"] != "/show/ep1.ts" {
+		t.Errorf("request logged as %v", fields)
+	}
+
+	logs = captureLog(t)
+	conf.Environment = ""
+	initLogFields()
+	serve("GET", "/show/ep1.ts", nil)
+	fields = logged(logs, "Request started")
+	if _, ok := fields["env"]; ok || fields["service"] != "vod-edge" {
+		t.Errorf("request logged as %v, want no env", fields)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How often MaintenanceFile is looked for
+const maintenanceFileInterval = 2 * time.Second
+
+// Page served in maintenance without a MaintenanceFile to take it from
+const maintenancePageDefault = "Down for maintenance, please try again later\n"
+
+// maintenanceState tracks whether object requests are answered with the
+// maintenance page instead of being proxied.  It is switched on from the
+// admin endpoint or by MaintenanceFile appearing, and is on while either
+// says so.
+type maintenanceState struct {
+	// checked by every request, so kept apart from the rest
+	on atomic.Bool
+
+	mu      sync.Mutex
+	byAdmin bool
+	byFile  bool
+	since   time.Time
+	page    []byte
+	ctype   string
+}
+
+var maintenance = &maintenanceState{page: []byte(maintenancePageDefault), ctype: "text/plain; charset=utf-8"}
+
+// update sets the admin or file switch and logs entering or leaving
+// maintenance.  The caller holds the lock.
+func (m *maintenanceState) update(byAdmin, byFile bool, why string) {
+	was := m.byAdmin || m.byFile
+	m.byAdmin, m.byFile = byAdmin, byFile
+	now := m.byAdmin || m.byFile
+	m.on.Store(now)
+	switch {
+	case now && !was:
+		m.since = time.Now()
+		log.Warn().Msg(fmt.Sprintf("Entering maintenance, %s", why))
+	case was && !now:
+		log.Warn().Msg(fmt.Sprintf("Leaving maintenance after %v, %s", time.Since(m.since).Round(time.Second), why))
+	}
+}
+
+// setAdmin switches maintenance on or off from the admin endpoint
+func (m *maintenanceState) setAdmin(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.update(on, m.byFile, "switched from the admin endpoint")
+}
+
+// checkFile switches maintenance on while MaintenanceFile exists, with its
+// content as the page
+func (m *maintenanceState) checkFile(name string) {
+	page, err := os.ReadFile(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().
+				Str("error", err.Error()).
+				Msg("Failed to read the maintenance file")
+		}
+		m.page = []byte(maintenancePageDefault)
+		m.update(m.byAdmin, false, "the maintenance file is gone")
+		return
+	}
+	m.page = page
+	m.update(m.byAdmin, true, "the maintenance file is there")
+}
+
+// status reports whether we are in maintenance and since when
+func (m *maintenanceState) status() (bool, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.on.Load(), m.since
+}
+
+// serveMaintenance answers with the maintenance page and a 503 telling
+// clients when to come back.  It isn't to be cached downstream, so the
+// content comes back as soon as we do.
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	maintenance.mu.Lock()
+	page, ctype := maintenance.page, maintenance.ctype
+	maintenance.mu.Unlock()
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", fmt.Sprint(len(page)))
+	w.Header().Set("Cache-Control", "no-store")
+	rejectRequest(w, http.StatusServiceUnavailable, conf.MaintenanceRetryAfter)
+	if r.Method != "HEAD" {
+		w.Write(page)
+	}
+}
+
+// maintenanceHandler switches maintenance on or off on a POST with
+// ?state=on or ?state=off, and answers with the state either way
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		switch r.URL.Query().Get("state") {
+		case "on":
+			maintenance.setAdmin(true)
+		case "off":
+			maintenance.setAdmin(false)
+		default:
+			http.Error(w, "state must be on or off", http.StatusBadRequest)
+			return
+		}
+	}
+	on, since := maintenance.status()
+	status := struct {
+		Maintenance bool       `json:"maintenance"`
+		Since       *time.Time `json:"since,omitempty"`
+	}{Maintenance: on}
+	if on {
+		status.Since = &since
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// initMaintenance starts looking for MaintenanceFile, whose extension
+// sets the page's content type
+func initMaintenance() {
+	if conf.MaintenanceFile == "" {
+		return
+	}
+	if ctype := mime.TypeByExtension(filepath.Ext(conf.MaintenanceFile)); ctype != "" {
+		maintenance.ctype = ctype
+	}
+	maintenance.checkFile(conf.MaintenanceFile)
+	go func() {
+		for range time.Tick(maintenanceFileInterval) {
+			maintenance.checkFile(conf.MaintenanceFile)
+		}
+	}()
+	log.Info().Msg(fmt.Sprintf("In maintenance while %s exists", conf.MaintenanceFile))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inMaintenance sets up a fresh maintenance state with an S3 that mustn't
+// be asked for anything, and returns the admin endpoint to switch it
+func inMaintenance(t *testing.T) func(state string) *httptest.ResponseRecorder {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("S3 asked for %s %s in maintenance", r.Method, r.URL.Path)
+	}))
+	prev := maintenance
+	t.Cleanup(func() { maintenance = prev })
+	maintenance = &maintenanceState{page: []byte(maintenancePageDefault), ctype: "text/plain; charset=utf-8"}
+	conf.MaintenanceRetryAfter = 5 * time.Minute
+
+	return func(state string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		maintenanceHandler(w, httptest.NewRequest("POST", "/admin/maintenance?state="+state, nil))
+		return w
+	}
+}
+
+func TestMaintenanceAdminSwitch(t *testing.T) {
+	set := inMaintenance(t)
+	logs := captureLog(t)
+
+	if w := set("maybe"); w.Code != 400 {
+		t.Errorf("state=maybe: got %d, want 400", w.Code)
+	}
+	if w := set("on"); !strings.Contains(w.Body.String(), `"maintenance":true`) {
+		t.Errorf("state=on: got %s", w.Body.String())
+	}
+	if logged(logs, "Entering maintenance, switched from the admin endpoint") == nil {
+		t.Error("entering maintenance not logged")
+	}
+
+	for _, method := range []string{"GET", "HEAD", "DELETE"} {
+		w := serve(method, "/show/ep1.ts", nil)
+		if w.Code != 503 {
+			t.Errorf("%s: got %d, want 503", method, w.Code)
+		}
+		if w.Header().Get("Retry-After") != "300" || w.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: got headers %v", method, w.Header())
+		}
+		if body := w.Body.String(); (method == "HEAD") != (body == "") {
+			t.Errorf("%s: got body %q", method, body)
+		}
+	}
+
+	if w := set("off"); !strings.Contains(w.Body.String(), `"maintenance":false`) {
+		t.Errorf("state=off: got %s", w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "Leaving maintenance after") {
+		t.Error("leaving maintenance not logged")
+	}
+}
+
+func TestMaintenanceFileSwitch(t *testing.T) {
+	set := inMaintenance(t)
+	name := filepath.Join(t.TempDir(), "maintenance.html")
+	maintenance.ctype = "text/html; charset=utf-8"
+
+	maintenance.checkFile(name)
+	if maintenance.on.Load() {
+		t.Fatal("in maintenance without the file")
+	}
+	os.WriteFile(name, []byte("<h1>Back soon</h1>"), 0600)
+	maintenance.checkFile(name)
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != 503 || w.Body.String() != "<h1>Back soon</h1>" ||
+		w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("got %d %q as %q, want the file's page", w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+	}
+
+	// on while either switch is
+	set("on")
+	os.Remove(name)
+	maintenance.checkFile(name)
+	if w := serve("GET", "/show/ep1.ts", nil); w.Code != 503 || w.Body.String() != maintenancePageDefault {
+		t.Errorf("admin switch on: got %d %q", w.Code, w.Body.String())
+	}
+	set("off")
+	if maintenance.on.Load() {
+		t.Error("still in maintenance with both switches off")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ManifestPrefetchConfig controls prefetching of the segments a manifest
+// references
+type ManifestPrefetchConfig struct {
+	Depth       int `yaml:"depth"`
+	Concurrency int `yaml:"concurrency"`
+}
+
+// Content types parsed as HLS or DASH manifests
+var manifestTypes = map[string]string{
+	"application/vnd.apple.mpegurl": "hls",
+	"application/x-mpegurl":         "hls",
+	"audio/mpegurl":                 "hls",
+	"audio/x-mpegurl":               "hls",
+	"application/dash+xml":          "dash",
+}
+
+// manifestKind returns "hls" or "dash" for manifest content types, or ""
+func manifestKind(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return manifestTypes[strings.ToLower(mt)]
+}
+
+// parseManifest returns up to max segment URIs referenced by a manifest,
+// in playback order
+func parseManifest(kind string, body []byte, max int) ([]string, error) {
+	var uris []string
+	switch kind {
+	case "hls":
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		first := true
+		for sc.Scan() && len(uris) < max {
+			line := strings.TrimSpace(sc.Text())
+			if first {
+				if line != "#EXTM3U" {
+					return nil, fmt.Errorf("missing #EXTM3U header")
+				}
+				first = false
+				continue
+			}
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			uris = append(uris, line)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	case "dash":
+		dec := xml.NewDecoder(bytes.NewReader(body))
+		for len(uris) < max {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			se, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			for _, attr := range se.Attr {
+				if (se.Name.Local == "SegmentURL" && attr.Name.Local == "media") ||
+					(se.Name.Local == "Initialization" && attr.Name.Local == "sourceURL") {
+					uris = append(uris, attr.Value)
+				}
+			}
+		}
+	}
+	return uris, nil
+}
+
+// resolveSegment maps a URI found in the manifest at upath onto an object
+// path in the bucket, or returns "" if it lives elsewhere
+func resolveSegment(upath, uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return ""
+	}
+	if strings.HasPrefix(u.Path, "/") {
+		return path.Clean(u.Path)
+	}
+	return path.Join(path.Dir(upath), u.Path)
+}
+
+// prefetcher fetches objects into the cache with a bounded worker pool
+type prefetcher struct {
+	keys chan string
+
+	// keys queued or being fetched, so each is only fetched once
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// The manifest prefetcher, nil when disabled
+var prefetch *prefetcher
+
+func newPrefetcher(concurrency int) *prefetcher {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	p := &prefetcher{
+		keys:    make(chan string, concurrency*16),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < concurrency; i++ {
+		go p.run()
+	}
+	return p
+}
+
+// enqueue schedules key to be fetched unless it is cached or already
+// queued.  Keys are dropped when the queue is full.
+func (p *prefetcher) enqueue(key string) {
+	if _, ok := cache.get(key); ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending[key] {
+		return
+	}
+	select {
+	case p.keys <- key:
+		p.pending[key] = true
+	default:
+	}
+}
+
+func (p *prefetcher) run() {
+	for key := range p.keys {
+		if err := p.fetch(key); err != nil {
+			log.Error().
+				Str("object", key).
+				Str("error", err.Error()).
+				Msg("Prefetch failed")
+		}
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+	}
+}
+
+// fetch reads the object at key from S3 into the cache
+func (p *prefetcher) fetch(key string) error {
+	r2, err := newS3Request("GET", key, nil)
+	if err != nil {
+		return err
+	}
+	defer inflight.begin(key, "")()
+	resp, err := doS3(r2)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	if !cache.cacheable(resp.ContentLength) {
+		return nil
+	}
+	body := make([]byte, resp.ContentLength)
+	if _, err := io.ReadFull(resp.Body, body); err != nil {
+		return err
+	}
+	cache.set(key, "", http.StatusOK, resp.Header, body)
+	log.Debug().
+		Str("object", key).
+		Int("content-length", len(body)).
+		Msg("Prefetched object")
+	return nil
+}
+
+// prefetchManifest queues the first segments referenced by a manifest
+// for prefetching.  Manifests that can't be parsed are logged and skipped.
+func prefetchManifest(upath, contentType string, body []byte) {
+	if prefetch == nil {
+		return
+	}
+	kind := manifestKind(contentType)
+	if kind == "" {
+		return
+	}
+	uris, err := parseManifest(kind, body, conf.ManifestPrefetch.Depth)
+	if err != nil {
+		log.Error().
+			Str("object", upath).
+			Str("error", err.Error()).
+			Msg("Failed to parse manifest for prefetch")
+		return
+	}
+	for _, uri := range uris {
+		if key := resolveSegment(upath, uri); key != "" {
+			prefetch.enqueue(key)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Methods counted under their own name in rejected_methods, anything else
+// a scanner makes up is counted as "other" so the map stays small
+var knownMethods = map[string]bool{
+	"PUT": true, "POST": true, "DELETE": true, "PATCH": true, "OPTIONS": true,
+	"TRACE": true, "TRACK": true, "CONNECT": true,
+	"PROPFIND": true, "MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+// rejectMethod answers a request with a method we don't serve with a 405
+// naming the ones we do, and leaves a trail of who tried it
+func rejectMethod(w http.ResponseWriter, r *http.Request) {
+	allow := []string{"GET", "HEAD"}
+	if conf.AllowUploads {
+		allow = append(allow, "PUT", "POST")
+	}
+	if conf.AllowDeletes {
+		allow = append(allow, "DELETE")
+	}
+	rejectMethodAllowing(w, r, allow)
+}
+
+// rejectMethodAllowing is rejectMethod for an endpoint serving the allow
+// methods
+func rejectMethodAllowing(w http.ResponseWriter, r *http.Request, allow []string) {
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+
+	method := r.Method
+	if !knownMethods[method] {
+		method = "other"
+	}
+	metricRejectedMethods.Add(method, 1)
+	log.Warn().
+		Str("method", r.Method).
+		Str("object", r.URL.Path).
+		Str("client", clientIP(r)).
+		Msg("Rejected method")
+}
+
+// rejectTrace turns away TRACE and TRACK on every path, those of the
+// debug and admin endpoints included, so a request is never echoed back
+// with whatever credentials or cookies came with it
+func rejectTrace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "TRACE" || r.Method == "TRACK" {
+			w.Header().Set("Server", serverName)
+			rejectMethod(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
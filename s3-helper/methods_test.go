@@ -0,0 +1,49 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRejectedMethods(t *testing.T) {
+	var calls int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	conf.AllowDeletes = true
+	logs := captureLog(t)
+	before := func(m string) int64 {
+		if v, ok := metricRejectedMethods.Get(m).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	patch, other := before("PATCH"), before("other")
+
+	w := serve("PATCH", "/show/ep1.ts", nil)
+	if w.Code != 405 || w.Header().Get("Allow") != "GET, HEAD, DELETE" {
+		t.Errorf("got %d Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	if fields := logged(logs, "Rejected method"); fields["method"] != "PATCH" || fields["client"] != "192.0.2.1" {
+		t.Errorf("logged as %v", fields)
+	}
+	serve("BREW", "/show/ep1.ts", nil)
+	if before("PATCH") != patch+1 || before("other") != other+1 {
+		t.Errorf("rejected_methods: %v", metricRejectedMethods)
+	}
+
+	// TRACE never gets as far as any handler
+	h := rejectTrace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("TRACE handled")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("TRACE", "/debug/vars", nil))
+	if rec.Code != 405 {
+		t.Errorf("TRACE got %d", rec.Code)
+	}
+	if calls != 0 {
+		t.Errorf("S3 got %d requests", calls)
+	}
+}
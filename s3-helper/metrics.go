@@ -0,0 +1,163 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Counters published on /debug/vars when metrics are enabled
+var (
+	metricAccessLogDropped = expvar.NewInt("access_log_dropped")
+	metricStaleServed      = expvar.NewInt("stale_served")
+
+	metricClientDisconnects  = expvar.NewInt("client_disconnects")
+	metricUpstreamReadErrors = expvar.NewInt("upstream_read_errors")
+	// bodies that didn't match the checksum S3 reported
+	metricChecksumFailures = expvar.NewInt("checksum_failures")
+	// and that didn't match their Content-MD5
+	metricContentMD5Failures = expvar.NewInt("content_md5_failures")
+	// ranges S3 answered with the whole object, counted with EnforceRange
+	// set
+	metricRangesIgnored = expvar.NewInt("ranges_ignored")
+	// full GETs given the content type sniffed from their body
+	metricContentTypeSniffed = expvar.NewInt("content_type_sniffed")
+	// upstream responses with a status outside SuccessStatuses
+	metricUpstreamErrors = expvar.NewInt("upstream_errors")
+	// 404s asked for again after MinObjectAge
+	metricNotFoundRetries = expvar.NewInt("not_found_retries")
+	// 1 while the share of 404s from S3 is over NotFoundAlarmRate
+	metricNotFoundAlarm = expvar.NewInt("not_found_alarm")
+
+	// requests refused with a 405 by method
+	metricRejectedMethods = expvar.NewMap("rejected_methods")
+
+	// requests taking longer than SlowRequestThreshold
+	metricSlowRequests = expvar.NewInt("slow_requests")
+
+	// requests turned away over MaxInflight and over ClientRateLimit
+	metricRejectedOverload  = expvar.NewInt("rejected_overload")
+	metricRejectedThrottled = expvar.NewInt("rejected_throttled")
+
+	// bytes of ranges served from merged cached ranges and fetched from
+	// S3 to fill the gaps in them
+	metricRangeBytesCache = expvar.NewInt("range_bytes_cache")
+	metricRangeBytesS3    = expvar.NewInt("range_bytes_s3")
+
+	// uploads passed on to S3, and the bytes of those S3 took
+	metricUploads     = expvar.NewInt("uploads")
+	metricUploadBytes = expvar.NewInt("upload_bytes")
+	// objects deleted in S3
+	metricDeletes = expvar.NewInt("deletes")
+
+	// HEAD requests answered from another client's upstream HEAD
+	metricHeadCoalesced = expvar.NewInt("head_coalesced")
+
+	// requests sent on to another endpoint after one from S3Endpoints
+	// failed
+	metricEndpointFailovers = expvar.NewInt("endpoint_failovers")
+
+	// reads sent to each region of RegionWeights, and those failed over
+	// to it
+	metricRegionRequests  = expvar.NewMap("region_requests")
+	metricRegionFailovers = expvar.NewMap("region_failovers")
+
+	// requests sent path-style after their virtual host didn't resolve
+	metricAddressingFallbacks = expvar.NewInt("addressing_fallbacks")
+
+	// fetches from S3 under way and waiting for one of the
+	// MaxS3Concurrency slots, and those given up on
+	metricS3Outstanding = expvar.NewInt("s3_outstanding")
+	metricS3Queued      = expvar.NewInt("s3_queued")
+	metricS3Shed        = expvar.NewInt("s3_shed")
+
+	// connections to S3 currently open
+	metricS3Conns = expvar.NewInt("s3_conns")
+	// S3 responses that closed their connection despite keep-alives
+	metricUpstreamConnClose = expvar.NewInt("upstream_conn_close")
+
+	// S3 requests on a reused and on a new connection, and the time new
+	// ones spent in DNS lookups and TLS handshakes in milliseconds
+	metricS3ConnsReused = expvar.NewInt("s3_conns_reused")
+	metricS3ConnsNew    = expvar.NewInt("s3_conns_new")
+	metricS3DNSMillis   = expvar.NewInt("s3_dns_ms")
+	metricS3TLSMillis   = expvar.NewInt("s3_tls_ms")
+
+	// request counts and total time in milliseconds by path bucket
+	metricRequests      = expvar.NewMap("requests")
+	metricRequestMillis = expvar.NewMap("request_ms")
+)
+
+// Label of requests that match no path bucket
+const metricsOtherBucket = "other"
+
+// pathBucket maps request paths matching a pattern onto a metrics label.
+// Patterns starting with "/" are path prefixes, others are matched
+// against the file name, e.g. "*.m3u8".
+type pathBucket struct {
+	Label   string
+	Pattern string
+}
+
+func (b pathBucket) match(upath string) bool {
+	return pathMatch(b.Pattern, upath)
+}
+
+// pathMatch matches upath against a path prefix starting with "/", or a
+// file name pattern otherwise
+func pathMatch(pattern, upath string) bool {
+	if strings.HasPrefix(pattern, "/") {
+		return strings.HasPrefix(upath, pattern)
+	}
+	ok, _ := path.Match(pattern, path.Base(upath))
+	return ok
+}
+
+// parsePathBuckets parses a comma separated list of label=pattern pairs,
+// a pattern on its own is its own label
+func parsePathBuckets(s string) ([]pathBucket, error) {
+	var buckets []pathBucket
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		b := pathBucket{Label: item, Pattern: item}
+		if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+			b = pathBucket{Label: strings.TrimSpace(kv[0]), Pattern: strings.TrimSpace(kv[1])}
+		}
+		if _, err := path.Match(b.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", b.Pattern, err)
+		}
+		if b.Label == "" || b.Label == metricsOtherBucket {
+			return nil, fmt.Errorf("invalid label %q", b.Label)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// metricsLabel returns the label of the first bucket upath falls into, so
+// the number of labels is bounded by the config
+func metricsLabel(upath string) string {
+	for _, b := range conf.MetricsPathBuckets {
+		if b.match(upath) {
+			return b.Label
+		}
+	}
+	return metricsOtherBucket
+}
+
+// recordRequest counts a finished request against its path bucket and
+// in the latency histogram, traced ones leaving their trace as exemplar
+func recordRequest(upath string, start time.Time, traceID string) {
+	took := time.Since(start)
+	label := metricsLabel(upath)
+	metricRequests.Add(label, 1)
+	metricRequestMillis.Add(label, took.Milliseconds())
+	if conf.MetricsEnabled {
+		requestLatency.observe(took, traceID)
+	}
+}
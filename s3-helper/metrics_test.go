@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"testing"
+)
+
+func TestParsePathBuckets(t *testing.T) {
+	buckets, err := parsePathBuckets("manifests=*.m3u8, /live/, *.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pathBucket{{"manifests", "*.m3u8"}, {"/live/", "/live/"}, {"*.ts", "*.ts"}}
+	if len(buckets) != len(want) {
+		t.Fatalf("got %v, want %v", buckets, want)
+	}
+	for i := range want {
+		if buckets[i] != want[i] {
+			t.Errorf("bucket %d is %v, want %v", i, buckets[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{"other=*.ts", "=*.ts", "x=[a-"} {
+		if _, err := parsePathBuckets(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestRequestsCountedByBucket(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	conf.MetricsPathBuckets, _ = parsePathBuckets("live=/live/,manifests=*.m3u8")
+
+	count := func(label string) int64 {
+		if v := metricRequests.Get(label); v != nil {
+			return v.(*expvar.Int).Value()
+		}
+		return 0
+	}
+	live, manifests, other := count("live"), count("manifests"), count(metricsOtherBucket)
+
+	serve("GET", "/live/ch1/index.m3u8", nil)
+	serve("GET", "/vod/ep1/index.m3u8", nil)
+	serve("GET", "/vod/ep1/seg1.ts", nil)
+	serve("GET", "/vod/ep1/seg2.ts", nil)
+
+	if count("live") != live+1 || count("manifests") != manifests+1 || count(metricsOtherBucket) != other+2 {
+		t.Errorf("counted live %d, manifests %d, other %d, want 1, 1 and 2",
+			count("live")-live, count("manifests")-manifests, count(metricsOtherBucket)-other)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "net/http"
+
+// Response headers kept with MinimalHeaders.  Besides the ones describing
+// the body they include those the helper's own answers can't do without,
+// the encoding of compressed bodies, the target of redirects and when to
+// come back after a 503 or 429.
+var minimalHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"ETag",
+	"Accept-Ranges",
+	"Content-Encoding",
+	"Vary",
+	"Location",
+	"Retry-After",
+}
+
+// stripToMinimal drops every header of a response but minimalHeaders,
+// including the Date net/http would otherwise add
+func stripToMinimal(h http.Header, status int) {
+	kept := make(http.Header, len(minimalHeaders))
+	for _, name := range minimalHeaders {
+		if v := h.Values(name); len(v) > 0 {
+			kept[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	for name := range h {
+		delete(h, name)
+	}
+	for name, v := range kept {
+		h[name] = v
+	}
+	if (status == http.StatusOK || status == http.StatusPartialContent) && h.Get("Accept-Ranges") == "" {
+		h.Set("Accept-Ranges", "bytes")
+	}
+	h["Date"] = nil
+}
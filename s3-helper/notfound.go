@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// notFoundWatch tracks the share of S3 responses that are 404s over fixed
+// windows.  Nearly all of them being 404 usually means S3Bucket or S3Path
+// point at the wrong place rather than clients asking for missing objects.
+type notFoundWatch struct {
+	mu       sync.Mutex
+	start    time.Time
+	total    int64
+	notFound int64
+}
+
+var notFoundAlarm = &notFoundWatch{}
+
+// initNotFoundAlarm judges windows on a timer as well as on requests, so
+// the alarm clears once the 404s stop even if the requests stop with them
+func initNotFoundAlarm() {
+	if conf.NotFoundAlarmRate <= 0 {
+		return
+	}
+	go notFoundAlarm.decay(conf.NotFoundAlarmWindow)
+}
+
+// decay rolls over the window every interval
+func (nw *notFoundWatch) decay(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		nw.mu.Lock()
+		nw.roll(now)
+		nw.mu.Unlock()
+	}
+}
+
+// record counts an S3 response, judging the previous window once its time
+// is up
+func (nw *notFoundWatch) record(status int) {
+	if conf.NotFoundAlarmRate <= 0 {
+		return
+	}
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.roll(time.Now())
+	nw.total++
+	if status == http.StatusNotFound {
+		nw.notFound++
+	}
+}
+
+// roll judges the current window and starts a new one once its time is
+// up.  The caller holds the lock.
+func (nw *notFoundWatch) roll(now time.Time) {
+	if nw.start.IsZero() {
+		nw.start = now
+	}
+	if elapsed := now.Sub(nw.start); elapsed >= conf.NotFoundAlarmWindow {
+		nw.check(elapsed)
+		nw.start, nw.total, nw.notFound = now, 0, 0
+	}
+}
+
+// check raises or clears the alarm for a finished window.  Windows with
+// too few requests to go by clear it too, the alarm only stays up while
+// windows keep confirming it.
+func (nw *notFoundWatch) check(elapsed time.Duration) {
+	if nw.total < int64(conf.NotFoundAlarmMinRequests) ||
+		float64(nw.notFound) < conf.NotFoundAlarmRate*float64(nw.total) {
+		metricNotFoundAlarm.Set(0)
+		return
+	}
+	metricNotFoundAlarm.Set(1)
+	log.Warn().
+		Int64("not-found", nw.notFound).
+		Int64("requests", nw.total).
+		Str("bucket", conf.S3Bucket).
+		Msg(fmt.Sprintf("S3 answered 404 to %d of %d requests in the last %v, check that S3_BUCKET is right",
+			nw.notFound, nw.total, elapsed.Round(time.Second)))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestNotFoundAlarmDecays(t *testing.T) {
+	var buf bytes.Buffer
+	prevLogger, prevConf := log.Logger, conf
+	t.Cleanup(func() {
+		log.Logger, conf = prevLogger, prevConf
+		metricNotFoundAlarm.Set(0)
+	})
+	log.Logger = zerolog.New(&buf)
+	conf.NotFoundAlarmRate = 0.9
+	conf.NotFoundAlarmWindow = time.Minute
+	conf.NotFoundAlarmMinRequests = 10
+
+	nw := &notFoundWatch{}
+	start := time.Now()
+	nw.roll(start)
+	for i := 0; i < 10; i++ {
+		nw.total++
+		nw.notFound++
+	}
+	nw.roll(start.Add(time.Minute))
+	if metricNotFoundAlarm.Value() != 1 {
+		t.Fatal("alarm not raised for a window of 404s")
+	}
+	if !strings.Contains(buf.String(), "check that S3_BUCKET is right") {
+		t.Errorf("no warning logged: %s", buf.String())
+	}
+
+	// a window without requests, as the timer sees it
+	nw.roll(start.Add(2 * time.Minute))
+	if metricNotFoundAlarm.Value() != 0 {
+		t.Error("alarm still raised after a window without requests")
+	}
+}
+
+func TestNotFoundAlarmClearsBelowRate(t *testing.T) {
+	prevConf := conf
+	t.Cleanup(func() {
+		conf = prevConf
+		metricNotFoundAlarm.Set(0)
+	})
+	conf.NotFoundAlarmRate = 0.5
+	conf.NotFoundAlarmWindow = time.Minute
+	conf.NotFoundAlarmMinRequests = 1
+
+	nw := &notFoundWatch{}
+	metricNotFoundAlarm.Set(1)
+	nw.record(http.StatusNotFound)
+	nw.record(http.StatusOK)
+	nw.record(http.StatusOK)
+	nw.roll(nw.start.Add(time.Minute))
+	if metricNotFoundAlarm.Value() != 0 {
+		t.Error("alarm still raised for a window mostly of 200s")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// retryNotFound reports whether a 404 from S3 should be asked for again,
+// once, after waiting MinObjectAge.  An object written moments ago may not
+// be visible to reads yet, so a client reading right after its write
+// would otherwise be told it doesn't exist.  The 404 is closed when it is
+// retried.
+func retryNotFound(resp *http.Response, err error, retried *bool, logger zerolog.Logger) bool {
+	if conf.MinObjectAge <= 0 || *retried || err != nil || resp.StatusCode != http.StatusNotFound {
+		return false
+	}
+	*retried = true
+	resp.Body.Close()
+	metricNotFoundRetries.Add(1)
+	logger.Info().Msg(fmt.Sprintf("Not found, asking again in %v in case it was just written", conf.MinObjectAge))
+	time.Sleep(conf.MinObjectAge)
+	return true
+}
+
+// logYoungObject notes an object last modified within MinObjectAge, whose
+// readers may still be getting an older version of it
+func logYoungObject(resp *http.Response, logger zerolog.Logger) {
+	if conf.MinObjectAge <= 0 || resp.StatusCode != http.StatusOK {
+		return
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return
+	}
+	if age := time.Since(modified); age < conf.MinObjectAge {
+		logger.Debug().
+			Dur("age", age).
+			Msg("Object modified within the minimum age, it may not be consistent yet")
+	}
+}
+
+// setObjectAge sets the Age header of a response straight from S3 when
+// DirectAge is on.  S3 doesn't hold responses, so the time since the
+// object was last modified stands in for it, or since S3's Date when
+// there is no Last-Modified.  That easily runs to months, so it is capped
+// at the response's max-age lest downstream caches take every object for
+// long expired.  An Age S3 already gave is passed on as is.
+func setObjectAge(w http.ResponseWriter, resp *http.Response) {
+	if !conf.DirectAge || resp.StatusCode < 200 || resp.StatusCode > 299 || w.Header().Get("Age") != "" {
+		return
+	}
+	if v := resp.Header.Get("Age"); v != "" {
+		w.Header().Set("Age", v)
+		return
+	}
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		if t, err = http.ParseTime(resp.Header.Get("Date")); err != nil {
+			return
+		}
+	}
+	age := time.Since(t)
+	if age < 0 {
+		age = 0
+	}
+	if maxAge, ok := responseMaxAge(w.Header()); ok && age > maxAge {
+		age = maxAge
+	}
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+}
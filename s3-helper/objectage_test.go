@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotFoundRetriedOnce(t *testing.T) {
+	var fetches int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Path == "/bucket/show/gone.ts" || fetches == 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("segment"))
+	}))
+	conf.MinObjectAge = 10 * time.Millisecond
+
+	w := serve("GET", "/show/new.ts", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "segment" || fetches != 2 {
+		t.Errorf("got %d %q after %d fetches, want the object on the second", w.Code, w.Body.String(), fetches)
+	}
+
+	fetches = 0
+	w = serve("GET", "/show/gone.ts", nil)
+	if w.Code != http.StatusNotFound || fetches != 2 {
+		t.Errorf("got %d after %d fetches, want a 404 after asking twice", w.Code, fetches)
+	}
+
+	conf.MinObjectAge = 0
+	fetches = 0
+	if w := serve("GET", "/show/gone.ts", nil); w.Code != http.StatusNotFound || fetches != 1 {
+		t.Errorf("got %d after %d fetches with no minimum age", w.Code, fetches)
+	}
+}
+
+func TestDirectAgeCappedAtMaxAge(t *testing.T) {
+	prevConf := conf
+	t.Cleanup(func() { conf = prevConf })
+	conf.DirectAge = true
+
+	for _, tc := range []struct {
+		cacheControl string
+		want         string
+	}{
+		{"public, max-age=300", "300"},
+		{"", "31536000"},
+		{"max-age=bogus", "31536000"},
+	} {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+		resp.Header.Set("Last-Modified", time.Now().Add(-365*24*time.Hour).UTC().Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		if tc.cacheControl != "" {
+			w.Header().Set("Cache-Control", tc.cacheControl)
+		}
+		setObjectAge(w, resp)
+		if got := w.Header().Get("Age"); got != tc.want {
+			t.Errorf("Cache-Control %q: Age %s, want %s", tc.cacheControl, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Content types of the two text exposition formats
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// What a metric namespace may look like, the start of a metric name
+var metricNamespaceRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// checkMetricsNamespace validates MetricsNamespace
+func checkMetricsNamespace(ns string) error {
+	if !metricNamespaceRe.MatchString(ns) {
+		return fmt.Errorf("%q is not a valid metric name prefix", ns)
+	}
+	return nil
+}
+
+// metricName puts name in MetricsNamespace
+func metricName(name string) string {
+	return conf.MetricsNamespace + "_" + name
+}
+
+// labelEscape escapes a label value for the text formats
+var labelEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// wantsOpenMetrics reports whether a scraper asked for OpenMetrics
+func wantsOpenMetrics(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+}
+
+// openMetricsHandler serves the counters of /debug/vars and the latency
+// histogram, all named within MetricsNamespace.  Scrapers asking for
+// OpenMetrics get it with exemplars when requests are traced, others the
+// Prometheus text format.  The counters' expvar names don't say whether
+// they only go up so they are left untyped, and the path buckets of maps
+// become a "bucket" label.
+func openMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	om := wantsOpenMetrics(r)
+	untyped := "untyped"
+	w.Header().Set("Content-Type", prometheusContentType)
+	if om {
+		untyped = "unknown"
+		w.Header().Set("Content-Type", openMetricsContentType)
+	}
+
+	bw := bufio.NewWriter(w)
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := metricName(kv.Key)
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, untyped)
+			fmt.Fprintf(bw, "%s %d\n", name, v.Value())
+		case *expvar.Map:
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, untyped)
+			v.Do(func(kv expvar.KeyValue) {
+				fmt.Fprintf(bw, "%s{bucket=\"%s\"} %s\n", name, labelEscape.Replace(kv.Key), kv.Value.String())
+			})
+		}
+	})
+	requestLatency.write(bw, metricName("request_duration_seconds"), om)
+	if om {
+		bw.WriteString("# EOF\n")
+	}
+	bw.Flush()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExport(t *testing.T) {
+	prev := conf.MetricsNamespace
+	t.Cleanup(func() { conf.MetricsNamespace = prev })
+	conf.MetricsNamespace = "edge"
+	metricRequests.Add(`show"1`, 0)
+
+	w := httptest.NewRecorder()
+	openMetricsHandler(w, httptest.NewRequest("GET", "/debug/metrics", nil))
+	metrics := w.Body.String()
+	if ct := w.Header().Get("Content-Type"); ct != prometheusContentType {
+		t.Errorf("got Content-Type %q, want the Prometheus text format", ct)
+	}
+	for _, want := range []string{
+		"# TYPE edge_upstream_errors untyped\nedge_upstream_errors ",
+		`edge_requests{bucket="show\"1"} `,
+		"# TYPE edge_request_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("missing %q in:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, "# UNIT") || strings.Contains(metrics, "# EOF") {
+		t.Errorf("OpenMetrics only lines in the Prometheus format:\n%s", metrics)
+	}
+
+	for _, ns := range []string{"", "1st", "edge-cache"} {
+		if checkMetricsNamespace(ns) == nil {
+			t.Errorf("namespace %q accepted", ns)
+		}
+	}
+}
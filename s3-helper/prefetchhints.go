@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Manifests larger than this are passed on without prefetch hints, as
+// they have to be read in full before the response starts
+const prefetchHintMaxBytes = 1 << 20
+
+// wantsPrefetchHints reports whether a full GET response is a manifest
+// to add prefetch hints to
+func wantsPrefetchHints(resp *http.Response) bool {
+	return conf.PrefetchHints > 0 && resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Content-Encoding") == "" && manifestKind(resp.Header.Get("Content-Type")) != "" &&
+		resp.ContentLength >= 0 && resp.ContentLength <= prefetchHintMaxBytes
+}
+
+// addPrefetchHints adds a "Link: <uri>; rel=prefetch" header for each of
+// the first PrefetchHints segments of the manifest at upath, so players
+// can fetch them early.  Only segments in the bucket are hinted, and a
+// manifest that doesn't parse gets none.  It returns the number added.
+func addPrefetchHints(h http.Header, upath, contentType string, body []byte) (int, error) {
+	kind := manifestKind(contentType)
+	if conf.PrefetchHints <= 0 || kind == "" {
+		return 0, nil
+	}
+	// a few more than needed, some may point elsewhere
+	uris, err := parseManifest(kind, body, 2*conf.PrefetchHints)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, uri := range uris {
+		if n == conf.PrefetchHints {
+			break
+		}
+		key := resolveSegment(upath, uri)
+		if key == "" {
+			continue
+		}
+		h.Add("Link", fmt.Sprintf("<%s>; rel=prefetch", (&url.URL{Path: key}).EscapedPath()))
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPrefetchHints(t *testing.T) {
+	const playlist = "#EXTM3U\n#EXTINF:6,\nseg 1.ts\n#EXTINF:6,\nhttp://elsewhere/seg2.ts\n" +
+		"#EXTINF:6,\n../other/seg3.ts\n#EXTINF:6,\nseg4.ts\n"
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/show/broken.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Write([]byte("not a playlist"))
+		case "/bucket/show/ep1.ts":
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Write([]byte(playlist))
+		default:
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Write([]byte(playlist))
+		}
+	}))
+	conf.PrefetchHints = 2
+
+	w := serve("GET", "/show/index.m3u8", nil)
+	want := []string{"</show/seg%201.ts>; rel=prefetch", "</other/seg3.ts>; rel=prefetch"}
+	links := w.Header()["Link"]
+	if len(links) != len(want) || links[0] != want[0] || links[1] != want[1] {
+		t.Errorf("got Link %q, want %q", links, want)
+	}
+	if w.Body.String() != playlist {
+		t.Errorf("got body %q, want the whole manifest", w.Body.String())
+	}
+
+	for _, c := range []struct{ method, target string }{
+		{"GET", "/show/broken.m3u8"},
+		{"GET", "/show/ep1.ts"},
+		{"HEAD", "/show/index.m3u8"},
+	} {
+		if links := serve(c.method, c.target, nil).Header()["Link"]; len(links) != 0 {
+			t.Errorf("%s %s: got Link %q", c.method, c.target, links)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Cache status of a range pieced together from the cache and S3
+const cachePartial = "PARTIAL"
+
+// span is a run of cached bytes of an object starting at first
+type span struct {
+	first int64
+	data  []byte
+}
+
+func (s span) last() int64 {
+	return s.first + int64(len(s.data)) - 1
+}
+
+// byteSpan is a range of bytes first to last inclusive
+type byteSpan struct {
+	first, last int64
+}
+
+// partialObject holds the cached ranges of one version of an object.  The
+// spans are kept sorted and merged so no two overlap or touch, which makes
+// finding the cached parts of a range a binary search.  Their data is
+// never modified once stored, merging builds a new slice.
+type partialObject struct {
+	etag    string
+	total   int64
+	header  http.Header
+	spans   []span
+	size    int64
+	expires time.Time
+	// where the object is in the cache's LRU list
+	elem *list.Element
+}
+
+// add merges the bytes at first into the spans.  When that makes the
+// object hold more than max bytes the spans furthest from the new one are
+// dropped, and the new one stays on its own if even that isn't enough.
+func (p *partialObject) add(first int64, data []byte, max int64) {
+	last := first + int64(len(data)) - 1
+	// the spans from i up to j overlap or touch the new one
+	i := sort.Search(len(p.spans), func(k int) bool { return p.spans[k].last()+1 >= first })
+	j := i
+	for j < len(p.spans) && p.spans[j].first <= last+1 {
+		j++
+	}
+
+	merged := span{first: first, data: data}
+	if j > i {
+		lo, hi := first, last
+		if p.spans[i].first < lo {
+			lo = p.spans[i].first
+		}
+		if p.spans[j-1].last() > hi {
+			hi = p.spans[j-1].last()
+		}
+		if hi-lo+1 <= max {
+			buf := make([]byte, hi-lo+1)
+			for _, s := range p.spans[i:j] {
+				copy(buf[s.first-lo:], s.data)
+			}
+			copy(buf[first-lo:], data)
+			merged = span{first: lo, data: buf}
+		}
+	}
+
+	spans := make([]span, 0, len(p.spans)-(j-i)+1)
+	spans = append(spans, p.spans[:i]...)
+	spans = append(spans, merged)
+	spans = append(spans, p.spans[j:]...)
+	p.spans = spans
+	p.size = 0
+	for _, s := range p.spans {
+		p.size += int64(len(s.data))
+	}
+
+	for p.size > max && len(p.spans) > 1 {
+		k := 0
+		if merged.first-p.spans[0].last() < p.spans[len(p.spans)-1].first-merged.last() {
+			k = len(p.spans) - 1
+		}
+		p.size -= int64(len(p.spans[k].data))
+		p.spans = append(p.spans[:k:k], p.spans[k+1:]...)
+	}
+}
+
+// pieces splits first to last into the spans covering it, cached ones
+// with their data and gaps with none
+func (p *partialObject) pieces(first, last int64) []span {
+	var pieces []span
+	pos := first
+	i := sort.Search(len(p.spans), func(k int) bool { return p.spans[k].last() >= first })
+	for ; i < len(p.spans) && pos <= last; i++ {
+		s := p.spans[i]
+		if s.first > last {
+			break
+		}
+		if s.first > pos {
+			pieces = append(pieces, span{first: pos, data: nil})
+			pos = s.first
+		}
+		end := s.last()
+		if end > last {
+			end = last
+		}
+		pieces = append(pieces, span{first: pos, data: s.data[pos-s.first : end-s.first+1]})
+		pos = end + 1
+	}
+	if pos <= last {
+		pieces = append(pieces, span{first: pos, data: nil})
+	}
+	return pieces
+}
+
+// mergesRanges reports whether ranges are cached in merged pieces
+func (c *objectCache) mergesRanges() bool {
+	return c != nil && c.rangeMax > 0
+}
+
+// rangeCacheable reports whether a range of n bytes can be cached
+func (c *objectCache) rangeCacheable(n int64) bool {
+	return c.mergesRanges() && n >= 0 && n <= c.rangeMax && n <= c.maxBytes
+}
+
+// addRange merges the body of a 206 response into the cached ranges of
+// the object at path, starting afresh when it comes from another version
+func (c *objectCache) addRange(path string, header http.Header, body []byte) {
+	if !c.rangeCacheable(int64(len(body))) || len(body) == 0 {
+		return
+	}
+	first, last, total, ok := parseContentRange(header.Get("Content-Range"))
+	if !ok || total < 0 || last-first+1 != int64(len(body)) {
+		return
+	}
+	ttl := cacheTTL(path, header, c.ttl)
+	if ttl <= 0 {
+		return
+	}
+	etag := header.Get("ETag")
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the object is rebuilt so that callers of partial holding on to
+	// the old one don't see it change
+	c.invalidate(path, etag)
+	old, ok := c.partials[path]
+	c.removePartial(path)
+	h := header.Clone()
+	h.Del("Content-Range")
+	h.Del("Content-Length")
+	p := &partialObject{etag: etag, total: total, header: h}
+	if ok && etag != "" && now.Before(old.expires) && old.total == total {
+		p.spans, p.size = old.spans, old.size
+	}
+	p.expires = now.Add(ttl)
+
+	c.evict(p.size + int64(len(body)))
+	p.add(first, body, c.rangeMax)
+	p.elem = c.lru.PushFront(lruItem{key: path, partial: true})
+	c.partials[path] = p
+	c.size += p.size
+}
+
+// partial returns the fresh cached ranges of the object at path.  The
+// object must not be modified, addRange replaces it instead.
+func (c *objectCache) partial(path string) (*partialObject, bool) {
+	if !c.mergesRanges() {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.partials[path]
+	if !ok || !time.Now().Before(p.expires) {
+		return nil, false
+	}
+	c.lru.MoveToFront(p.elem)
+	return p, true
+}
+
+// removePartial drops the cached ranges of path.  Must be called with the
+// lock held.
+func (c *objectCache) removePartial(path string) {
+	if p, ok := c.partials[path]; ok {
+		c.size -= p.size
+		c.lru.Remove(p.elem)
+		delete(c.partials, path)
+	}
+}
+
+// serveMergedRange answers a range of an object we have some of cached,
+// fetching only the gaps from S3, and returns false without writing
+// anything when it is better left to a plain request.  All gaps are
+// fetched before the response starts so that a failure, e.g. the object
+// changing in S3, can still fall back.
+func serveMergedRange(w http.ResponseWriter, upath, byterange string, limits RetryConfig,
+	logger zerolog.Logger) bool {
+	p, ok := cache.partial(upath)
+	if !ok {
+		return false
+	}
+	first, last, ok := parseByteRange(byterange)
+	if !ok || first >= p.total {
+		return false
+	}
+	if last < 0 || last >= p.total {
+		last = p.total - 1
+	}
+	if last-first+1 > cache.rangeMax {
+		return false
+	}
+
+	pieces := p.pieces(first, last)
+	if len(pieces) == 1 && pieces[0].data == nil {
+		return false
+	}
+	var cached, fetched int64
+	nretries := map[string]int{}
+	for i, piece := range pieces {
+		if piece.data != nil {
+			cached += int64(len(piece.data))
+			continue
+		}
+		end := last
+		if i+1 < len(pieces) {
+			end = pieces[i+1].first - 1
+		}
+		data, header, err := fetchGap(upath, byteSpan{piece.first, end}, p.etag, limits, nretries, logger)
+		if err != nil {
+			logger.Warn().
+				Str("error", err.Error()).
+				Int64("gap-start", piece.first).
+				Msg("Could not fill range from cache, fetching it whole")
+			if err == errObjectChanged {
+				cache.delete(upath)
+			}
+			return false
+		}
+		pieces[i].data = data
+		fetched += int64(len(data))
+		cache.addRange(upath, header, data)
+	}
+
+	for name, hflag := range headerForward {
+		if hflag {
+			if v := p.header.Get(name); v != "" {
+				w.Header().Set(name, v)
+			}
+		}
+	}
+	status := cacheHit
+	if fetched > 0 {
+		status = cachePartial
+	}
+	setCacheStatus(w, status)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, p.total))
+	w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	for _, piece := range pieces {
+		if _, err := w.Write(piece.data); err != nil {
+			metricClientDisconnects.Add(1)
+			logger.Info().
+				Str("error", err.Error()).
+				Msg("Client disconnected during body copy")
+			abortConnection(w)
+			return true
+		}
+	}
+	metricRangeBytesCache.Add(cached)
+	metricRangeBytesS3.Add(fetched)
+	logger.Info().
+		Int64("content-length", last-first+1).
+		Int64("cached", cached).
+		Int64("fetched", fetched).
+		Msg("Served range from cache and S3")
+	return true
+}
+
+// errObjectChanged is returned when S3 no longer has the version of an
+// object cached ranges belong to
+var errObjectChanged = errors.New("object changed in S3")
+
+// fetchGap fetches a range missing from the cache, which must come from
+// the version with the given ETag, along with the headers of S3's answer
+func fetchGap(upath string, gap byteSpan, etag string, limits RetryConfig, nretries map[string]int,
+	logger zerolog.Logger) ([]byte, http.Header, error) {
+	resp, err := fetchRangeChunk(upath, nil, gap.first, gap.last, etag, limits, nretries, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, resp.Header, errObjectChanged
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, resp.Header, fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	first, last, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || first != gap.first || last != gap.last {
+		return nil, resp.Header, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, gap.last-gap.first+1))
+	if err == nil && int64(len(data)) != gap.last-gap.first+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		metricUpstreamReadErrors.Add(1)
+		return nil, resp.Header, err
+	}
+	return data, resp.Header, nil
+}
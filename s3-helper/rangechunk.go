@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// parseByteRange parses a single "bytes=first-last" or "bytes=first-"
+// range, last is -1 when it is left open.  Suffix and multi-part ranges
+// are not understood.
+func parseByteRange(s string) (first, last int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return 0, 0, false
+	}
+	spec := strings.TrimSpace(s[len("bytes="):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	dash := strings.IndexByte(spec, '-')
+	if dash <= 0 {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+	if spec[dash+1:] == "" {
+		return first, -1, true
+	}
+	last, err = strconv.ParseInt(spec[dash+1:], 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// validRange reports whether a Range header is a well formed set of byte
+// ranges, "bytes" being the only unit S3 understands.  Ranges past the end
+// of the object are left to S3.
+func validRange(s string) bool {
+	eq := strings.IndexByte(s, '=')
+	if eq < 0 || !strings.EqualFold(strings.TrimSpace(s[:eq]), "bytes") {
+		return false
+	}
+	digits := func(v string) bool {
+		_, err := strconv.ParseUint(v, 10, 64)
+		return err == nil
+	}
+	n := 0
+	for _, spec := range strings.Split(s[eq+1:], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return false
+		}
+		first, last := spec[:dash], spec[dash+1:]
+		switch {
+		case first == "":
+			// a suffix, the last so many bytes
+			if !digits(last) {
+				return false
+			}
+		case !digits(first) || (last != "" && !digits(last)):
+			return false
+		case last != "":
+			f, _ := strconv.ParseUint(first, 10, 64)
+			l, _ := strconv.ParseUint(last, 10, 64)
+			if l < f {
+				return false
+			}
+		}
+		n++
+	}
+	return n > 0
+}
+
+// parseContentRange parses a "bytes first-last/total" Content-Range, total
+// is -1 when S3 reports it as unknown
+func parseContentRange(s string) (first, last, total int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, 0, false
+	}
+	spec := s[len("bytes "):]
+	slash := strings.IndexByte(spec, '/')
+	if slash < 0 {
+		return 0, 0, 0, false
+	}
+	first, last, ok = parseByteRange("bytes=" + spec[:slash])
+	if !ok || last < 0 {
+		return 0, 0, 0, false
+	}
+	total = -1
+	if t := spec[slash+1:]; t != "*" {
+		n, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || n <= last {
+			return 0, 0, 0, false
+		}
+		total = n
+	}
+	return first, last, total, true
+}
+
+// chunkedRange reports whether a requested range should be fetched from S3
+// in RangeChunkSize pieces.  Open ended ranges always qualify as their
+// length isn't known until S3 answers.
+func chunkedRange(byterange string) (first, last int64, ok bool) {
+	if conf.RangeChunkSize <= 0 || byterange == "" {
+		return 0, 0, false
+	}
+	first, last, ok = parseByteRange(byterange)
+	if !ok || (last >= 0 && last-first+1 <= conf.RangeChunkSize) {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// fetchRangeChunk requests one piece of an object, retrying failures by
+// class up to limits the same way forwardToS3 does.  When etag is set the
+// piece must come from that version of the object.
+func fetchRangeChunk(upath string, query url.Values, first, last int64, etag string,
+	limits RetryConfig, nretries map[string]int, logger zerolog.Logger) (*http.Response, error) {
+	for {
+		req, err := newS3Request("GET", upath, query)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+
+		resp, err := doS3(req)
+		class := retryClass(resp, err)
+		if class == "" || nretries[class] >= limits.max(class) {
+			return resp, err
+		}
+
+		nretries[class]++
+		if err == nil {
+			err = fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+			resp.Body.Close()
+		}
+		logger.Error().
+			Str("error", err.Error()).
+			Str("class", class).
+			Int("attempt", nretries[class]).
+			Int64("chunk-start", first).
+			Msg(fmt.Sprintf("Upstream %s: retry #%d", class, nretries[class]))
+	}
+}
+
+// serveChunkedRange answers a large range request by fetching it from S3
+// in RangeChunkSize pieces, each retried on its own, and streaming them
+// out back to back as a single 206 response.  A piece that fails part way
+// through is requested again from where it broke off.
+func serveChunkedRange(w http.ResponseWriter, upath string, query url.Values,
+	first, last int64, limits RetryConfig, logger zerolog.Logger) {
+	chunk := conf.RangeChunkSize
+	nretries := map[string]int{}
+
+	end := first + chunk - 1
+	if last >= 0 && end > last {
+		end = last
+	}
+	resp, err := fetchRangeChunk(upath, query, first, end, "", limits, nretries, logger)
+	if err == errNoCredentials {
+		credentialsUnavailable(w)
+		logger.Warn().Msg("No valid credentials, asked client to retry")
+		return
+	}
+	if err != nil {
+		logger.Error().
+			Str("error", err.Error()).
+			Msg("Failed to fetch first range chunk")
+		w.WriteHeader(500)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, hflag := range headerForward {
+		if hflag {
+			if v := resp.Header.Get(name); v != "" {
+				w.Header().Set(name, v)
+			}
+		}
+	}
+	setCacheStatus(w, cacheMiss)
+
+	// anything but a partial response, e.g. a 404 or 416, goes back to
+	// the client as is, and so does a range S3 can't tell the total of
+	_, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || total < 0 {
+		w.WriteHeader(resp.StatusCode)
+		copyBody(w, resp.Body)
+		logger.Info().
+			Int("statuscode", resp.StatusCode).
+			Msg("Range not split, forwarded first chunk response")
+		return
+	}
+
+	if last < 0 || last >= total {
+		last = total - 1
+	}
+	if end > last {
+		end = last
+	}
+	etag := resp.Header.Get("ETag")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, total))
+	w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	logger.Info().
+		Int64("content-length", last-first+1).
+		Int64("chunk-size", chunk).
+		Msg(fmt.Sprintf("Begin chunked transfer of #%d bytes", last-first+1))
+
+	pos := first
+	for pos <= last {
+		if resp == nil {
+			end = pos + chunk - 1
+			if end > last {
+				end = last
+			}
+			resp, err = fetchRangeChunk(upath, query, pos, end, etag, limits, nretries, logger)
+			if err == nil && resp.StatusCode != http.StatusPartialContent {
+				resp.Body.Close()
+				err = fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+			}
+			if err != nil {
+				metricUpstreamReadErrors.Add(1)
+				logger.Error().
+					Str("error", err.Error()).
+					Int64("content-length", last-first+1).
+					Int64("recv", pos-first).
+					Msg("Failed to fetch range chunk from S3")
+				abortConnection(w)
+				return
+			}
+		}
+
+		src := &trackingReader{Reader: io.LimitReader(resp.Body, end-pos+1)}
+		n, err := copyBody(w, src)
+		resp.Body.Close()
+		resp = nil
+		pos += n
+		if err != nil && src.err == nil {
+			metricClientDisconnects.Add(1)
+			logger.Info().
+				Str("error", err.Error()).
+				Int64("content-length", last-first+1).
+				Int64("recv", pos-first).
+				Msg("Client disconnected during body copy")
+			abortConnection(w)
+			return
+		}
+
+		// every piece gets its own retries, a short or broken one is
+		// picked up again from where it stopped while they last
+		if pos > end {
+			nretries = map[string]int{}
+		} else {
+			if nretries[retryClassConnection] >= limits.max(retryClassConnection) {
+				metricUpstreamReadErrors.Add(1)
+				logger.Error().
+					Int64("content-length", last-first+1).
+					Int64("recv", pos-first).
+					Msg("Failed to read range chunk from S3")
+				abortConnection(w)
+				return
+			}
+			nretries[retryClassConnection]++
+			logger.Error().
+				Int64("chunk-start", pos).
+				Int("attempt", nretries[retryClassConnection]).
+				Msg(fmt.Sprintf("Range chunk cut short: retry #%d", nretries[retryClassConnection]))
+		}
+	}
+
+	logger.Info().
+		Int64("content-length", last-first+1).
+		Int64("recv", pos-first).
+		Msg("Success copying body")
+}
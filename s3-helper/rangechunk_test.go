@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunkedObject serves a 100 byte object, with handler given a chance to
+// answer each range request itself first
+func chunkedObject(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, object []byte) bool) []byte {
+	object := make([]byte, 100)
+	rand.New(rand.NewSource(1)).Read(object)
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil && handler(w, r, object) {
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	}))
+	conf.RangeChunkSize = 16
+	return object
+}
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		in          string
+		first, last int64
+		ok          bool
+	}{
+		{"bytes=0-99", 0, 99, true},
+		{"bytes=10-", 10, -1, true},
+		{"bytes=-10", 0, 0, false},
+		{"bytes=5-4", 0, 0, false},
+		{"bytes=0-1,5-6", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+	for _, tt := range tests {
+		first, last, ok := parseByteRange(tt.in)
+		if first != tt.first || last != tt.last || ok != tt.ok {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v", tt.in, first, last, ok)
+		}
+	}
+}
+
+func TestMalformedRangeRejected(t *testing.T) {
+	var ranges []string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+
+	for _, rng := range []string{"items=0-9", "bytes=9-0", "bytes=a-b", "bytes=", "bytes=5", "bytes=1--2", "0-9"} {
+		if w := serve("GET", "/show/ep1.ts", http.Header{"Range": {rng}}); w.Code != http.StatusBadRequest {
+			t.Errorf("Range %q got %d, want a 400", rng, w.Code)
+		}
+	}
+	if len(ranges) != 0 {
+		t.Errorf("S3 asked for %q", ranges)
+	}
+
+	// valid ones go through untouched, even past the end of the object
+	for _, rng := range []string{"bytes=0-1", "Bytes=2-", "bytes=-3", "bytes=0-0, 4-5", "bytes=20-30"} {
+		serve("GET", "/show/ep1.ts", http.Header{"Range": {rng}})
+	}
+	if strings.Join(ranges, "|") != "bytes=0-1|Bytes=2-|bytes=-3|bytes=0-0, 4-5|bytes=20-30" {
+		t.Errorf("S3 asked for %q", ranges)
+	}
+}
+
+func TestChunkedRange(t *testing.T) {
+	var requests atomic.Int32
+	object := chunkedObject(t, func(w http.ResponseWriter, r *http.Request, object []byte) bool {
+		requests.Add(1)
+		return false
+	})
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=10-89"}})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), object[10:90]) {
+		t.Errorf("got %d with %d bytes, want a 206 of bytes 10-89", w.Code, w.Body.Len())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 10-89/100" {
+		t.Errorf("Content-Range %q", cr)
+	}
+	if n := requests.Load(); n != 5 {
+		t.Errorf("fetched in %d chunks, want 5", n)
+	}
+
+	// an open ended range runs to the end of the object
+	w = serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=40-"}})
+	if !bytes.Equal(w.Body.Bytes(), object[40:]) || w.Header().Get("Content-Length") != "60" {
+		t.Errorf("got %d bytes with length %s, want bytes 40-99", w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+}
+
+func TestChunkCutShort(t *testing.T) {
+	var cut atomic.Bool
+	object := chunkedObject(t, func(w http.ResponseWriter, r *http.Request, object []byte) bool {
+		// the chunk from byte 32 breaks off half way the first time
+		if r.Header.Get("Range") != "bytes=32-47" || cut.Swap(true) {
+			return false
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Range", "bytes 32-47/100")
+		w.Header().Set("Content-Length", "16")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(object[32:40])
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return true
+	})
+
+	w := serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-99"}})
+	if !cut.Load() {
+		t.Fatal("chunk never cut short")
+	}
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), object) {
+		t.Errorf("got %d with %d bytes, want the object byte for byte", w.Code, w.Body.Len())
+	}
+}
+
+func TestChunkETagChanged(t *testing.T) {
+	chunkedObject(t, func(w http.ResponseWriter, r *http.Request, object []byte) bool {
+		// the object is replaced after the first chunk went out
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			return false
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(bytes.ToUpper(object)))
+		return true
+	})
+	front := frontend(t)
+
+	req, _ := http.NewRequest("GET", front.URL+"/show/ep1.ts", nil)
+	req.Header.Set("Range", "bytes=0-99")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("read %d bytes of a mixed up object without an error", len(body))
+	}
+	if len(body) > 16 {
+		t.Errorf("got %d bytes, want no more than the first chunk", len(body))
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EC2 instance metadata service
+var imdsEndpoint = "http://169.254.169.254"
+
+// resolveRegion finds the region to use when none is configured, trying
+// the same sources as the AWS SDKs in order: the environment, the shared
+// config file and the instance metadata service.  It returns the region
+// and where it came from.
+func resolveRegion() (string, string, error) {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region, name, nil
+		}
+	}
+
+	if region, file := sharedConfigRegion(); region != "" {
+		return region, file, nil
+	}
+
+	region, err := imdsRegion()
+	if err != nil {
+		return "", "", fmt.Errorf("no region configured and instance metadata lookup failed: %v", err)
+	}
+	return region, "instance metadata", nil
+}
+
+// sharedConfigRegion reads the region of the active profile from the
+// shared AWS config file
+func sharedConfigRegion() (string, string) {
+	file := os.Getenv("AWS_CONFIG_FILE")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", ""
+		}
+		file = filepath.Join(home, ".aws", "config")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	section := "profile " + profile
+	if profile == "default" {
+		section = "default"
+	}
+
+	var current string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if current != section {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "region" {
+			return strings.TrimSpace(kv[1]), file
+		}
+	}
+	return "", ""
+}
+
+// imdsRegion asks the instance metadata service for the region, using an
+// IMDSv2 session token when one can be had
+func imdsRegion() (string, error) {
+	// metadata requests must never go through a proxy
+	client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{}}
+
+	req, err := http.NewRequest("GET", imdsEndpoint+"/latest/meta-data/placement/region", nil)
+	if err != nil {
+		return "", err
+	}
+	if token, err := imdsToken(client); err == nil {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func imdsToken(client *http.Client) (string, error) {
+	req, err := http.NewRequest("PUT", imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return string(b), err
+}
+
+// discoverBucketRegion asks S3 which region bucket lives in, using a
+// HeadBucket request.  S3 reports the region in x-amz-bucket-region even
+// when it answers with a redirect or an error for the wrong region.
+func discoverBucketRegion(bucket string) (string, error) {
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("%s://s3.%s.amazonaws.com/%s", s3Scheme(), conf.S3Region, bucket), nil)
+	if err != nil {
+		return "", err
+	}
+	if req, err = signRequest(req); err != nil {
+		return "", err
+	}
+
+	// we want the redirect itself, not wherever it points to
+	client := *s3Client.Load()
+	client.Timeout = 10 * time.Second
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	region := resp.Header.Get("X-Amz-Bucket-Region")
+	if region == "" {
+		return "", fmt.Errorf("no bucket region in response, Response Status Code: %d", resp.StatusCode)
+	}
+	return region, nil
+}
+
+// checkBucketRegion compares the configured region with the bucket's
+// actual one, switching to the latter when AutoDetectRegion is set.  The
+// buckets of routes are signed for the same region, so those in another
+// one are reported too.
+func checkBucketRegion() {
+	// S3-compatible stores don't necessarily know about regions
+	if conf.S3Endpoint != "" {
+		return
+	}
+	region, err := discoverBucketRegion(conf.S3Bucket)
+	switch {
+	case err != nil:
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("Could not discover the bucket region")
+	case region == conf.S3Region:
+	case conf.AutoDetectRegion:
+		log.Warn().Msg(fmt.Sprintf("Bucket %s is in region %s, not %s, using %s",
+			conf.S3Bucket, region, conf.S3Region, region))
+		conf.S3Region = region
+	default:
+		log.Error().Msg(fmt.Sprintf("Bucket %s is in region %s but S3_REGION is %s, requests will fail",
+			conf.S3Bucket, region, conf.S3Region))
+	}
+
+	for _, bucket := range routeBuckets() {
+		region, err := discoverBucketRegion(bucket)
+		if err != nil {
+			log.Warn().
+				Str("bucket", bucket).
+				Str("error", err.Error()).
+				Msg("Could not discover the region of a route bucket")
+			continue
+		}
+		if region != conf.S3Region {
+			log.Error().Msg(fmt.Sprintf("Route bucket %s is in region %s but requests are signed for %s, they will fail",
+				bucket, region, conf.S3Region))
+		}
+	}
+}
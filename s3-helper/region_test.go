@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// bucketElsewhere answers HeadBucket for a bucket in eu-west-1 the way S3
+// does when asked in another region
+func bucketElsewhere(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.Path != "/bucket" {
+			t.Errorf("got %s %s, want a HeadBucket", r.Method, r.URL.Path)
+		}
+		w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+		w.Header().Set("Location", "http://s3.eu-west-1.amazonaws.com/bucket")
+		w.WriteHeader(http.StatusMovedPermanently)
+	}))
+}
+
+func TestDiscoverBucketRegion(t *testing.T) {
+	bucketElsewhere(t)
+	region, err := discoverBucketRegion(conf.S3Bucket)
+	if err != nil || region != "eu-west-1" {
+		t.Errorf("got %q, %v, want eu-west-1", region, err)
+	}
+}
+
+func TestCheckBucketRegion(t *testing.T) {
+	bucketElsewhere(t)
+	checkBucketRegion()
+	if conf.S3Region != "us-east-1" {
+		t.Errorf("region switched to %s without AutoDetectRegion", conf.S3Region)
+	}
+
+	conf.AutoDetectRegion = true
+	checkBucketRegion()
+	if conf.S3Region != "eu-west-1" {
+		t.Errorf("region %s, want the bucket's eu-west-1", conf.S3Region)
+	}
+}
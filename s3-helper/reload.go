@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// reloadable reports whether SIGHUP has anything to reload, otherwise it
+// stops the helper like SIGINT and SIGTERM do
+func reloadable() bool {
+	return conf.BucketRoutesFile != "" || conf.S3ClientCertFile != "" || conf.S3CACertFile != ""
+}
+
+// reload rereads what SIGHUP covers: the bucket routes and the S3 client
+// with its certificates.  Whatever fails to load is kept as it was.
+func reload() {
+	if conf.BucketRoutesFile != "" {
+		if err := reloadBucketRoutes(); err != nil {
+			log.Error().
+				Str("error", err.Error()).
+				Msg("Failed to reload bucket routes, keeping the current ones")
+		}
+	}
+	if err := reloadS3Client(); err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg("Failed to rebuild the S3 client, keeping the current one")
+	}
+}
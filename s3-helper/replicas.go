@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// regionReplica is a copy of the bucket in another region, to which a
+// share of reads set by its weight goes
+type regionReplica struct {
+	Region string
+	Bucket string
+	Weight int
+}
+
+// host is the path-style S3 host of the replica's region
+func (rep regionReplica) host() string {
+	return "s3." + rep.Region + ".amazonaws.com"
+}
+
+// prefix is the start of the URLs of objects in the replica
+func (rep regionReplica) prefix() string {
+	return s3Scheme() + "://" + rep.host() + "/" + rep.Bucket
+}
+
+// replicaPool spreads GETs and HEADs of the bucket over its replicas by
+// weight.  Unlike endpointPool a key doesn't stick to a replica, the
+// point being to share out egress and not caches.
+type replicaPool struct {
+	mu       sync.Mutex
+	replicas []regionReplica
+	// replicas that failed are passed over until then
+	downUntil map[string]time.Time
+}
+
+// The pool of RegionWeights, nil without any
+var replicas *replicaPool
+
+// parseRegionWeights parses a comma separated list of region=weight pairs.
+// A replica bucket named differently from S3Bucket is given as
+// region:bucket=weight.
+func parseRegionWeights(s string) ([]regionReplica, error) {
+	var reps []regionReplica
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not region=weight", item)
+		}
+		rep := regionReplica{Region: strings.TrimSpace(kv[0]), Bucket: conf.S3Bucket}
+		if rb := strings.SplitN(rep.Region, ":", 2); len(rb) == 2 {
+			rep.Region, rep.Bucket = strings.TrimSpace(rb[0]), strings.TrimSpace(rb[1])
+		}
+		if rep.Region == "" || rep.Bucket == "" || strings.ContainsAny(rep.Region, "/. ") {
+			return nil, fmt.Errorf("invalid replica %q", kv[0])
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid weight %q for %s", kv[1], rep.Region)
+		}
+		if seen[rep.Region] {
+			return nil, fmt.Errorf("region %s is given twice", rep.Region)
+		}
+		seen[rep.Region] = true
+		rep.Weight = w
+		reps = append(reps, rep)
+	}
+	return reps, nil
+}
+
+func newReplicaPool(reps []regionReplica) *replicaPool {
+	return &replicaPool{replicas: reps, downUntil: make(map[string]time.Time)}
+}
+
+// up returns the replicas not passed over, or all of them when none are
+// left
+func (p *replicaPool) up() []regionReplica {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up []regionReplica
+	for _, rep := range p.replicas {
+		if !now.Before(p.downUntil[rep.Region]) {
+			up = append(up, rep)
+		}
+	}
+	if len(up) == 0 {
+		return p.replicas
+	}
+	return up
+}
+
+// pick draws a replica from those that are up, each as likely as its
+// share of their weights
+func (p *replicaPool) pick() regionReplica {
+	up := p.up()
+	total := 0
+	for _, rep := range up {
+		total += rep.Weight
+	}
+	n := rand.Intn(total)
+	for _, rep := range up {
+		if n < rep.Weight {
+			return rep
+		}
+		n -= rep.Weight
+	}
+	return up[len(up)-1]
+}
+
+// replicaOf returns the replica u is addressed to, with the rest of the
+// URL after the bucket
+func (p *replicaPool) replicaOf(u string) (regionReplica, string, bool) {
+	for _, rep := range p.replicas {
+		if prefix := rep.prefix(); strings.HasPrefix(u, prefix+"/") {
+			return rep, u[len(prefix):], true
+		}
+	}
+	return regionReplica{}, "", false
+}
+
+// route points the URL of an object in the home bucket at a replica drawn
+// by weight.  Other URLs, e.g. those of bucket routes, are left alone.
+func (p *replicaPool) route(u string) string {
+	home := s3Scheme() + "://s3." + conf.S3Region + ".amazonaws.com/" + conf.S3Bucket + "/"
+	if !strings.HasPrefix(u, home) {
+		return u
+	}
+	return p.pick().prefix() + u[len(home)-1:]
+}
+
+// regionFor returns the region to sign req for, that of the replica it is
+// addressed to or S3Region
+func regionFor(req *http.Request) string {
+	if replicas != nil {
+		if rep, _, ok := replicas.replicaOf(req.URL.String()); ok {
+			return rep.Region
+		}
+	}
+	return conf.S3Region
+}
+
+// markDown passes over a replica for EndpointDownFor
+func (p *replicaPool) markDown(region string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().After(p.downUntil[region]) {
+		log.Warn().Msg(fmt.Sprintf("S3 region %s is failing, passing over it for %v", region, conf.EndpointDownFor))
+	}
+	p.downUntil[region] = time.Now().Add(conf.EndpointDownFor)
+}
+
+// markUp clears a replica that answered again
+func (p *replicaPool) markUp(region string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.downUntil[region]; ok {
+		delete(p.downUntil, region)
+		log.Info().Msg(fmt.Sprintf("S3 region %s is back up", region))
+	}
+}
+
+// doReplicated sends req to the replica it is addressed to, failing over
+// to the others by weight, heaviest first, until one answers without
+// failing.  The last failure is returned when they all do.
+func (p *replicaPool) doReplicated(req *http.Request) (*http.Response, error) {
+	first, rest, ok := p.replicaOf(req.URL.String())
+	if !ok {
+		return sendS3(req)
+	}
+	order := []regionReplica{first}
+	others := append([]regionReplica(nil), p.up()...)
+	sort.SliceStable(others, func(i, j int) bool { return others[i].Weight > others[j].Weight })
+	for _, rep := range others {
+		if rep.Region != first.Region {
+			order = append(order, rep)
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for i, rep := range order {
+		r := req
+		if i > 0 {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if r, err = retargetReplica(req, rep, rest); err != nil {
+				return nil, err
+			}
+			metricRegionFailovers.Add(rep.Region, 1)
+		}
+		metricRegionRequests.Add(rep.Region, 1)
+		log.Debug().
+			Str("region", rep.Region).
+			Str("bucket", rep.Bucket).
+			Str("method", req.Method).
+			Msg("Sending to S3 region")
+		resp, err = sendS3(r)
+		if !endpointFailed(resp, err) {
+			p.markUp(rep.Region)
+			return resp, nil
+		}
+		p.markDown(rep.Region)
+	}
+	return resp, err
+}
+
+// retargetReplica copies req for another replica, signed afresh for its
+// region and host
+func retargetReplica(req *http.Request, rep regionReplica, rest string) (*http.Request, error) {
+	u, err := url.Parse(rep.prefix() + rest)
+	if err != nil {
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	readdress(r, u)
+	clearSignature(r)
+	return signRequestFor(r, rep.Region)
+}
+
+// initReplicas sets up the replica pool when RegionWeights is set.
+// Replicas are reached path style on AWS, so custom endpoints, transfer
+// acceleration and virtual-hosted addressing don't go with it.
+func initReplicas() {
+	if len(conf.RegionWeights) == 0 {
+		return
+	}
+	if conf.S3Endpoint != "" || conf.S3Accelerate || conf.S3VirtualHosted {
+		exitConfig("S3_REGION_WEIGHTS", fmt.Errorf("replicas need path-style AWS addressing"))
+	}
+	replicas = newReplicaPool(conf.RegionWeights)
+	log.Info().Msg(fmt.Sprintf("Spreading reads over %d S3 regions", len(conf.RegionWeights)))
+}
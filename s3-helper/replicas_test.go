@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRetargetReplicaSignsForRegionAndHost(t *testing.T) {
+	s := &hostSigner{}
+	useSigner(t, s)
+
+	rep := regionReplica{Region: "eu-west-1", Bucket: "media-eu", Weight: 1}
+	req, _ := http.NewRequest("GET", "http://s3.us-east-1.amazonaws.com/media/show/ep1.ts", nil)
+	r, err := retargetReplica(req, rep, "/show/ep1.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.URL.Path != "/media-eu/show/ep1.ts" {
+		t.Errorf("path = %q", r.URL.Path)
+	}
+	if len(s.signed) != 1 || s.signed[0] != rep.host() {
+		t.Errorf("signed for %q, want %q", s.signed, rep.host())
+	}
+	if got := r.Header.Get("Authorization"); got != "signed for "+rep.host()+" in eu-west-1" {
+		t.Errorf("Authorization = %q", got)
+	}
+}
+
+func TestParseRegionWeights(t *testing.T) {
+	defer func(b string) { conf.S3Bucket = b }(conf.S3Bucket)
+	conf.S3Bucket = "media"
+
+	reps, err := parseRegionWeights("us-east-1=3, eu-west-1:media-eu=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []regionReplica{{"us-east-1", "media", 3}, {"eu-west-1", "media-eu", 1}}
+	if len(reps) != len(want) {
+		t.Fatalf("got %v, want %v", reps, want)
+	}
+	for i := range want {
+		if reps[i] != want[i] {
+			t.Errorf("replica %d = %v, want %v", i, reps[i], want[i])
+		}
+	}
+	for _, bad := range []string{"us-east-1", "us-east-1=0", "us-east-1=1,us-east-1=2", "a.b=1"} {
+		if _, err := parseRegionWeights(bad); err == nil {
+			t.Errorf("parseRegionWeights(%q) succeeded", bad)
+		}
+	}
+}
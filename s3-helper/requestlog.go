@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Query parameters of presigned URLs that must not end up in logs
+var redactedQueryParams = []string{"X-Amz-Signature", "X-Amz-Security-Token"}
+
+// redactURL formats u for logging with any signature or session token in
+// its query replaced
+func redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	q := u.Query()
+	redacted := false
+	for _, name := range redactedQueryParams {
+		if q.Has(name) {
+			q.Set(name, "xxxxx")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// logRequestStarted logs the one event for a request about to go to S3,
+// with the query and URL it goes with
+func logRequestStarted(logger zerolog.Logger, u *url.URL) {
+	if e := logger.Info(); e.Enabled() {
+		e.Str("query", u.RawQuery).
+			Str("url", redactURL(u)).
+			Msg("Request started")
+	}
+}
+
+// logRequestCompleted logs the one event for a finished request, however
+// it was answered
+func logRequestCompleted(logger zerolog.Logger, sw *statusWriter, start time.Time) {
+	logger.Info().
+		Int("statuscode", sw.status).
+		Int64("bytes", sw.bytes).
+		Dur("duration", time.Since(start)).
+		Msg("Request completed")
+}
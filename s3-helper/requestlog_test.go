@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestLoggedOnce(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	}))
+	logs := captureLog(t)
+
+	serve("GET", "/show/ep1.ts", nil)
+	if n := strings.Count(logs.String(), `"message":"Request started"`); n != 1 {
+		t.Errorf("logged %d starts", n)
+	}
+	if n := strings.Count(logs.String(), `"message":"Request completed"`); n != 1 {
+		t.Errorf("logged %d completions", n)
+	}
+	fields := logged(logs, "Request completed")
+	if fields["statuscode"] != 200.0 || fields["bytes"] != 7.0 || fields["object"] != "/show/ep1.ts" {
+		t.Errorf("completion logged as %v", fields)
+	}
+	if fields := logged(logs, "Request started"); !strings.HasSuffix(fields["url"].(string), "/bucket/show/ep1.ts") {
+		t.Errorf("start logged as %v", fields)
+	}
+
+	u, _ := url.Parse("https://s3/bucket/k?X-Amz-Signature=secret&X-Amz-Security-Token=token&partNumber=1")
+	if s := redactURL(u); strings.Contains(s, "secret") || strings.Contains(s, "=token") ||
+		!strings.Contains(s, "partNumber=1") {
+		t.Errorf("logged URL %s", s)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// statusWriter records the status code and body size written to a client,
+// cutting the headers down to minimalHeaders first when minimal is set
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	bytes   int64
+	minimal bool
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 && code >= 200 {
+		sw.status = code
+		if sw.minimal {
+			stripToMinimal(sw.Header(), code)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// abortConnection resets the client connection after a body was cut short
+// mid-stream, so that downstream sees an error rather than a clean end to
+// what looks like a complete response.  Without a connection to hijack,
+// e.g. over HTTP/2, the server is left to abort the stream.
+func abortConnection(w http.ResponseWriter) {
+	for {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				if tc, ok := conn.(*net.TCPConn); ok {
+					// close with a RST instead of a FIN
+					tc.SetLinger(0)
+				}
+				conn.Close()
+				return
+			}
+			break
+		}
+		uw, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = uw.Unwrap()
+	}
+	panic(http.ErrAbortHandler)
+}
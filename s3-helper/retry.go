@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Classes of upstream failure that can be retried independently
+const (
+	retryClassTimeout    = "timeout"
+	retryClassServer     = "5xx"
+	retryClassConnection = "connection"
+)
+
+// RetryConfig holds the maximum number of retries for each class of
+// upstream failure.
+type RetryConfig struct {
+	Timeout    int `yaml:"timeout"`
+	Server     int `yaml:"5xx"`
+	Connection int `yaml:"connection"`
+}
+
+// max returns the retry limit configured for the given class
+func (rc RetryConfig) max(class string) int {
+	switch class {
+	case retryClassTimeout:
+		return rc.Timeout
+	case retryClassServer:
+		return rc.Server
+	case retryClassConnection:
+		return rc.Connection
+	}
+	return 0
+}
+
+// String formats the limits the way parseRetryConfig takes them
+func (rc RetryConfig) String() string {
+	return fmt.Sprintf("%s=%d,%s=%d,%s=%d", retryClassTimeout, rc.Timeout,
+		retryClassServer, rc.Server, retryClassConnection, rc.Connection)
+}
+
+// parseRetryConfig parses either a plain integer, which applies to every
+// class, or a comma separated list of class=count pairs, e.g.
+// "timeout=5,5xx=8,connection=1".  Classes left out are not retried.
+func parseRetryConfig(s string) (RetryConfig, error) {
+	var rc RetryConfig
+	s = strings.TrimSpace(s)
+
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return rc, fmt.Errorf("invalid retry count %d", n)
+		}
+		return RetryConfig{Timeout: n, Server: n, Connection: n}, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return rc, fmt.Errorf("invalid retry setting %q", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n < 0 {
+			return rc, fmt.Errorf("invalid retry count %q", kv[1])
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case retryClassTimeout:
+			rc.Timeout = n
+		case retryClassServer:
+			rc.Server = n
+		case retryClassConnection, "conn":
+			rc.Connection = n
+		default:
+			return rc, fmt.Errorf("unknown retry class %q", kv[0])
+		}
+	}
+	return rc, nil
+}
+
+// retryClass classifies the outcome of an upstream request.  An empty
+// string means the outcome is final and should not be retried.
+func retryClass(resp *http.Response, err error) string {
+	if err == errS3Busy {
+		return ""
+	}
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return retryClassTimeout
+		}
+		return retryClassConnection
+	}
+	if resp.StatusCode >= 500 && resp.StatusCode <= 599 {
+		return retryClassServer
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryConfig(t *testing.T) {
+	tests := []struct {
+		in   string
+		want RetryConfig
+	}{
+		{"3", RetryConfig{Timeout: 3, Server: 3, Connection: 3}},
+		{"timeout=5,5xx=8,connection=1", RetryConfig{Timeout: 5, Server: 8, Connection: 1}},
+		{" 5xx=2 , conn=4", RetryConfig{Server: 2, Connection: 4}},
+	}
+	for _, tt := range tests {
+		got, err := parseRetryConfig(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseRetryConfig(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"-1", "5xx", "5xx=-1", "dns=2"} {
+		if _, err := parseRetryConfig(in); err == nil {
+			t.Errorf("parseRetryConfig(%q) didn't fail", in)
+		}
+	}
+}
+
+func TestServerErrorsRetried(t *testing.T) {
+	var attempts atomic.Int32
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	conf.S3Retries = RetryConfig{Server: 3}
+
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want S3's 503 passed on", w.Code)
+	}
+	if n := attempts.Load(); n != 4 {
+		t.Errorf("S3 asked %d times, want once and 3 retries", n)
+	}
+}
+
+func TestServerErrorRecovers(t *testing.T) {
+	var attempts atomic.Int32
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("segment"))
+	}))
+	conf.S3Retries = RetryConfig{Server: 1}
+
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "segment" {
+		t.Errorf("got %d %q, want the retry's 200", w.Code, w.Body.String())
+	}
+}
+
+func TestConnectionErrorsRetried(t *testing.T) {
+	var attempts atomic.Int32
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	conf.S3Retries = RetryConfig{Server: 5, Connection: 1}
+
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want a 500", w.Code)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("S3 asked %d times, want once and 1 retry", n)
+	}
+}
+
+func TestTimeoutsRetried(t *testing.T) {
+	var attempts atomic.Int32
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	conf.S3Retries = RetryConfig{Timeout: 2, Connection: 5}
+	conf.MaxConnsPerHost = 1
+	conf.S3Timeout = 50 * time.Millisecond
+
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want a 500", w.Code)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("S3 asked %d times, want once and 2 retries", n)
+	}
+}
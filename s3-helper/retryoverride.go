@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Header trusted clients can set to override S3Retries for a request, in
+// the same format, e.g. "0" for a live edge or "timeout=2,5xx=1"
+const maxRetriesHeader = "X-S3-Max-Retries"
+
+// Clients allowed to use maxRetriesHeader
+var retryOverrideAllow []*net.IPNet
+
+// initRetryOverride sets up the clients allowed to override retries
+func initRetryOverride() {
+	if conf.RetryOverrideCIDRs == "" {
+		return
+	}
+	nets, err := parseCIDRs(conf.RetryOverrideCIDRs)
+	if err != nil {
+		exitConfig("S3_RETRY_OVERRIDE_CIDRS", err)
+	}
+	retryOverrideAllow = nets
+}
+
+// requestRetries returns the retry limits for r, the ones it asked for
+// with maxRetriesHeader clamped to RetryOverrideMax when it comes from an
+// allowlisted client, S3Retries otherwise.  It reports whether they were
+// overridden.
+func requestRetries(r *http.Request) (RetryConfig, bool) {
+	v := r.Header.Get(maxRetriesHeader)
+	if v == "" || !ipAllowed(retryOverrideAllow, clientIP(r)) {
+		return conf.S3Retries, false
+	}
+	rc, err := parseRetryConfig(v)
+	if err != nil {
+		log.Warn().
+			Str("object", r.URL.Path).
+			Str("error", err.Error()).
+			Msg("Ignored invalid " + maxRetriesHeader)
+		return conf.S3Retries, false
+	}
+	clamp := func(n int) int {
+		if n > conf.RetryOverrideMax {
+			return conf.RetryOverrideMax
+		}
+		return n
+	}
+	return RetryConfig{
+		Timeout:    clamp(rc.Timeout),
+		Server:     clamp(rc.Server),
+		Connection: clamp(rc.Connection),
+	}, true
+}
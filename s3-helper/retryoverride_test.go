@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRetryOverride(t *testing.T) {
+	var fetches int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	prev := retryOverrideAllow
+	t.Cleanup(func() { retryOverrideAllow = prev })
+	// httptest requests come from 192.0.2.1
+	retryOverrideAllow, _ = parseCIDRs("192.0.2.0/24")
+	conf.RetryOverrideMax = 3
+	logs := captureLog(t)
+
+	for _, tc := range []struct {
+		header string
+		want   int
+	}{
+		{"", 3},
+		{"0", 1},
+		{"5xx=1", 2},
+		{"50", 4},
+		{"bogus", 3},
+	} {
+		fetches = 0
+		serve("GET", "/show/ep1.ts", http.Header{maxRetriesHeader: {tc.header}})
+		if fetches != tc.want {
+			t.Errorf("%s %q: S3 asked %d times, want %d", maxRetriesHeader, tc.header, fetches, tc.want)
+		}
+	}
+	logs.Reset()
+	serve("GET", "/show/ep1.ts", http.Header{maxRetriesHeader: {"0"}})
+	if fields := logged(logs, "Request started"); fields["max-retries"] != (RetryConfig{}).String() {
+		t.Errorf("override logged as %v", fields)
+	}
+
+	// other clients can't
+	retryOverrideAllow, _ = parseCIDRs("10.0.0.0/8")
+	fetches = 0
+	serve("GET", "/show/ep1.ts", http.Header{maxRetriesHeader: {"0"}})
+	if fetches != 3 {
+		t.Errorf("S3 asked %d times for an untrusted override, want the configured 3", fetches)
+	}
+}
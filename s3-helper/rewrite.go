@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// keyRewriteRule rewrites the object paths its regexp matches into new
+// keys, the replacement can refer to its groups as $1 or ${name}
+type keyRewriteRule struct {
+	Pattern     string
+	Replacement string
+	re          *regexp.Regexp
+}
+
+// parseKeyRewriteRules parses a semicolon separated list of
+// regexp=replacement pairs, kept in order as the first match wins.  Not
+// commas, those can be part of a regexp, e.g. "{1,3}".
+func parseKeyRewriteRules(s string) ([]keyRewriteRule, error) {
+	var rules []keyRewriteRule
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid rewrite rule %q, expected regexp=replacement", item)
+		}
+		re, err := regexp.Compile(kv[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern %q: %v", kv[0], err)
+		}
+		rules = append(rules, keyRewriteRule{Pattern: kv[0], Replacement: kv[1], re: re})
+	}
+	return rules, nil
+}
+
+// rewriteKey applies the first of KeyRewriteRules matching the decoded
+// object path.  The result is still a path, S3Path and bucket routes
+// apply to it as they would have to the original.
+func rewriteKey(upath string) string {
+	for _, rule := range conf.KeyRewriteRules {
+		if !rule.re.MatchString(upath) {
+			continue
+		}
+		key := rule.re.ReplaceAllString(upath, rule.Replacement)
+		if !strings.HasPrefix(key, "/") {
+			key = "/" + key
+		}
+		log.Debug().
+			Str("object", upath).
+			Str("key", key).
+			Str("rule", rule.Pattern).
+			Msg("Rewrote object key")
+		return key
+	}
+	return upath
+}
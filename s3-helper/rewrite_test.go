@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestKeyRewritten(t *testing.T) {
+	var got []string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.Path)
+	}))
+	rules, err := parseKeyRewriteRules(`^/v1/([^/]+)/(.*)$=/media/$1/v1/$2; ^/(?P<show>[a-z]+)\.m3u8$=${show}/index.m3u8; ^/v1/=/never`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.KeyRewriteRules = rules
+
+	for _, target := range []string{"/v1/show/ep1.ts", "/show.m3u8", "/other/ep1.ts"} {
+		serve("GET", target, nil)
+	}
+	want := []string{"/bucket/media/show/v1/ep1.ts", "/bucket/show/index.m3u8", "/bucket/other/ep1.ts"}
+	if len(got) != len(want) {
+		t.Fatalf("S3 got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("S3 got %q, want %q", got[i], want[i])
+		}
+	}
+
+	for _, s := range []string{"^/v1/", "=/x", "([a-z]=/x"} {
+		if _, err := parseKeyRewriteRules(s); err == nil {
+			t.Errorf("rules %q accepted", s)
+		}
+	}
+}
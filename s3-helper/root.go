@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Ways to answer a request for "/", set by RootResponse.  A redirect is
+// given as "redirect=<url>".
+const (
+	rootNotFound = "404"
+	rootInfo     = "info"
+	rootForward  = "forward"
+	rootRedirect = "redirect="
+)
+
+// Body of the "info" root response
+const rootInfoPage = serverName + "\n"
+
+// checkRootResponse validates a RootResponse setting
+func checkRootResponse(s string) error {
+	switch s {
+	case "", rootNotFound, rootInfo, rootForward:
+		return nil
+	}
+	if !strings.HasPrefix(s, rootRedirect) {
+		return fmt.Errorf("%q is not one of 404, info, forward or redirect=<url>", s)
+	}
+	u, err := url.Parse(strings.TrimPrefix(s, rootRedirect))
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" && !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("redirect target %q is neither absolute nor a path", u)
+	}
+	return nil
+}
+
+// serveRoot answers a request for "/" as configured instead of asking S3
+// for an empty key, which only ever returns a confusing error.  It returns
+// false when the request should be forwarded after all.
+func serveRoot(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case conf.RootResponse == rootForward:
+		return false
+	case conf.RootResponse == rootInfo:
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", fmt.Sprint(len(rootInfoPage)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != "HEAD" {
+			io.WriteString(w, rootInfoPage)
+		}
+	case strings.HasPrefix(conf.RootResponse, rootRedirect):
+		http.Redirect(w, r, strings.TrimPrefix(conf.RootResponse, rootRedirect), http.StatusFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return true
+}
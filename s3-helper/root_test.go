@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRootAnsweredLocally(t *testing.T) {
+	var fetches int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+	}))
+
+	for _, tc := range []struct {
+		setting string
+		status  int
+		body    string
+	}{
+		{"", http.StatusNotFound, ""},
+		{"404", http.StatusNotFound, ""},
+		{"info", http.StatusOK, rootInfoPage},
+		{"redirect=https://example.com/", http.StatusFound, ""},
+	} {
+		conf.RootResponse = tc.setting
+		w := serve("GET", "/", nil)
+		if w.Code != tc.status || (tc.body != "" && w.Body.String() != tc.body) {
+			t.Errorf("root_response %q: got %d %q", tc.setting, w.Code, w.Body.String())
+		}
+	}
+	if w := serve("GET", "/", nil); w.Header().Get("Location") != "https://example.com/" {
+		t.Errorf("redirected to %q", w.Header().Get("Location"))
+	}
+	if fetches != 0 {
+		t.Errorf("S3 asked %d times for /", fetches)
+	}
+
+	conf.RootResponse = "forward"
+	serve("GET", "/", nil)
+	if fetches != 1 {
+		t.Error("/ not forwarded")
+	}
+
+	if err := checkRootResponse("redirect=elsewhere"); err == nil {
+		t.Error("relative redirect target accepted")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// bucketRoute sends requests under a path prefix to a bucket of their own,
+// e.g. one per tenant.  The prefix is stripped from the key.
+type bucketRoute struct {
+	Prefix string
+	Bucket string
+}
+
+// routeTable holds bucket routes longest prefix first, so the most
+// specific one wins
+type routeTable []bucketRoute
+
+// The bucket routes in effect, swapped as a whole on reload so a lookup
+// always sees one consistent table
+var bucketRoutes atomic.Pointer[routeTable]
+
+// loadBucketRoutes reads a routes file with a "prefix bucket" pair per
+// line, blank lines and lines starting with "#" are skipped
+func loadBucketRoutes(file string) (routeTable, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var table routeTable
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("%s:%d: expected \"/prefix bucket\"", file, n)
+		}
+		r := bucketRoute{Prefix: fields[0], Bucket: fields[1]}
+		if seen[r.Prefix] {
+			return nil, fmt.Errorf("%s:%d: duplicate prefix %s", file, n, r.Prefix)
+		}
+		// route buckets are addressed like the configured one
+		if err := checkRouteBucket(r.Bucket); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		seen[r.Prefix] = true
+		table = append(table, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(table, func(i, j int) bool {
+		return len(table[i].Prefix) > len(table[j].Prefix)
+	})
+	return table, nil
+}
+
+// checkRouteBucket makes sure bucket can be addressed the way the
+// configured bucket is
+func checkRouteBucket(bucket string) error {
+	if conf.S3Accelerate {
+		return checkAccelerateBucket(bucket)
+	}
+	if conf.S3VirtualHosted {
+		return checkVirtualHostedBucket(bucket)
+	}
+	return nil
+}
+
+// routeBuckets lists the buckets of the routes in effect, each once
+func routeBuckets() []string {
+	table := bucketRoutes.Load()
+	if table == nil {
+		return nil
+	}
+	var buckets []string
+	seen := make(map[string]bool)
+	for _, r := range *table {
+		if !seen[r.Bucket] {
+			seen[r.Bucket] = true
+			buckets = append(buckets, r.Bucket)
+		}
+	}
+	return buckets
+}
+
+// routeBucket returns the bucket and key for upath when it falls under a
+// bucket route
+func routeBucket(upath string) (string, string, bool) {
+	table := bucketRoutes.Load()
+	if table == nil {
+		return "", "", false
+	}
+	for _, r := range *table {
+		if strings.HasPrefix(upath, r.Prefix) {
+			key := strings.TrimPrefix(upath, r.Prefix)
+			if !strings.HasPrefix(key, "/") {
+				key = "/" + key
+			}
+			return r.Bucket, key, true
+		}
+	}
+	return "", "", false
+}
+
+// diffRoutes lists the routes added and removed going from old to new, a
+// changed bucket counts as both
+func diffRoutes(old, new routeTable) (added, removed []string) {
+	was := make(map[string]string)
+	for _, r := range old {
+		was[r.Prefix] = r.Bucket
+	}
+	is := make(map[string]string)
+	for _, r := range new {
+		is[r.Prefix] = r.Bucket
+		if b, ok := was[r.Prefix]; !ok || b != r.Bucket {
+			added = append(added, r.Prefix+" "+r.Bucket)
+		}
+	}
+	for _, r := range old {
+		if b, ok := is[r.Prefix]; !ok || b != r.Bucket {
+			removed = append(removed, r.Prefix+" "+r.Bucket)
+		}
+	}
+	return added, removed
+}
+
+// reloadBucketRoutes rereads the routes file and swaps in the new table,
+// keeping the old one if the file is broken.  Requests already under way
+// finish with the routes they started with.
+func reloadBucketRoutes() error {
+	table, err := loadBucketRoutes(conf.BucketRoutesFile)
+	if err != nil {
+		return err
+	}
+	var old routeTable
+	if t := bucketRoutes.Load(); t != nil {
+		old = *t
+	}
+	bucketRoutes.Store(&table)
+
+	added, removed := diffRoutes(old, table)
+	log.Info().
+		Strs("added", added).
+		Strs("removed", removed).
+		Msg(fmt.Sprintf("Loaded %d bucket routes from %s", len(table), conf.BucketRoutesFile))
+	return nil
+}
+
+// initBucketRoutes loads the bucket routes when a routes file is set
+func initBucketRoutes() {
+	if conf.BucketRoutesFile == "" {
+		return
+	}
+	if err := reloadBucketRoutes(); err != nil {
+		exitConfig("S3_BUCKET_ROUTES_FILE", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRouteBucketsCheckedLikeConfigured(t *testing.T) {
+	prevConf := conf
+	t.Cleanup(func() { conf = prevConf })
+	file := filepath.Join(t.TempDir(), "routes")
+	if err := os.WriteFile(file, []byte("/a tenant-a\n/b tenant.b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.S3UseTLS = true
+	conf.S3VirtualHosted = true
+	if _, err := loadBucketRoutes(file); err == nil || !strings.Contains(err.Error(), "tenant.b") {
+		t.Errorf("got %v, want the dotted bucket refused for virtual-hosted addressing", err)
+	}
+
+	conf.S3VirtualHosted, conf.S3Accelerate = false, true
+	if _, err := loadBucketRoutes(file); err == nil || !strings.Contains(err.Error(), "tenant.b") {
+		t.Errorf("got %v, want the dotted bucket refused for transfer acceleration", err)
+	}
+
+	conf.S3Accelerate = false
+	if _, err := loadBucketRoutes(file); err != nil {
+		t.Errorf("path-style routes refused: %v", err)
+	}
+}
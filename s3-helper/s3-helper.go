@@ -2,23 +2,25 @@
 package main
 
 import (
+	"bytes"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
-	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"runtime"
-	// "strings"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/crunchyroll/go-aws-auth"
-
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -30,14 +32,358 @@ const configFileDefault = "/etc/s3-helper.yml"
 type Config struct {
 	Listen string `yaml:"listen"`
 
+	// Requests with more header bytes than MaxHeaderBytes, or a longer
+	// Range header than MaxRangeHeaderBytes, are refused with a 431
+	MaxHeaderBytes      int `yaml:"max_header_bytes" optional:"true"`
+	MaxRangeHeaderBytes int `yaml:"max_range_header_bytes" optional:"true"`
+
+	// AdminListen serves operational endpoints on a separate
+	// address, disabled when empty
+	AdminListen string `yaml:"admin_listen" optional:"true"`
+	// AdminRequired exits when the admin listener can't be started,
+	// otherwise requests keep being served without it
+	AdminRequired bool `yaml:"admin_required" optional:"true"`
+	// AdminCIDRs lists the clients allowed on the admin listener, any
+	// when empty
+	AdminCIDRs string `yaml:"admin_cidrs" optional:"true"`
+
 	Concurrency int `optional:"true"`
 
 	S3Timeout time.Duration `yaml:"s3_timeout"`
-	S3Retries int           `yaml:"s3_retries"`
+	S3Retries RetryConfig   `yaml:"s3_retries"`
+
+	// S3KeepAlives reuses connections to S3, with idle ones closed every
+	// IdleConnSweepInterval when that is set
+	S3KeepAlives          bool          `yaml:"s3_keepalives" optional:"true"`
+	IdleConnSweepInterval time.Duration `yaml:"idle_conn_sweep_interval" optional:"true"`
+	// ConnCloseWarnRate is the share of S3 responses closing their
+	// connection despite keep-alives that is warned about, 0 never warns
+	ConnCloseWarnRate float64 `yaml:"conn_close_warn_rate" optional:"true"`
+
+	// MaxConnsPerHost caps the connections to each S3 host, idle or not.
+	// Requests over the limit queue for up to S3Timeout.
+	MaxConnsPerHost int `yaml:"max_conns_per_host" optional:"true"`
+
+	// S3UseTLS connects to S3 over https with at least S3MinTLSVersion,
+	// limited to S3CipherSuites when set
+	S3UseTLS        bool   `yaml:"s3_use_tls" optional:"true"`
+	S3MinTLSVersion string `yaml:"s3_min_tls_version" optional:"true"`
+	S3CipherSuites  string `yaml:"s3_cipher_suites" optional:"true"`
+
+	// S3Endpoint points at an S3-compatible store instead of AWS, e.g.
+	// "https://minio.internal:9000", with buckets addressed path style
+	S3Endpoint string `yaml:"s3_endpoint" optional:"true"`
+	// S3Endpoints spreads objects over several S3-compatible backends with
+	// the same content by hashing their keys, an endpoint that fails is
+	// passed over for EndpointDownFor
+	S3Endpoints     []string      `yaml:"s3_endpoints" optional:"true"`
+	EndpointDownFor time.Duration `yaml:"endpoint_down_for" optional:"true"`
+	// RegionWeights spreads GETs and HEADs over replicas of the bucket in
+	// other regions by weight, a region that fails is passed over for
+	// EndpointDownFor too
+	RegionWeights []regionReplica `yaml:"region_weights" optional:"true"`
+
+	// S3MaxRedirects is how many redirects from S3 are followed, each
+	// signed afresh.  0 passes the first one on to the client.
+	S3MaxRedirects int `yaml:"s3_max_redirects" optional:"true"`
+
+	// S3Accelerate fetches through the bucket's transfer acceleration
+	// endpoint, requests are still signed for S3Region
+	S3Accelerate bool `yaml:"s3_accelerate" optional:"true"`
+
+	// S3VirtualHosted addresses the bucket as <bucket>.s3.<region>.amazonaws.com
+	// rather than in the path, AddressingFallback retries a request
+	// path-style once when that host doesn't resolve
+	S3VirtualHosted    bool `yaml:"s3_virtual_hosted" optional:"true"`
+	AddressingFallback bool `yaml:"addressing_fallback" optional:"true"`
+
+	// Client certificate and CA for mutual TLS with a custom endpoint
+	S3ClientCertFile string `yaml:"s3_client_cert_file" optional:"true"`
+	S3ClientKeyFile  string `yaml:"s3_client_key_file" optional:"true"`
+	S3CACertFile     string `yaml:"s3_ca_cert_file" optional:"true"`
 
 	S3Region string `yaml:"s3_region"`
 	S3Bucket string `yaml:"s3_bucket"`
 	S3Path   string `yaml:"s3_prefix" optional:"true"`
+
+	// BucketRoutesFile maps path prefixes onto buckets of their own, it
+	// is reread on SIGHUP
+	BucketRoutesFile string `yaml:"bucket_routes_file" optional:"true"`
+
+	// RootResponse is how "/" is answered: "404", "info", "forward" to
+	// S3 or "redirect=<url>"
+	RootResponse string `yaml:"root_response" optional:"true"`
+
+	// StripTrailingSlash asks S3 for "/file.ts" when a client asks for
+	// "/file.ts/"
+	StripTrailingSlash bool `yaml:"strip_trailing_slash" optional:"true"`
+
+	// ServerTiming adds a Server-Timing header breaking down where a
+	// request's time went.  It tells clients about our latency to S3 so it
+	// is off by default.
+	ServerTiming bool `yaml:"server_timing" optional:"true"`
+
+	// AutoDetectRegion switches to the bucket's actual region when it
+	// differs from S3Region
+	AutoDetectRegion bool `yaml:"auto_detect_region" optional:"true"`
+
+	// SignatureVersion picks how requests are signed, "v4", "v4a" or "v2"
+	SignatureVersion string `yaml:"signature_version" optional:"true"`
+	// AnonymousAccess fetches from public buckets without signing
+	AnonymousAccess bool `yaml:"anonymous_access" optional:"true"`
+	// RequireCredentials exits at startup when no credentials can be
+	// found, unless AnonymousAccess is set
+	RequireCredentials bool `yaml:"require_credentials" optional:"true"`
+
+	// ForwardQueryParams lists the client query parameters passed on to
+	// S3, and signed, all others are dropped
+	ForwardQueryParams []string `yaml:"forward_query_params" optional:"true"`
+
+	// HeadFallbackToGet answers HEAD requests with the headers of a one
+	// byte GET when the backend rejects HEAD with a 405 or 501
+	HeadFallbackToGet bool `yaml:"head_fallback_to_get" optional:"true"`
+
+	// HeadLengthFallback takes the size from a one byte GET when the
+	// backend answers a HEAD with a 200 but no Content-Length
+	HeadLengthFallback bool `yaml:"head_length_fallback" optional:"true"`
+
+	// ArchiveEnabled serves archivePath, streaming a zip or tar of up to
+	// ArchiveMaxEntries objects and ArchiveMaxBytes in all
+	ArchiveEnabled    bool  `yaml:"archive_enabled" optional:"true"`
+	ArchiveMaxEntries int   `yaml:"archive_max_entries" optional:"true"`
+	ArchiveMaxBytes   int64 `yaml:"archive_max_bytes" optional:"true"`
+
+	// MaxInflight caps the requests handled at once, those over it get
+	// OverloadStatus.  0 means no limit.
+	MaxInflight        int           `yaml:"max_inflight" optional:"true"`
+	OverloadStatus     int           `yaml:"overload_status" optional:"true"`
+	OverloadRetryAfter time.Duration `yaml:"overload_retry_after" optional:"true"`
+
+	// MaxS3Concurrency caps the fetches from S3 under way at once, bodies
+	// included, across all requests.  Up to MaxS3Queue more wait for a
+	// slot for as long as S3Timeout, others get OverloadStatus.  0 means
+	// no limit.
+	MaxS3Concurrency int `yaml:"max_s3_concurrency" optional:"true"`
+	MaxS3Queue       int `yaml:"max_s3_queue" optional:"true"`
+
+	// ClientRateLimit is how many requests a second each client address
+	// may make on average, ClientRateBurst at once.  Those over it get
+	// ThrottleStatus.  0 means no limit.
+	ClientRateLimit    float64       `yaml:"client_rate_limit" optional:"true"`
+	ClientRateBurst    int           `yaml:"client_rate_burst" optional:"true"`
+	ThrottleStatus     int           `yaml:"throttle_status" optional:"true"`
+	ThrottleRetryAfter time.Duration `yaml:"throttle_retry_after" optional:"true"`
+	// TrustedProxyCIDRs are the proxies in front of us whose
+	// X-Forwarded-For gives the client address the limits and access
+	// lists go by.  Without them each proxy counts as one client.
+	TrustedProxyCIDRs string `yaml:"trusted_proxy_cidrs" optional:"true"`
+
+	// UseEnvProxy routes S3 traffic through HTTP_PROXY/HTTPS_PROXY/NO_PROXY,
+	// S3ProxyURL overrides it with an explicit proxy
+	UseEnvProxy bool   `yaml:"use_env_proxy" optional:"true"`
+	S3ProxyURL  string `yaml:"s3_proxy_url" optional:"true"`
+
+	// AccessLogSink is stdout, a file, an http(s) URL or an
+	// s3://bucket/prefix URL that per-request access records are batched
+	// to, disabled when empty.  They are JSON or Apache combined log lines
+	// depending on AccessLogFormat.
+	AccessLogSink   string `yaml:"access_log_sink" optional:"true"`
+	AccessLogBatch  int    `yaml:"access_log_batch" optional:"true"`
+	AccessLogFormat string `yaml:"access_log_format" optional:"true"`
+
+	// CloudFrontForwardID passes CloudFront's X-Amz-Cf-Id on to S3 in the
+	// User-Agent so it shows up in S3 server access logs
+	CloudFrontForwardID bool `yaml:"cloudfront_forward_id" optional:"true"`
+	// CorrelationHeader names the header requests to S3 carry an ID in
+	// that is logged with them, "User-Agent" or "Referer" to find it in
+	// S3 server access logs.  Disabled when empty.
+	CorrelationHeader string `yaml:"correlation_header" optional:"true"`
+
+	// LogSampleRate is the share of requests, between 0 and 1, that are
+	// logged and access logged in full.  Failures always are.
+	LogSampleRate float64 `yaml:"log_sample_rate" optional:"true"`
+	// SlowRequestThreshold logs a warning for every request taking longer,
+	// sampled or not, disabled when zero
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold" optional:"true"`
+
+	MetricsEnabled bool `yaml:"metrics_enabled" optional:"true"`
+	// MetricsNamespace prefixes the names of everything on /debug/metrics
+	// so they don't collide with other exporters on the same target
+	MetricsNamespace string `yaml:"metrics_namespace" optional:"true"`
+	// TracingEnabled continues the W3C trace context of client requests,
+	// or starts one, logging the trace ID and passing it on to S3.  With
+	// metrics on too, latency histogram buckets carry it as exemplar.
+	TracingEnabled bool `yaml:"tracing_enabled" optional:"true"`
+	// MetricsPathBuckets maps request paths onto a bounded set of metrics
+	// labels, anything unmatched is counted as "other"
+	MetricsPathBuckets []pathBucket `yaml:"metrics_path_buckets" optional:"true"`
+
+	// CacheTTL enables the object metadata cache, ETagShortCircuit answers
+	// matching If-None-Match requests from it with a 304
+	CacheTTL         time.Duration `yaml:"cache_ttl" optional:"true"`
+	ETagShortCircuit bool          `yaml:"etag_short_circuit" optional:"true"`
+	// CacheTTLByPath and CacheTTLByContentType override CacheTTL for the
+	// objects they match, e.g. seconds for manifests and hours for
+	// segments.  A TTL of 0 keeps them out of the cache.
+	CacheTTLByPath        []cacheTTLRule `yaml:"cache_ttl_by_path" optional:"true"`
+	CacheTTLByContentType []cacheTTLRule `yaml:"cache_ttl_by_content_type" optional:"true"`
+	// CacheStatusHeader names the response header reporting HIT, MISS,
+	// PARTIAL, STALE or REVALIDATED, empty to leave it out
+	CacheStatusHeader string `yaml:"cache_status_header" optional:"true"`
+
+	// Bodies of objects up to CacheMaxObjectSize bytes are cached too, up
+	// to CacheMaxBytes in total
+	CacheMaxObjectSize int64 `yaml:"cache_max_object_size" optional:"true"`
+	CacheMaxBytes      int64 `yaml:"cache_max_bytes" optional:"true"`
+	// CacheRangeMaxBytes merges the cached ranges of each object, up to
+	// that many bytes of it, so that a range overlapping them only needs
+	// the gaps from S3.  Ranges are cached as requested when zero.
+	CacheRangeMaxBytes int64 `yaml:"cache_range_max_bytes" optional:"true"`
+
+	// KeyRewriteRules map object paths onto other keys with regexps, e.g.
+	// for a new storage layout, the first match wins
+	KeyRewriteRules []keyRewriteRule `yaml:"key_rewrite_rules" optional:"true"`
+
+	// SegmentRoutes translate "?segment=N" on matching paths into the
+	// range of the Nth fixed size slice of the object
+	SegmentRoutes []segmentRoute `yaml:"segment_routes" optional:"true"`
+
+	// HTTP10MaxBuffer caps how much of a body without a known length is
+	// buffered to give HTTP/1.0 clients a Content-Length
+	HTTP10MaxBuffer int64 `yaml:"http10_max_buffer" optional:"true"`
+
+	// ShortReadMaxBytes is the size up to which whole objects are read in
+	// full before being sent, so a body cut short can be retried.  0, the
+	// default, streams everything.
+	ShortReadMaxBytes int64 `yaml:"short_read_max_bytes" optional:"true"`
+
+	// NotFoundAlarmRate is the share of S3 responses in a
+	// NotFoundAlarmWindow that must be 404s, with at least
+	// NotFoundAlarmMinRequests of them, to warn of a likely prefix
+	// misconfiguration.  0 turns the alarm off.
+	NotFoundAlarmRate        float64       `yaml:"not_found_alarm_rate" optional:"true"`
+	NotFoundAlarmWindow      time.Duration `yaml:"not_found_alarm_window" optional:"true"`
+	NotFoundAlarmMinRequests int           `yaml:"not_found_alarm_min_requests" optional:"true"`
+
+	// MinObjectAge is how long a newly written object may take to be
+	// readable.  A 404 is asked for again once after waiting that long.
+	MinObjectAge time.Duration `yaml:"min_object_age" optional:"true"`
+	// DirectAge sets Age on responses straight from S3 too, the time
+	// since the object was last modified, or since S3's Date without a
+	// Last-Modified.  That is how old the object is, often far beyond
+	// any freshness lifetime, so it is capped at the response's max-age;
+	// without one downstream caches may treat every object as stale.
+	// Cached responses always get one.
+	DirectAge bool `yaml:"direct_age" optional:"true"`
+
+	// VerifyChecksums asks S3 for the checksums of objects uploaded with
+	// one and checks full bodies against them as they stream
+	VerifyChecksums bool `yaml:"verify_checksums" optional:"true"`
+	// VerifyContentMD5 does the same with the MD5 of objects without a
+	// checksum, from the ETag of single part uploads or a Content-MD5
+	VerifyContentMD5 bool `yaml:"verify_content_md5" optional:"true"`
+
+	// EnforceRange handles S3 answering a range with the whole object,
+	// "error" fails the request with a 502 and "apply" cuts the range out
+	// of the body.  The whole object is passed on when empty.
+	EnforceRange string `yaml:"enforce_range" optional:"true"`
+
+	// SniffContentType replaces the generic type of full GETs of objects
+	// S3 has as application/octet-stream with the one their first bytes
+	// suggest, for objects of up to SniffMaxBytes, any size when zero
+	SniffContentType bool  `yaml:"sniff_content_type" optional:"true"`
+	SniffMaxBytes    int64 `yaml:"sniff_max_bytes" optional:"true"`
+
+	// CopyBufferSize is the buffer size bodies are streamed to clients
+	// with, larger buffers mean fewer syscalls for big segments
+	CopyBufferSize int `yaml:"copy_buffer_size" optional:"true"`
+
+	// RangeChunkSize splits range requests larger than this many bytes
+	// into separately retried pieces, disabled when zero
+	RangeChunkSize int64 `yaml:"range_chunk_size" optional:"true"`
+
+	ManifestPrefetch ManifestPrefetchConfig `yaml:"manifest_prefetch" optional:"true"`
+	// PrefetchHints adds a Link rel=prefetch header for up to that many of
+	// the first segments of manifests, disabled when zero
+	PrefetchHints int `yaml:"prefetch_hints" optional:"true"`
+
+	// CompressionCodecs lists the codecs responses of CompressTypes may be
+	// compressed with, empty disables compression
+	CompressionCodecs []string `yaml:"compression_codecs" optional:"true"`
+	CompressTypes     []string `yaml:"compress_types" optional:"true"`
+	// CompressionLevel trades CPU for ratio, 0 to 11 for br and -2 to 9
+	// for gzip, each codec's default when -1
+	CompressionLevel int `yaml:"compression_level" optional:"true"`
+	// VaryHeaders are added to the Vary header of every response, e.g.
+	// Origin for CORS, on top of Accept-Encoding for compressible ones
+	VaryHeaders []string `yaml:"vary_headers" optional:"true"`
+	// AllowedHosts lists the Host headers requests are served for, e.g.
+	// "media.example.com" or "*.example.com", others get a 421.  Any host
+	// is served when empty.
+	AllowedHosts []string `yaml:"allowed_hosts" optional:"true"`
+	// MinimalHeaders cuts every response down to the headers that
+	// describe its body, dropping Date, Last-Modified, Server, the
+	// cache status and the like that could fingerprint the deployment
+	MinimalHeaders bool `yaml:"minimal_headers" optional:"true"`
+	// Only bodies of CompressMinBytes up to CompressMaxBytes are
+	// compressed, no upper limit when the latter is zero
+	CompressMinBytes int64 `yaml:"compress_min_bytes" optional:"true"`
+	CompressMaxBytes int64 `yaml:"compress_max_bytes" optional:"true"`
+
+	// Chaos testing, only honored when started with -chaos.  Clients in
+	// ChaosAllowCIDRs can also ask for latency per request.
+	ChaosLatency    time.Duration `yaml:"chaos_latency" optional:"true"`
+	ChaosErrorRate  float64       `yaml:"chaos_error_rate" optional:"true"`
+	ChaosAllowCIDRs string        `yaml:"chaos_allow_cidrs" optional:"true"`
+
+	// Clients in RetryOverrideCIDRs can set X-S3-Max-Retries to override
+	// S3Retries for a request, up to RetryOverrideMax for each class
+	RetryOverrideCIDRs string `yaml:"retry_override_cidrs" optional:"true"`
+	RetryOverrideMax   int    `yaml:"retry_override_max" optional:"true"`
+
+	// AllowUploads passes PUTs and multipart upload POSTs from clients in
+	// UploadCIDRs on to S3, with bodies of up to UploadMaxBytes
+	AllowUploads   bool   `yaml:"allow_uploads" optional:"true"`
+	UploadCIDRs    string `yaml:"upload_cidrs" optional:"true"`
+	UploadMaxBytes int64  `yaml:"upload_max_bytes" optional:"true"`
+	// AllowDeletes passes confirmed DELETEs from clients in DeleteCIDRs
+	// on to S3
+	AllowDeletes bool   `yaml:"allow_deletes" optional:"true"`
+	DeleteCIDRs  string `yaml:"delete_cidrs" optional:"true"`
+
+	// ServeStaleOnError serves cached objects up to CacheMaxStale past
+	// their expiry when S3 can't be reached
+	ServeStaleOnError bool          `yaml:"serve_stale_on_error" optional:"true"`
+	CacheMaxStale     time.Duration `yaml:"cache_max_stale" optional:"true"`
+
+	// DiagnosticsInterval logs goroutine, file descriptor and heap
+	// stats at debug level this often, disabled when zero
+	DiagnosticsInterval time.Duration `yaml:"diagnostics_interval" optional:"true"`
+
+	// SuccessStatuses lists the upstream status codes and classes that
+	// aren't logged and counted as errors, e.g. "2xx,304"
+	SuccessStatuses string `yaml:"success_statuses" optional:"true"`
+
+	// WatchdogInterval checks this often that requests are still being
+	// served and exits after repeated failures, disabled when zero
+	WatchdogInterval time.Duration `yaml:"watchdog_interval" optional:"true"`
+
+	// ShutdownTimeout is how long to wait on a signal for requests under
+	// way to finish before exiting, zero exits at once
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" optional:"true"`
+
+	// MaintenanceFile puts us in maintenance while it exists, answering
+	// object requests with its content and a 503 carrying
+	// MaintenanceRetryAfter
+	MaintenanceFile       string        `yaml:"maintenance_file" optional:"true"`
+	MaintenanceRetryAfter time.Duration `yaml:"maintenance_retry_after" optional:"true"`
+
+	// ServiceName and Environment are logged on every line as "service"
+	// and "env", the latter left out when empty
+	ServiceName string `yaml:"service_name" optional:"true"`
+	Environment string `yaml:"environment" optional:"true"`
+
+	// LogLevel is the least severe level logged, "info" by default
 	LogLevel string `optional:"true"`
 }
 
@@ -53,6 +399,9 @@ var conf Config
 var progName string
 var statRate float32 = 1
 
+// Proxy selection for S3 requests, set up by initProxy
+var s3Proxy func(*http.Request) (*url.URL, error)
+
 // List of headers to forward in response
 var headerForward = map[string]bool{
 	"Date":           true,
@@ -61,6 +410,10 @@ var headerForward = map[string]bool{
 	"Content-Type":   true,
 	"Last-Modified":  true,
 	"ETag":           true,
+	// the version served, for versioned buckets
+	"X-Amz-Version-Id": true,
+	// set by response-content-disposition or the object's metadata
+	"Content-Disposition": true,
 }
 
 const serverName = "VOD S3 Helper"
@@ -79,14 +432,101 @@ func initRuntime() {
 
 }
 
+// Decide how S3 requests are proxied
+func initProxy() {
+	switch {
+	case conf.S3ProxyURL != "":
+		u, err := url.Parse(conf.S3ProxyURL)
+		if err != nil {
+			exitConfig("S3_PROXY_URL", err)
+		}
+		s3Proxy = http.ProxyURL(u)
+		log.Info().Msg(fmt.Sprintf("Using proxy %s for S3 requests", u.Redacted()))
+	case conf.UseEnvProxy:
+		s3Proxy = http.ProxyFromEnvironment
+		log.Info().Msg("Using environment proxy settings for S3 requests")
+	default:
+		s3Proxy = nil
+		log.Info().Msg("Connecting to S3 directly, proxy disabled")
+	}
+}
+
 func forwardToS3(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	traceID := requestTraceID(r)
+	defer recordRequest(r.URL.Path, start, traceID)
+
+	// unsampled requests only log warnings and errors, and only make the
+	// access log when they fail
+	sampled := logSampled()
+
+	sw := &statusWriter{ResponseWriter: w, minimal: conf.MinimalHeaders}
+	w = sw
+	if accessLog != nil {
+		defer func() {
+			if !sampled && sw.status < 400 {
+				return
+			}
+			accessLog.emit(accessRecord{
+				Time:     time.Now(),
+				Key:      r.URL.Path,
+				Bytes:    sw.bytes,
+				Status:   sw.status,
+				ClientIP: clientIP(r),
+
+				CloudFrontID: cloudFrontID(r),
+
+				Request:   r.Method + " " + r.RequestURI + " " + r.Proto,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+			})
+		}()
+	}
+
 	w.Header().Set("Server", serverName)
+	addVary(w.Header(), conf.VaryHeaders...)
 
+	// in maintenance nothing goes to S3, the watchdog's self-check aside
+	// so it doesn't take maintenance for a hang
+	if maintenance.on.Load() && r.URL.Path != watchdogPath {
+		serveMaintenance(w, r)
+		return
+	}
+
+	// a client over its rate is throttled, when we are over the in-flight
+	// limit everyone is.  This comes before anything else is looked at so
+	// uploads, deletes and refused methods count too, the watchdog's
+	// self-check aside as above.
+	if r.URL.Path != watchdogPath {
+		release, ok := admit(w, r, r.URL.Path)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
+	if isUpload(r) {
+		serveUpload(w, r)
+		return
+	}
+	if isDelete(r) {
+		serveDelete(w, r)
+		return
+	}
 	if r.Method != "GET" && r.Method != "HEAD" {
-		w.WriteHeader(405)
+		rejectMethod(w, r)
 		return
 	}
 
+	// Expect: 100-continue means nothing on a GET or HEAD as we never
+	// read their bodies: net/http sends the final response straight away
+	// rather than a 100 Continue, closing the connection when a body was
+	// announced.  The header is dropped so nothing further on takes it for
+	// a body still to come.  Uploads have gone by now and get their 100
+	// Continue when they read theirs.  Other expectations are refused with
+	// a 417 before we get here.
+	r.Header.Del("Expect")
+
 	// Make sure that RemoteAddr is 127.0.0.1 so it comes off a local proxy
 	// a := strings.SplitN(r.RemoteAddr, ":", 2)
 	// if len(a) != 2 || a[0] != "127.0.0.1" {
@@ -94,88 +534,426 @@ func forwardToS3(w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 
-	upath := r.URL.Path
+	upath := stripTrailingSlash(r.URL.Path)
 	byterange := r.Header.Get("Range")
-	logger := log.With().
+
+	if err := checkKey(upath); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Warn().
+			Str("object", upath).
+			Str("error", err.Error()).
+			Msg("Rejected object key")
+		return
+	}
+
+	// segment routes take the range as an index instead
+	if rng, status, err := segmentRange(upath, r.URL.Query(), byterange); err != nil {
+		w.WriteHeader(status)
+		log.Warn().
+			Str("object", upath).
+			Str("error", err.Error()).
+			Msg("Rejected segment request")
+		return
+	} else if rng != "" {
+		byterange = rng
+	}
+
+	// a pathological Range header is refused before it gets anywhere
+	if conf.MaxRangeHeaderBytes > 0 && len(byterange) > conf.MaxRangeHeaderBytes {
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		log.Warn().
+			Str("object", upath).
+			Int("range-length", len(byterange)).
+			Str("client", clientIP(r)).
+			Msg("Rejected oversized Range header")
+		return
+	}
+	if byterange != "" && !validRange(byterange) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Warn().
+			Str("object", upath).
+			Str("range", byterange).
+			Str("client", clientIP(r)).
+			Msg("Rejected malformed Range header")
+		return
+	}
+
+	// If-Range only holds with a strong validator, a weak ETag gets the
+	// whole object
+	var ifRangeName, ifRangeValue string
+	if byterange != "" {
+		name, value, ok := ifRangeCondition(r.Header.Get("If-Range"))
+		if !ok {
+			byterange = ""
+		}
+		ifRangeName, ifRangeValue = name, value
+	}
+
+	// the watchdog's self-check never leaves the process
+	if upath == watchdogPath {
+		serveWatchdog(w)
+		return
+	}
+
+	// nor does a bare "/", unless it is configured to
+	if upath == "/" && serveRoot(w, r) {
+		return
+	}
+
+	logctx := log.With().
 		Str("object", upath).
 		Str("range", byterange).
-		Str("method", r.Method).
-		Logger()
-	s3url := fmt.Sprintf("http://s3.%s.amazonaws.com/%s%s%s", conf.S3Region, conf.S3Bucket, conf.S3Path, upath)
-	r2, err := http.NewRequest(r.Method, s3url, nil)
+		Str("method", r.Method)
+	// correlate with CloudFront's logs when it is in front of us
+	cfID := cloudFrontID(r)
+	if cfID != "" {
+		logctx = logctx.Str("cf-id", cfID)
+	}
+	if traceID != "" {
+		logctx = logctx.Str("trace-id", traceID)
+	}
+	correlationID := newCorrelationID(traceID)
+	if correlationID != "" {
+		logctx = logctx.Str("correlation-id", correlationID)
+	}
+	// trusted clients can ask for fewer or more retries than configured
+	retries, overridden := requestRetries(r)
+	if overridden {
+		logctx = logctx.Str("max-retries", retries.String())
+	}
+	logger := logctx.Logger()
+	if !sampled {
+		logger = logger.Level(zerolog.WarnLevel)
+	}
+
+	// retries are counted per class so e.g. transient 503s can be
+	// retried more aggressively than connection failures
+	nretries := map[string]int{}
+	defer logSlowRequest(logger, sw, start, nretries)
+	defer logRequestCompleted(logger, sw, start)
+
+	if chaosError() {
+		w.WriteHeader(500)
+		logger.Warn().Msg("Chaos error")
+		return
+	}
+
+	query, err := forwardQuery(r)
+	if err != nil {
+		w.WriteHeader(400)
+		logger.Error().
+			Str("error", err.Error()).
+			Msg("Invalid query parameters")
+		return
+	}
+
+	// only plain requests can use the cache, full ones for the whole
+	// object and others for a range of it.  A range under If-Range has
+	// to be checked with S3.
+	cacheable := len(query) == 0 && ifRangeName == ""
+	full := cacheable && byterange == ""
+	ckey := cacheKey(upath, byterange)
+
+	// clients can ask for cached copies to be revalidated, which also
+	// rules out serving them stale, or for the cache to be left alone
+	noCache, noStore := requestCacheDirectives(r.Header)
+	fromCache := cacheable && !noCache && !noStore
+	staleOK := full && !noCache && !noStore
+	if cache != nil && (noCache || noStore) {
+		logger.Info().
+			Bool("no-cache", noCache).
+			Bool("no-store", noStore).
+			Msg("Client asked to bypass the cache")
+	}
+
+	// answer conditional requests for an unchanged object straight from
+	// the cache without contacting S3
+	if conf.ETagShortCircuit && full && fromCache {
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			if e, ok := cache.get(upath); ok && etagMatch(inm, e.etag) {
+				setCacheStatus(w, cacheHit)
+				setAge(w, e)
+				writeNotModified(w, e.header)
+				logger.Info().
+					Str("etag", e.etag).
+					Msg("Not modified, served from cache")
+				return
+			}
+		}
+	}
+
+	// serve small objects and ranges straight from the cache when we have
+	// them, an expired copy is revalidated with S3 below
+	var revalidate *cacheEntry
+	if cacheable && !noStore {
+		if e, ok := cache.lookup(ckey); ok && e.body != nil {
+			if e.fresh(time.Now()) && !noCache {
+				setCacheStatus(w, cacheHit)
+				serveCached(w, r, e)
+				logger.Info().
+					Int("content-length", len(e.body)).
+					Msg("Served from cache")
+				return
+			}
+			if e.etag != "" {
+				revalidate = e
+			}
+		}
+	}
+
+	// a range overlapping what we have cached of the object only needs
+	// the rest from S3
+	if fromCache && r.Method == "GET" && byterange != "" && cache.mergesRanges() {
+		if serveMergedRange(w, upath, byterange, retries, logger) {
+			return
+		}
+	}
+
+	// large ranges are fetched piecewise when that is enabled, unless
+	// they are conditional
+	if r.Method == "GET" && ifRangeName == "" {
+		if first, last, ok := chunkedRange(byterange); ok {
+			defer inflight.begin(upath, byterange)()
+			serveChunkedRange(w, upath, query, first, last, retries, logger)
+			return
+		}
+	}
+
+	r2, err := newS3Request(r.Method, upath, query)
+	if err == errNoCredentials {
+		credentialsUnavailable(w)
+		logger.Warn().Msg("No valid credentials, asked client to retry")
+		return
+	}
 	if err != nil {
 		w.WriteHeader(403)
 		logger.Error().
 			Str("error", err.Error()).
-			Str("url", s3url).
+			Str("url", s3URL(upath)).
 			Msg("Failed to create GET request")
 		return
 	}
 
-	r2 = awsauth.SignForRegion(r2, conf.S3Region, "s3")
+	tagCloudFrontID(r2, cfID)
+	propagateTrace(r2, traceID)
+	r2, err = tagCorrelationID(r2, correlationID)
+	if err == errNoCredentials {
+		credentialsUnavailable(w)
+		logger.Warn().Msg("No valid credentials, asked client to retry")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(403)
+		logger.Error().
+			Str("error", err.Error()).
+			Msg("Failed to sign request with correlation header")
+		return
+	}
 
-	logger.Info().
-		Str("RawQuery", r2.URL.RawQuery).
-		Msg("Received request")
+	// time the S3 side of the request for the Server-Timing header
+	var timing *serverTiming
+	if conf.ServerTiming {
+		timing = newServerTiming(start)
+		r2 = timing.trace(r2)
+	}
+	// and how its connection was come by, for debugging slow requests
+	var conns *connTrace
+	if traceConns(logger) {
+		conns = &connTrace{}
+		r2 = conns.trace(r2)
+	}
 
-	url := r2.URL.String()
-	logger.Info().
-		Str("url", url).
-		Msg("Received request")
+	logRequestStarted(logger, r2.URL)
 
 	var bodySize int64
-	r2.Header.Set("Host", r2.URL.Host)
 	// parse the byterange request header to derive the content-length requested
 	// so we know how much data we need to xfer from s3 to the client.
 	if byterange != "" {
 		r2.Header.Set("Range", byterange)
 	}
-
-	nretries := 0
+	if revalidate != nil {
+		r2.Header.Set("If-None-Match", revalidate.etag)
+	}
+	if ifRangeName != "" {
+		r2.Header.Set(ifRangeName, ifRangeValue)
+	}
 
 	var resp *http.Response
+	var notFoundRetried bool
 
-	// setup client outside of for loop since we don't
-	// need to define it multiple times and failures
-	// shouldn't need a new client
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   conf.S3Timeout,
-				KeepAlive: 1 * time.Second,
-			}).DialContext,
-			IdleConnTimeout:   conf.S3Timeout,
-			DisableKeepAlives: true, // terminates open connections
-		}}
+	defer inflight.begin(upath, byterange)()
 
 	for {
-		resp, err = client.Do(r2)
-		if err == nil {
+		if r2.Method == "HEAD" {
+			resp, err = heads.do(r2)
+		} else {
+			resp, err = doS3(r2)
+			// a small object cut short is retried like a failed
+			// connection while the client hasn't seen any of it
+			if err == nil && shortReadGuarded(r2, resp, full) {
+				if err = bufferComplete(resp); err != nil {
+					metricUpstreamReadErrors.Add(1)
+					resp = nil
+				}
+			}
+		}
+		class := retryClass(resp, err)
+		if class == "" {
+			if retryNotFound(resp, err, &notFoundRetried, logger) {
+				continue
+			}
+			if ifRangeChanged(resp, err, r2, ifRangeName, logger) {
+				continue
+			}
 			break
 		}
 
-		// Bail out on non-timeout error, or too many timeouts.
-		netErr, ok := err.(net.Error)
-		isTimeout := ok && netErr.Timeout()
-
-		if nretries >= conf.S3Retries || !isTimeout {
+		// Bail out once this class has used up its retries.  A 5xx
+		// response is still forwarded to the client as is.
+		if nretries[class] >= retries.max(class) {
+			if err == nil {
+				if staleOK && serveStale(w, r, upath, logger) {
+					resp.Body.Close()
+					return
+				}
+				break
+			}
 			logger.Error().
 				Str("error", err.Error()).
-				Msg(fmt.Sprintf("Connection failed after #%d retries", conf.S3Retries))
-			w.WriteHeader(500)
+				Str("class", class).
+				Int("attempt", nretries[class]).
+				Msg(fmt.Sprintf("Connection failed after #%d retries", nretries[class]))
+			if !staleOK || !serveStale(w, r, upath, logger) {
+				w.WriteHeader(500)
+			}
 			return
 		}
 
+		nretries[class]++
+		if err == nil {
+			err = fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+			resp.Body.Close()
+		}
 		logger.Error().
 			Str("error", err.Error()).
-			Msg(fmt.Sprintf("Connection timeout: retry #%d", nretries))
-		nretries++
+			Str("class", class).
+			Int("attempt", nretries[class]).
+			Msg(fmt.Sprintf("Upstream %s: retry #%d", class, nretries[class]))
+	}
+
+	// S3 is as busy as we let it be, shed the request like an overload
+	if err == errS3Busy {
+		rejectRequest(w, conf.OverloadStatus, conf.OverloadRetryAfter)
+		logger.Warn().Msg(fmt.Sprintf("Over %d concurrent S3 fetches", conf.MaxS3Concurrency))
+		return
+	}
+
+	if r.Method == "HEAD" && conf.HeadFallbackToGet && headUnsupported(resp) {
+		resp = headFallback(resp, upath, query, byterange, logger)
+	}
+	if r.Method == "HEAD" && headLengthMissing(resp, byterange) {
+		logger.Warn().Msg("Backend answered HEAD without a Content-Length")
+		if conf.HeadLengthFallback {
+			resp = headFallback(resp, upath, query, byterange, logger)
+		}
 	}
+	notFoundAlarm.record(resp.StatusCode)
+	logYoungObject(resp, logger)
+	conns.record(logger)
 
 	defer resp.Body.Close()
 
 	header := resp.Header
+
+	// S3 confirmed our expired copy is still current
+	if revalidate != nil && resp.StatusCode == http.StatusNotModified {
+		cache.refresh(ckey)
+		setCacheStatus(w, cacheRevalidated)
+		serveCached(w, r, revalidate)
+		logger.Info().
+			Int("content-length", len(revalidate.body)).
+			Msg("Revalidated, served from cache")
+		return
+	}
+
+	// a backend that ignored the range either fails the request or has it
+	// applied here, for clients that can't take the whole object
+	if enforceRange(r.Method) && rangeIgnored(resp, byterange, ifRangeName) {
+		metricRangesIgnored.Add(1)
+		status := http.StatusBadGateway
+		err := fmt.Errorf("backend ignored the range")
+		if conf.EnforceRange == enforceRangeApply {
+			status, err = applyRange(resp, byterange, r.Method == "HEAD")
+		}
+		if err != nil {
+			if status == http.StatusRequestedRangeNotSatisfiable {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", resp.ContentLength))
+			}
+			w.WriteHeader(status)
+			logger.Error().
+				Str("error", err.Error()).
+				Int("statuscode", status).
+				Msg("Backend answered a range with the whole object")
+			return
+		}
+		logger.Info().Msg("Backend answered a range with the whole object, applied it")
+	}
+
+	// keep track of the object's current ETag, a full response replaces
+	// whatever we had and a missing object invalidates it along with its
+	// cached ranges
+	if full && !noStore && resp.StatusCode == http.StatusOK {
+		cache.set(upath, "", resp.StatusCode, header, nil)
+	} else if resp.StatusCode == http.StatusNotFound {
+		cache.delete(upath)
+	}
+
+	// If-None-Match takes the weak comparison, which S3 may not when its
+	// ETags are weak
+	if full && resp.StatusCode == http.StatusOK {
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, header.Get("ETag")) {
+			setCacheStatus(w, cacheMiss)
+			writeNotModified(w, header)
+			logger.Info().
+				Str("etag", header.Get("ETag")).
+				Msg("Not modified")
+			return
+		}
+	}
+
+	// objects uploaded without a type get the one their first bytes
+	// suggest, before anything goes by the type
+	if full && r.Method == "GET" && sniffable(resp) {
+		if ct, ok := sniffContentType(resp); ok {
+			metricContentTypeSniffed.Add(1)
+			logger.Debug().
+				Str("content-type", ct).
+				Msg("Sniffed content type of object stored as " + genericContentType)
+		}
+	}
+
+	// manifests are read up front to hint players at their first segments
+	if full && r.Method == "GET" && wantsPrefetchHints(resp) {
+		body, err := io.ReadAll(resp.Body)
+		if err == nil && int64(len(body)) != resp.ContentLength {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			metricUpstreamReadErrors.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+			logger.Error().
+				Str("error", err.Error()).
+				Msg("Could not read manifest for prefetch hints")
+			return
+		}
+		resp.Body = &prefixedBody{Reader: bytes.NewReader(body), Closer: resp.Body}
+		if _, err := addPrefetchHints(w.Header(), upath, header.Get("Content-Type"), body); err != nil {
+			logger.Debug().
+				Str("error", err.Error()).
+				Msg("Manifest didn't parse, no prefetch hints")
+		}
+	}
+
 	for name, hflag := range headerForward {
 		if hflag {
 			if v := header.Get(name); v != "" {
@@ -183,42 +961,158 @@ func forwardToS3(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	setObjectAge(w, resp)
+	setCacheStatus(w, cacheMiss)
+
+	// only pass on a length S3 actually gave us, when it is unknown the
+	// body is streamed with chunked transfer encoding instead.  HTTP/1.0
+	// clients can't take that so the body is buffered for them.
+	if resp.ContentLength < 0 && http10(r) && r.Method != "HEAD" &&
+		resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		if err := bufferBody(resp, conf.HTTP10MaxBuffer); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			logger.Error().
+				Str("error", err.Error()).
+				Msg("Could not buffer body without a Content-Length for HTTP/1.0 client")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if resp.ContentLength >= 0 {
+		bodySize = resp.ContentLength
+	} else {
+		w.Header().Del("Content-Length")
+		logger.Info().Msg("Upstream did not send a Content-Length, streaming chunked")
+	}
+
+	// compress whole objects of whitelisted types when the client accepts
+	// one of our codecs, the length is no longer known up front then
+	var encoding string
+	if full && resp.StatusCode == http.StatusOK && header.Get("Content-Encoding") == "" &&
+		compressible(header.Get("Content-Type")) && compressSize(resp.ContentLength) {
+		// whether we compress depends on Accept-Encoding, which caches
+		// downstream need to know even when we don't
+		if len(conf.CompressionCodecs) > 0 {
+			addVary(w.Header(), "Accept-Encoding")
+		}
+		// HTTP/1.0 clients have to know the length up front
+		if !http10(r) {
+			encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		}
+	}
+	if encoding != "" {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", encoding)
+		if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			w.Header().Set("ETag", "W/"+etag)
+		}
+		logger = logger.With().Str("encoding", encoding).Logger()
+	}
 
 	// we can't buffer in ram or to disk so write the body
 	// directly to the return body buffer and stream out
 	// to the client. if we have a failure, we can't notify
-	// the client, this is a poor design with potential
-	// silent truncation of the output.
+	// the client other than by resetting the connection so
+	// the truncated output isn't taken for a complete one.
 	//
+	// only 2xx responses carry a body worth copying, which statuses are
+	// logged as errors is up to SuccessStatuses
+	setServerTiming(w, timing)
 	w.WriteHeader(resp.StatusCode)
-	var bytes int64
+	var nbytes int64
 	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
 		if r2.Method != "HEAD" {
-			logger.Info().
-				Int64("content-length", bodySize).
-				Msg(fmt.Sprintf("Begin data transfer of #%d bytes", bodySize))
-			bytes, err = io.Copy(w, resp.Body)
-			if err != nil {
+			chaosDelay(r, logger)
+			// keep a copy of small full objects and ranges for the cache
+			var body io.Reader = resp.Body
+			var buf *bytes.Buffer
+			if cacheable && !noStore && (resp.StatusCode == http.StatusOK) == (byterange == "") &&
+				(cache.cacheable(resp.ContentLength) || byterange != "" && cache.rangeCacheable(resp.ContentLength)) {
+				buf = bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+				body = io.TeeReader(resp.Body, buf)
+			}
+			// check whole objects against the checksum S3 has for them,
+			// or else the MD5 their ETag or Content-MD5 gives
+			var verify *checksumVerifier
+			if full && resp.StatusCode == http.StatusOK {
+				if conf.VerifyChecksums {
+					verify = newChecksumVerifier(header)
+				}
+				if verify == nil && conf.VerifyContentMD5 {
+					verify = newContentMD5Verifier(header)
+				}
+				if verify != nil {
+					body = io.TeeReader(body, verify)
+				}
+			}
+			src := &trackingReader{Reader: body}
+			if encoding != "" {
+				cw := newCompressor(encoding, w)
+				nbytes, err = copyBody(cw, src)
+				if cerr := cw.Close(); err == nil {
+					err = cerr
+				}
+			} else {
+				nbytes, err = copyBody(w, src)
+			}
+			if err != nil && src.err == nil {
+				// the client went away, nothing wrong on the S3 side
+				metricClientDisconnects.Add(1)
+				logger.Info().
+					Str("error", err.Error()).
+					Int64("content-length", bodySize).
+					Int64("recv", nbytes).
+					Msg("Client disconnected during body copy")
+				abortConnection(w)
+			} else if err != nil {
 				// we failed copying the body yet already sent the http header so can't tell
 				// the client that it failed.
+				metricUpstreamReadErrors.Add(1)
 				logger.Error().
 					Str("error", err.Error()).
 					Int64("content-length", bodySize).
-					Int64("recv", bytes).
-					Msg("Failed to copy body")
-			} else {
-				logger.Info().
-					Int64("content-length", bodySize).
-					Int64("recv", bytes).
-					Msg("Success copying body")
+					Int64("recv", nbytes).
+					Msg("Failed to read body from S3")
+				abortConnection(w)
+			} else if verify != nil && verify.got() != verify.want {
+				// too late to tell the client, but at least don't keep it
+				verify.failures.Add(1)
+				logger.Warn().
+					Str("algorithm", verify.algo).
+					Str("expected", verify.want).
+					Str("computed", verify.got()).
+					Int64("recv", nbytes).
+					Msg("Checksum mismatch on body from S3")
+			} else if buf != nil && nbytes == resp.ContentLength {
+				// the whole body came through, keep it for the cache
+				if byterange != "" && cache.mergesRanges() {
+					cache.addRange(upath, header, buf.Bytes())
+					metricRangeBytesS3.Add(nbytes)
+				} else {
+					cache.set(upath, byterange, resp.StatusCode, header, buf.Bytes())
+					prefetchManifest(upath, header.Get("Content-Type"), buf.Bytes())
+				}
 			}
+		} else {
+			// HEAD responses carry the object's headers, including the
+			// length and range a GET would return, but never a body
+			logger.Info().
+				Int64("content-length", bodySize).
+				Str("content-range", header.Get("Content-Range")).
+				Msg("Forwarded HEAD response")
 		}
+	} else if successStatus(resp.StatusCode) {
+		// e.g. a 304, there is no body to copy
+		logger.Info().
+			Int("statuscode", resp.StatusCode).
+			Msg("Forwarded response without body")
 	} else {
+		metricUpstreamErrors.Add(1)
 		logger.Error().
 			Str("error", fmt.Sprintf("Response Status Code: %d", resp.StatusCode)).
 			Int("statuscode", resp.StatusCode).
 			Int64("content-length", bodySize).
-			Int64("recv", bytes).
+			Int64("recv", nbytes).
 			Msg("Bad connection status response code")
 	}
 }
@@ -229,33 +1123,319 @@ func main() {
 
 	progName = path.Base(os.Args[0])
 
-	// configFile := flag.String("config", configFileDefault, "config file to use")
+	configSource := flag.String("config", "", "file or http(s):// or s3:// URL of NAME=value settings to load")
+	configCache := flag.String("config-cache", configCacheDefault(), "copy of a remote -config used when it can't be fetched")
 	pprofFlag := flag.Bool("pprof", false, "enable pprof")
+	flag.BoolVar(&chaosEnabled, "chaos", false, "enable chaos testing (never in production)")
 	flag.Parse()
 
+	if *configSource != "" {
+		if err := loadConfigSource(*configSource, *configCache); err != nil {
+			exitConfig("-config", err)
+		}
+	}
+
 	// conf.LogLevel = "error"
 	conf.Listen = "0.0.0.0:8080"
+	conf.AdminListen = os.Getenv("S3_ADMIN_LISTEN")
+	conf.AdminRequired = envBool("S3_ADMIN_REQUIRED", false)
+	conf.AdminCIDRs = os.Getenv("S3_ADMIN_CIDRS")
+	conf.MaxHeaderBytes = envInt("S3_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+	conf.MaxRangeHeaderBytes = envInt("S3_MAX_RANGE_HEADER_BYTES", 1024)
 	conf.S3Region = os.Getenv("S3_REGION")
 	conf.S3Bucket = os.Getenv("S3_BUCKET")
+	conf.BucketRoutesFile = os.Getenv("S3_BUCKET_ROUTES_FILE")
+	conf.ServerTiming = envBool("S3_SERVER_TIMING", false)
+	conf.RootResponse = envString("S3_ROOT_RESPONSE", rootNotFound)
+	if err := checkRootResponse(conf.RootResponse); err != nil {
+		exitConfig("S3_ROOT_RESPONSE", err)
+	}
+	conf.StripTrailingSlash = envBool("S3_STRIP_TRAILING_SLASH", false)
+	conf.SignatureVersion = envString("S3_SIGNATURE_VERSION", "v4")
+	conf.AnonymousAccess = envBool("S3_ANONYMOUS_ACCESS", false)
+	conf.RequireCredentials = envBool("S3_REQUIRE_CREDENTIALS", true)
+	conf.AutoDetectRegion = envBool("S3_AUTO_DETECT_REGION", false)
 	conf.S3Timeout, _ = time.ParseDuration("5s")
-	conf.S3Retries =  5
-	conf.Concurrency =  0
-	conf.LogLevel = os.Getenv("S3_LOGLEVEL")
+	conf.S3Retries = RetryConfig{Timeout: 5}
+	if retries := os.Getenv("S3_RETRIES"); retries != "" {
+		rc, err := parseRetryConfig(retries)
+		if err != nil {
+			exitConfig("S3_RETRIES", err)
+		}
+		conf.S3Retries = rc
+	}
+	conf.S3KeepAlives = envBool("S3_KEEPALIVES", false)
+	conf.ConnCloseWarnRate = envFloat("S3_CONN_CLOSE_WARN_RATE", 0.5)
+	if conf.ConnCloseWarnRate < 0 || conf.ConnCloseWarnRate > 1 {
+		exitConfig("S3_CONN_CLOSE_WARN_RATE", fmt.Errorf("%v is not between 0 and 1", conf.ConnCloseWarnRate))
+	}
+	conf.MaxConnsPerHost = envInt("S3_MAX_CONNS_PER_HOST", 0)
+	conf.IdleConnSweepInterval = envDuration("S3_IDLE_CONN_SWEEP_INTERVAL", 0)
+	conf.S3UseTLS = envBool("S3_USE_TLS", false)
+	conf.S3MinTLSVersion = envString("S3_MIN_TLS_VERSION", "1.2")
+	conf.S3CipherSuites = os.Getenv("S3_CIPHER_SUITES")
+	conf.S3Endpoint = os.Getenv("S3_ENDPOINT")
+	eps, err := parseEndpoints(os.Getenv("S3_ENDPOINTS"))
+	if err != nil {
+		exitConfig("S3_ENDPOINTS", err)
+	}
+	conf.S3Endpoints = eps
+	// the first stands in for all of them where a custom endpoint matters
+	if len(eps) > 0 && conf.S3Endpoint == "" {
+		conf.S3Endpoint = eps[0]
+	}
+	conf.EndpointDownFor = envDuration("S3_ENDPOINT_DOWN_FOR", 10*time.Second)
+	reps, err := parseRegionWeights(os.Getenv("S3_REGION_WEIGHTS"))
+	if err != nil {
+		exitConfig("S3_REGION_WEIGHTS", err)
+	}
+	conf.RegionWeights = reps
+	conf.S3MaxRedirects = envInt("S3_MAX_REDIRECTS", 3)
+	if conf.S3MaxRedirects < 0 {
+		exitConfig("S3_MAX_REDIRECTS", fmt.Errorf("%d is negative", conf.S3MaxRedirects))
+	}
+	conf.S3Accelerate = envBool("S3_ACCELERATE", false)
+	conf.S3VirtualHosted = envBool("S3_VIRTUAL_HOSTED", false)
+	conf.AddressingFallback = envBool("S3_ADDRESSING_FALLBACK", false)
+	conf.ForwardQueryParams = strings.Split(envString("S3_FORWARD_QUERY_PARAMS", forwardQueryParamsDefault), ",")
+	if err := setQueryForward(conf.ForwardQueryParams); err != nil {
+		exitConfig("S3_FORWARD_QUERY_PARAMS", err)
+	}
+	conf.HeadFallbackToGet = envBool("S3_HEAD_FALLBACK_TO_GET", false)
+	conf.HeadLengthFallback = envBool("S3_HEAD_LENGTH_FALLBACK", false)
+	conf.ArchiveEnabled = envBool("S3_ARCHIVE_ENABLED", false)
+	conf.ArchiveMaxEntries = envInt("S3_ARCHIVE_MAX_ENTRIES", 100)
+	if conf.ArchiveEnabled && conf.ArchiveMaxEntries < 1 {
+		exitConfig("S3_ARCHIVE_MAX_ENTRIES", fmt.Errorf("%d is less than 1", conf.ArchiveMaxEntries))
+	}
+	conf.ArchiveMaxBytes = int64(envInt("S3_ARCHIVE_MAX_BYTES", 1<<30))
+	conf.MaxInflight = envInt("S3_MAX_INFLIGHT", 0)
+	conf.OverloadStatus = envInt("S3_OVERLOAD_STATUS", overloadStatusDefault)
+	if err := checkRejectStatus(conf.OverloadStatus); err != nil {
+		exitConfig("S3_OVERLOAD_STATUS", err)
+	}
+	conf.OverloadRetryAfter = envDuration("S3_OVERLOAD_RETRY_AFTER", time.Second)
+	conf.MaxS3Concurrency = envInt("S3_MAX_S3_CONCURRENCY", 0)
+	conf.MaxS3Queue = envInt("S3_MAX_S3_QUEUE", 0)
+	conf.ClientRateLimit = envFloat("S3_CLIENT_RATE_LIMIT", 0)
+	conf.ClientRateBurst = envInt("S3_CLIENT_RATE_BURST", int(math.Ceil(conf.ClientRateLimit)))
+	if conf.ClientRateLimit > 0 && conf.ClientRateBurst < 1 {
+		exitConfig("S3_CLIENT_RATE_BURST", fmt.Errorf("%d is less than 1", conf.ClientRateBurst))
+	}
+	conf.ThrottleStatus = envInt("S3_THROTTLE_STATUS", throttleStatusDefault)
+	if err := checkRejectStatus(conf.ThrottleStatus); err != nil {
+		exitConfig("S3_THROTTLE_STATUS", err)
+	}
+	conf.ThrottleRetryAfter = envDuration("S3_THROTTLE_RETRY_AFTER", 5*time.Second)
+	conf.TrustedProxyCIDRs = os.Getenv("S3_TRUSTED_PROXY_CIDRS")
+	conf.S3ClientCertFile = os.Getenv("S3_CLIENT_CERT_FILE")
+	conf.S3ClientKeyFile = os.Getenv("S3_CLIENT_KEY_FILE")
+	conf.S3CACertFile = os.Getenv("S3_CA_CERT_FILE")
+	conf.Concurrency = 0
+	conf.UseEnvProxy = envBool("S3_USE_ENV_PROXY", true)
+	conf.S3ProxyURL = os.Getenv("S3_PROXY_URL")
+	conf.AccessLogSink = os.Getenv("S3_ACCESS_LOG_SINK")
+	conf.AccessLogBatch = envInt("S3_ACCESS_LOG_BATCH", 100)
+	conf.AccessLogFormat = envString("S3_ACCESS_LOG_FORMAT", accessLogJSON)
+	if err := checkAccessLogFormat(conf.AccessLogFormat); err != nil {
+		exitConfig("S3_ACCESS_LOG_FORMAT", err)
+	}
+	conf.LogSampleRate = envFloat("S3_LOG_SAMPLE_RATE", 1)
+	if conf.LogSampleRate < 0 || conf.LogSampleRate > 1 {
+		exitConfig("S3_LOG_SAMPLE_RATE", fmt.Errorf("%v is not between 0 and 1", conf.LogSampleRate))
+	}
+	conf.SlowRequestThreshold = envDuration("S3_SLOW_REQUEST_THRESHOLD", 0)
+	conf.CloudFrontForwardID = envBool("S3_CLOUDFRONT_FORWARD_ID", false)
+	conf.CorrelationHeader = os.Getenv("S3_CORRELATION_HEADER")
+	conf.MetricsEnabled = envBool("S3_METRICS_ENABLED", false)
+	conf.MetricsNamespace = envString("S3_METRICS_NAMESPACE", "s3helper")
+	if err := checkMetricsNamespace(conf.MetricsNamespace); err != nil {
+		exitConfig("S3_METRICS_NAMESPACE", err)
+	}
+	conf.TracingEnabled = envBool("S3_TRACING_ENABLED", false)
+	buckets, err := parsePathBuckets(os.Getenv("S3_METRICS_PATH_BUCKETS"))
+	if err != nil {
+		exitConfig("S3_METRICS_PATH_BUCKETS", err)
+	}
+	conf.MetricsPathBuckets = buckets
+	conf.CacheTTL = envDuration("S3_CACHE_TTL", 0)
+	ttlRules, err := parseCacheTTLRules(os.Getenv("S3_CACHE_TTL_BY_PATH"))
+	if err != nil {
+		exitConfig("S3_CACHE_TTL_BY_PATH", err)
+	}
+	conf.CacheTTLByPath = ttlRules
+	ttlRules, err = parseCacheTTLRules(os.Getenv("S3_CACHE_TTL_BY_CONTENT_TYPE"))
+	if err != nil {
+		exitConfig("S3_CACHE_TTL_BY_CONTENT_TYPE", err)
+	}
+	conf.CacheTTLByContentType = ttlRules
+	conf.ETagShortCircuit = envBool("S3_ETAG_SHORT_CIRCUIT", false)
+	conf.CacheStatusHeader = envString("S3_CACHE_STATUS_HEADER", "X-Cache")
+	if conf.CacheStatusHeader == "off" {
+		conf.CacheStatusHeader = ""
+	}
+	conf.CacheMaxObjectSize = int64(envInt("S3_CACHE_MAX_OBJECT_SIZE", 0))
+	conf.CacheMaxBytes = int64(envInt("S3_CACHE_MAX_BYTES", 256<<20))
+	conf.CacheRangeMaxBytes = int64(envInt("S3_CACHE_RANGE_MAX_BYTES", 0))
+	conf.ServeStaleOnError = envBool("S3_SERVE_STALE_ON_ERROR", false)
+	conf.CacheMaxStale = envDuration("S3_CACHE_MAX_STALE", time.Hour)
+	rewrites, err := parseKeyRewriteRules(os.Getenv("S3_KEY_REWRITE_RULES"))
+	if err != nil {
+		exitConfig("S3_KEY_REWRITE_RULES", err)
+	}
+	conf.KeyRewriteRules = rewrites
+	routes, err := parseSegmentRoutes(os.Getenv("S3_SEGMENT_ROUTES"))
+	if err != nil {
+		exitConfig("S3_SEGMENT_ROUTES", err)
+	}
+	conf.SegmentRoutes = routes
+	conf.HTTP10MaxBuffer = int64(envInt("S3_HTTP10_MAX_BUFFER", 16<<20))
+	conf.ShortReadMaxBytes = int64(envInt("S3_SHORT_READ_MAX_BYTES", 0))
+	conf.NotFoundAlarmRate = envFloat("S3_NOT_FOUND_ALARM_RATE", 0)
+	if conf.NotFoundAlarmRate < 0 || conf.NotFoundAlarmRate > 1 {
+		exitConfig("S3_NOT_FOUND_ALARM_RATE", fmt.Errorf("%v is not between 0 and 1", conf.NotFoundAlarmRate))
+	}
+	conf.NotFoundAlarmWindow = envDuration("S3_NOT_FOUND_ALARM_WINDOW", time.Minute)
+	conf.NotFoundAlarmMinRequests = envInt("S3_NOT_FOUND_ALARM_MIN_REQUESTS", 20)
+	conf.MinObjectAge = envDuration("S3_MIN_OBJECT_AGE", 0)
+	conf.DirectAge = envBool("S3_DIRECT_AGE", false)
+	conf.VerifyChecksums = envBool("S3_VERIFY_CHECKSUMS", false)
+	conf.VerifyContentMD5 = envBool("S3_VERIFY_CONTENT_MD5", false)
+	conf.EnforceRange = os.Getenv("S3_ENFORCE_RANGE")
+	if err := checkEnforceRange(conf.EnforceRange); err != nil {
+		exitConfig("S3_ENFORCE_RANGE", err)
+	}
+	conf.SniffContentType = envBool("S3_SNIFF_CONTENT_TYPE", false)
+	conf.SniffMaxBytes = int64(envInt("S3_SNIFF_MAX_BYTES", 64<<20))
+	conf.CopyBufferSize = envInt("S3_COPY_BUFFER_SIZE", copyBufferSizeDefault)
+	conf.RangeChunkSize = int64(envInt("S3_RANGE_CHUNK_SIZE", 0))
+	conf.ManifestPrefetch.Depth = envInt("S3_MANIFEST_PREFETCH_DEPTH", 0)
+	conf.ManifestPrefetch.Concurrency = envInt("S3_MANIFEST_PREFETCH_CONCURRENCY", 4)
+	conf.PrefetchHints = envInt("S3_PREFETCH_HINTS", 0)
+	codecs, err := parseCodecs(os.Getenv("S3_COMPRESSION_CODECS"))
+	if err != nil {
+		exitConfig("S3_COMPRESSION_CODECS", err)
+	}
+	conf.CompressionCodecs = codecs
+	conf.CompressionLevel = envInt("S3_COMPRESSION_LEVEL", compressionLevelDefault)
+	if err := checkCompressionLevel(conf.CompressionLevel, conf.CompressionCodecs); err != nil {
+		exitConfig("S3_COMPRESSION_LEVEL", err)
+	}
+	conf.CompressTypes = strings.Split(envString("S3_COMPRESS_TYPES", compressTypesDefault), ",")
+	if vary := os.Getenv("S3_VARY_HEADERS"); vary != "" {
+		conf.VaryHeaders = strings.Split(vary, ",")
+	}
+	if hosts := os.Getenv("S3_ALLOWED_HOSTS"); hosts != "" {
+		conf.AllowedHosts = strings.Split(hosts, ",")
+	}
+	conf.MinimalHeaders = envBool("S3_MINIMAL_HEADERS", false)
+	conf.CompressMinBytes = int64(envInt("S3_COMPRESS_MIN_BYTES", 1024))
+	conf.CompressMaxBytes = int64(envInt("S3_COMPRESS_MAX_BYTES", 0))
+	conf.ChaosLatency = envDuration("S3_CHAOS_LATENCY", 0)
+	conf.ChaosErrorRate = envFloat("S3_CHAOS_ERROR_RATE", 0)
+	conf.ChaosAllowCIDRs = os.Getenv("S3_CHAOS_ALLOW_CIDRS")
+	conf.RetryOverrideCIDRs = os.Getenv("S3_RETRY_OVERRIDE_CIDRS")
+	conf.RetryOverrideMax = envInt("S3_RETRY_OVERRIDE_MAX", 10)
+	conf.AllowUploads = envBool("S3_ALLOW_UPLOADS", false)
+	conf.UploadCIDRs = envString("S3_UPLOAD_CIDRS", "127.0.0.1,::1")
+	conf.UploadMaxBytes = int64(envInt("S3_UPLOAD_MAX_BYTES", 64<<20))
+	conf.AllowDeletes = envBool("S3_ALLOW_DELETES", false)
+	conf.DeleteCIDRs = envString("S3_DELETE_CIDRS", "127.0.0.1,::1")
+	if conf.RetryOverrideMax < 0 {
+		exitConfig("S3_RETRY_OVERRIDE_MAX", fmt.Errorf("%d is negative", conf.RetryOverrideMax))
+	}
+	conf.DiagnosticsInterval = envDuration("S3_DIAGNOSTICS_INTERVAL", 0)
+	conf.SuccessStatuses = envString("S3_SUCCESS_STATUSES", successStatusesDefault)
+	statuses, err := parseStatusSet(conf.SuccessStatuses)
+	if err != nil {
+		exitConfig("S3_SUCCESS_STATUSES", err)
+	}
+	successStatuses = statuses
+	conf.WatchdogInterval = envDuration("S3_WATCHDOG_INTERVAL", 0)
+	conf.ShutdownTimeout = envDuration("S3_SHUTDOWN_TIMEOUT", 0)
+	conf.MaintenanceFile = os.Getenv("S3_MAINTENANCE_FILE")
+	conf.MaintenanceRetryAfter = envDuration("S3_MAINTENANCE_RETRY_AFTER", 5*time.Minute)
+	conf.ServiceName = envString("S3_SERVICE_NAME", serverName)
+	conf.Environment = os.Getenv("S3_ENVIRONMENT")
+	conf.LogLevel = envString("S3_LOGLEVEL", "info")
+	initLogLevel()
+	initLogFields()
 
 	log.Info().Msg("Starting up")
 	defer log.Info().Msg("Shutting down")
 
-	log.Info().Msg(fmt.Sprintf("S3Region: %s", conf.S3Region))
-	log.Info().Msg(fmt.Sprintf("S3Bucket: %s", conf.S3Bucket))
-	log.Info().Msg(fmt.Sprintf("LogLevel: %s", conf.LogLevel))
+	if conf.S3Region == "" {
+		region, source, err := resolveRegion()
+		if err != nil {
+			exitConfig("S3_REGION", err)
+		}
+		conf.S3Region = region
+		log.Info().Msg(fmt.Sprintf("Resolved region %s from %s", region, source))
+	}
+
+	if conf.S3Accelerate {
+		if err := checkAccelerate(); err != nil {
+			exitConfig("S3_ACCELERATE", err)
+		}
+		log.Info().Msg(fmt.Sprintf("Using transfer acceleration for bucket %s", conf.S3Bucket))
+	}
+	if conf.S3VirtualHosted && !conf.S3Accelerate {
+		if err := checkVirtualHosted(); err != nil {
+			exitConfig("S3_VIRTUAL_HOSTED", err)
+		}
+		log.Info().Msg(fmt.Sprintf("Addressing bucket %s as %s", conf.S3Bucket, s3VirtualHost(conf.S3Bucket)))
+	}
 
 	initRuntime()
+	initBucketRoutes()
+	initTrustedProxies()
+	initLimits()
+	initSigner()
+	initCredentials()
+	initProxy()
+	initTLS()
+	initS3Client()
+	initEndpoints()
+	initReplicas()
+	initChaos()
+	initRetryOverride()
+	initUploads()
+	initDeletes()
+	initMaintenance()
+	initNotFoundAlarm()
+	initS3Slots()
+	initDiagnostics()
+	checkBucketRegion()
+	logStartup()
+
+	initCache()
+
+	// prefetched segments have nowhere to go without a body cache
+	if conf.ManifestPrefetch.Depth > 0 && cache != nil && conf.CacheMaxObjectSize > 0 {
+		prefetch = newPrefetcher(conf.ManifestPrefetch.Concurrency)
+		log.Info().Msg(fmt.Sprintf("Prefetching %d segments per manifest with %d workers",
+			conf.ManifestPrefetch.Depth, conf.ManifestPrefetch.Concurrency))
+	}
+
+	if conf.AccessLogSink != "" {
+		al, err := newAccessLogger(conf.AccessLogSink, conf.AccessLogBatch, conf.AccessLogFormat)
+		if err != nil {
+			exitConfig("S3_ACCESS_LOG_SINK", err)
+		}
+		accessLog = al
+		defer accessLog.close()
+		log.Info().Msg(fmt.Sprintf("Writing %s access log to %s", conf.AccessLogFormat, conf.AccessLogSink))
+	}
 
 	// nr := newrelic.NewNewRelic(&conf.NewRelic)
 	mux := http.NewServeMux()
 
 	// mux.Handle(nr.MonitorHandler("/", http.HandlerFunc(forwardToS3)))
 	mux.Handle("/", http.HandlerFunc(forwardToS3))
+	if conf.ArchiveEnabled {
+		mux.Handle(archivePath, http.HandlerFunc(archiveHandler))
+		log.Info().Msg(fmt.Sprintf("Streaming archives of up to %d objects on %s", conf.ArchiveMaxEntries, archivePath))
+	}
 
 	if *pprofFlag {
 		mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
@@ -265,17 +1445,62 @@ func main() {
 		log.Info().Msg("pprof is enabled")
 	}
 
+	if conf.MetricsEnabled {
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.Handle("/debug/metrics", http.HandlerFunc(openMetricsHandler))
+		log.Info().Msg("metrics are enabled")
+	}
+
+	if conf.AdminListen != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/debug/inflight", http.HandlerFunc(inflightHandler))
+		admin.Handle("/stats", http.HandlerFunc(statsHandler))
+		admin.Handle("/cache/purge", http.HandlerFunc(purgeHandler))
+		admin.Handle("/debug/bundle", http.HandlerFunc(bundleHandler))
+		admin.Handle("/readyz", http.HandlerFunc(readyzHandler))
+		admin.Handle("/admin/drain", http.HandlerFunc(drainHandler))
+		admin.Handle("/admin/undrain", http.HandlerFunc(undrainHandler))
+		admin.Handle("/admin/maintenance", http.HandlerFunc(maintenanceHandler))
+
+		initAdminAllow()
+		startAdmin(conf.AdminListen, rejectTrace(checkAdminClient(admin)))
+	}
+
 	log.Info().Msg(fmt.Sprintf("Accepting connections on %v", conf.Listen))
 
+	server := &http.Server{
+		Addr:           conf.Listen,
+		Handler:        rejectTrace(checkHost(mux)),
+		MaxHeaderBytes: conf.MaxHeaderBytes,
+	}
+	mainServer = server
+
 	go func() {
-		errLNS := http.ListenAndServe(conf.Listen, mux)
-		if errLNS != nil {
+		errLNS := server.ListenAndServe()
+		if errLNS != nil && errLNS != http.ErrServerClosed {
 			log.Error().Msg(fmt.Sprintf("Failure starting up %v", errLNS))
 			os.Exit(1)
 		}
 	}()
 
-	stopSignals := make(chan os.Signal, 1)
-	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
-	<-stopSignals
+	initWatchdog()
+
+	// SIGHUP reloads when there is something to reload, and stops us
+	// like the others otherwise
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
+	// as does the end of a drain that asked for it
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP || !reloadable() {
+				break wait
+			}
+			reload()
+		case <-drainShutdown:
+			break wait
+		}
+	}
+	shutdown(server)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// captureLog collects the log lines written until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prev := log.Logger
+	t.Cleanup(func() { log.Logger = prev })
+	log.Logger = zerolog.New(&buf)
+	return &buf
+}
+
+// logged returns the fields of the first line logged with msg, or nil
+func logged(logs *bytes.Buffer, msg string) map[string]interface{} {
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(line), &fields) == nil && fields["message"] == msg {
+			return fields
+		}
+	}
+	return nil
+}
+
+func TestChunkedWithoutContentLength(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/show/ep1.ts" {
+			t.Errorf("S3 asked for %s", r.URL.Path)
+		}
+		// flushing before the end leaves S3's length unknown
+		w.Write([]byte("01234"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("56789"))
+	}))
+
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("got %d %q, want the whole body", w.Code, w.Body.String())
+	}
+	if cl, ok := w.Header()["Content-Length"]; ok {
+		t.Errorf("Content-Length %q passed on for a chunked body", cl)
+	}
+}
+
+func TestContentLengthForwarded(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("0123456789"))
+	}))
+
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Header().Get("Content-Length") != "10" || w.Body.String() != "0123456789" {
+		t.Errorf("got length %q %q", w.Header().Get("Content-Length"), w.Body.String())
+	}
+}
+
+func TestHTTP10GetsContentLength(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write([]byte("#EXTM3U\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("#EXTINF:6,\nseg.ts\n", 100)))
+	}))
+	conf.HTTP10MaxBuffer = 4096
+	conf.CompressionCodecs = []string{"gzip"}
+	conf.CompressTypes = strings.Split(compressTypesDefault, ",")
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/show/index.m3u8", nil)
+		r.Proto, r.ProtoMinor = "HTTP/1.0", 0
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		forwardToS3(w, r)
+		return w
+	}
+
+	w := get()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("got %d with Content-Length %q for %d bytes", w.Code, w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("HTTP/1.0 response compressed with %s", ce)
+	}
+
+	conf.HTTP10MaxBuffer = 100
+	if w := get(); w.Code != http.StatusBadGateway {
+		t.Errorf("body over the buffer limit got %d, want a 502", w.Code)
+	}
+}
+
+func TestHeadForwarded(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("got a %s, want the HEAD passed on", r.Method)
+		}
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("Content-Range", "bytes 2-5/10")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	logs := captureLog(t)
+
+	w := serve("HEAD", "/show/ep1.ts", http.Header{"Range": {"bytes=2-5"}})
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 0 {
+		t.Errorf("got %d with %d bytes, want a bodiless 206", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("Content-Length") != "4" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("headers %v", w.Header())
+	}
+	fields := logged(logs, "Forwarded HEAD response")
+	if fields == nil || fields["content-length"] != 4.0 || fields["content-range"] != "bytes 2-5/10" {
+		t.Errorf("HEAD logged as %v, want its length and range", fields)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/crunchyroll/go-aws-auth"
+	"github.com/rs/zerolog/log"
+)
+
+// s3Scheme is the URL scheme used to reach S3
+func s3Scheme() string {
+	if conf.S3UseTLS {
+		return "https"
+	}
+	return "http"
+}
+
+// s3URL maps an object path, rewritten by KeyRewriteRules, onto its URL
+// in the S3 bucket, or in the bucket its route points at
+func s3URL(upath string) string {
+	upath = rewriteKey(upath)
+	bucket, key := conf.S3Bucket, conf.S3Path+upath
+	if b, k, ok := routeBucket(upath); ok {
+		bucket, key = b, k
+	}
+	return s3ObjectURL(bucket, key)
+}
+
+// s3ObjectURL addresses key, which starts with a "/", in bucket
+func s3ObjectURL(bucket, key string) string {
+	// built by concatenation rather than fmt as this runs for every
+	// request, at least once
+	if endpoints != nil {
+		return endpoints.pick(bucket+key) + "/" + bucket + escapeKey(key)
+	}
+	if conf.S3Endpoint != "" {
+		return strings.TrimRight(conf.S3Endpoint, "/") + "/" + bucket + escapeKey(key)
+	}
+	if conf.S3Accelerate {
+		return s3Scheme() + "://" + bucket + ".s3-accelerate.amazonaws.com" + escapeKey(key)
+	}
+	if conf.S3VirtualHosted {
+		return s3Scheme() + "://" + s3VirtualHost(bucket) + escapeKey(key)
+	}
+	return s3Scheme() + "://s3." + conf.S3Region + ".amazonaws.com/" + bucket + escapeKey(key)
+}
+
+// escapeKey escapes each segment of key for the path of an S3 URL, so
+// that nothing in it can be taken for a query or a fragment.  Parsing the
+// URL gives back the key as Path, with this escaping as RawPath.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// errInvalidKey is returned for object keys that can't be passed on to S3
+var errInvalidKey = errors.New("invalid object key")
+
+// checkKey refuses keys with a "?" or "#".  Clients only get those into
+// a path by escaping them, and such a key is far more likely an attempt
+// to smuggle a query past ForwardQueryParams than a real object.
+func checkKey(upath string) error {
+	if strings.ContainsAny(upath, "?#") {
+		return fmt.Errorf("%w %q", errInvalidKey, upath)
+	}
+	return nil
+}
+
+// checkObjectKey refuses keys an upload or delete can't be meant for:
+// none at all or "/", which would address the bucket itself, ones ending
+// in "/", which name a prefix rather than an object, and those checkKey
+// refuses
+func checkObjectKey(upath string) error {
+	if upath == "" || strings.HasSuffix(upath, "/") {
+		return fmt.Errorf("%w %q", errInvalidKey, upath)
+	}
+	return checkKey(upath)
+}
+
+// checkAccelerate makes sure transfer acceleration can be used with the
+// configured bucket
+func checkAccelerate() error {
+	if conf.S3Endpoint != "" {
+		return fmt.Errorf("transfer acceleration is not available with a custom endpoint")
+	}
+	return checkAccelerateBucket(conf.S3Bucket)
+}
+
+// checkAccelerateBucket makes sure bucket, the configured one or that of a
+// route, can be used with transfer acceleration
+func checkAccelerateBucket(bucket string) error {
+	// the bucket name becomes part of the host name
+	if strings.Contains(bucket, ".") {
+		return fmt.Errorf("bucket %q contains dots, which transfer acceleration doesn't allow", bucket)
+	}
+	return nil
+}
+
+// S3 GET query parameters forwarded unless configured otherwise
+const forwardQueryParamsDefault = "partNumber,versionId,response-content-disposition,response-content-type"
+
+// S3 GET query parameters passed through from the client request, set up
+// by setQueryForward
+var queryForward = map[string]bool{
+	"partNumber": true,
+	"versionId":  true,
+
+	// S3 echoes these into the response headers, e.g. for a download
+	// filename prompt
+	"response-content-disposition": true,
+	"response-content-type":        true,
+}
+
+// setQueryForward sets the query parameters passed on to S3.  Anything
+// else, e.g. cache busting parameters, is dropped.
+func setQueryForward(names []string) error {
+	allow := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// these belong to the signature we add ourselves
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			return fmt.Errorf("query parameter %q can't be forwarded", name)
+		}
+		allow[name] = true
+	}
+	queryForward = allow
+	return nil
+}
+
+// forwardQuery picks the query parameters of a client request that are
+// passed on to S3
+func forwardQuery(r *http.Request) (url.Values, error) {
+	// most requests have no query, which needn't be parsed
+	if r.URL.RawQuery == "" {
+		return nil, nil
+	}
+	query := url.Values{}
+	for name, values := range r.URL.Query() {
+		if !queryForward[name] || len(values) == 0 {
+			continue
+		}
+		query.Set(name, values[0])
+	}
+	if pn := query.Get("partNumber"); pn != "" {
+		if n, err := strconv.Atoi(pn); err != nil || n < 1 || n > 10000 {
+			return nil, fmt.Errorf("invalid partNumber %q", pn)
+		}
+	}
+	// the overrides end up as response headers so they have to be well
+	// formed, and a disposition can only be inline or an attachment
+	if cd := query.Get("response-content-disposition"); cd != "" {
+		if d, _, err := mime.ParseMediaType(cd); err != nil || (d != "attachment" && d != "inline") {
+			return nil, fmt.Errorf("invalid response-content-disposition %q", cd)
+		}
+	}
+	if ct := query.Get("response-content-type"); ct != "" {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return nil, fmt.Errorf("invalid response-content-type %q", ct)
+		}
+	}
+	return query, nil
+}
+
+// newS3Request creates a signed request for the object at upath.  The
+// query is added before signing so it is covered by the signature.  It
+// fails with errNoCredentials while there is nothing valid to sign with,
+// and with errInvalidKey for a key checkKey refuses.
+func newS3Request(method, upath string, query url.Values) (*http.Request, error) {
+	if err := checkKey(upath); err != nil {
+		return nil, err
+	}
+	u := s3URL(upath)
+	if replicas != nil && (method == "GET" || method == "HEAD") {
+		u = replicas.route(u)
+	}
+	r2, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the query is only ever the filtered one, spaces sent as %20, which
+	// is how SigV4 canonicalizes them
+	r2.URL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	// S3 only returns checksums when asked, and the header has to be signed
+	if conf.VerifyChecksums && method == "GET" {
+		r2.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	}
+	if r2, err = signRequest(r2); err != nil {
+		return nil, err
+	}
+	r2.Header.Set("Host", r2.URL.Host)
+	return r2, nil
+}
+
+// signRequest signs req with the current credentials, for the region of
+// the replica it is addressed to if any
+func signRequest(req *http.Request) (*http.Request, error) {
+	return signRequestFor(req, regionFor(req))
+}
+
+// signRequestFor signs req for region with the current credentials
+func signRequestFor(req *http.Request, region string) (*http.Request, error) {
+	var creds awsauth.Credentials
+	if !conf.AnonymousAccess {
+		c, err := credentials.get()
+		if err != nil {
+			return nil, err
+		}
+		creds = c
+	}
+	return signer.Sign(req, region, "s3", creds), nil
+}
+
+// Headers making up a request's signature
+var signatureHeaders = []string{"Authorization", "X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token",
+	"X-Amz-Region-Set", "Date"}
+
+// clearSignature drops the signature of a request about to be signed for
+// somewhere else
+func clearSignature(req *http.Request) {
+	for _, name := range signatureHeaders {
+		req.Header.Del(name)
+	}
+}
+
+// readdress points req at u, Host included.  The signer takes the host
+// from req.Host, so it has to be in place before req is signed again.
+func readdress(req *http.Request, u *url.URL) {
+	req.URL = u
+	req.Host = u.Host
+	req.Header.Set("Host", u.Host)
+}
+
+// s3CheckRedirect follows up to S3MaxRedirects redirects from S3, signing
+// the request afresh for each hop as the signature covers the host.  The
+// redirect response itself is returned once they are used up, or right
+// away when S3MaxRedirects is 0.
+func s3CheckRedirect(req *http.Request, via []*http.Request) error {
+	prev := via[len(via)-1]
+	if len(via) > conf.S3MaxRedirects {
+		log.Warn().
+			Str("url", prev.URL.String()).
+			Str("location", req.URL.String()).
+			Msg(fmt.Sprintf("Not following S3 redirect, %d allowed", conf.S3MaxRedirects))
+		return http.ErrUseLastResponse
+	}
+
+	// S3 names the bucket's region when that is why it redirects
+	region := conf.S3Region
+	if req.Response != nil {
+		if r := req.Response.Header.Get("X-Amz-Bucket-Region"); r != "" {
+			region = r
+		}
+	}
+	// the client leaves Host empty on a hop to another host
+	readdress(req, req.URL)
+	clearSignature(req)
+	signed, err := signRequestFor(req, region)
+	if err != nil {
+		return err
+	}
+	req.Header = signed.Header
+	log.Info().
+		Str("url", prev.URL.String()).
+		Str("location", req.URL.String()).
+		Int("hop", len(via)).
+		Msg("Following S3 redirect")
+	return nil
+}
+
+// The client shared by all requests to S3, set up by initS3Client and
+// replaced as a whole by reloadS3Client
+var s3Client atomic.Pointer[http.Client]
+
+// A replaced transport's idle connections are closed this often until the
+// requests still using it are done
+const retireInterval = 10 * time.Second
+
+// newS3Client creates a client for requests to S3
+func newS3Client() *http.Client {
+	transport := &countedTransport{}
+	transport.Transport = &http.Transport{
+		Proxy: s3Proxy,
+		DialContext: countConns(&transport.open, (&net.Dialer{
+			Timeout:   conf.S3Timeout,
+			KeepAlive: 1 * time.Second,
+		}).DialContext),
+		IdleConnTimeout:   conf.S3Timeout,
+		DisableKeepAlives: !conf.S3KeepAlives, // terminates open connections
+		MaxConnsPerHost:   conf.MaxConnsPerHost,
+		TLSClientConfig:   s3TLS.Load().Clone(),
+	}
+	return &http.Client{Transport: transport, CheckRedirect: s3CheckRedirect}
+}
+
+// initS3Client sets up the shared S3 client, and the sweeper for its
+// idle connections when configured
+func initS3Client() {
+	s3Client.Store(newS3Client())
+	if conf.MaxConnsPerHost > 0 {
+		log.Info().Msg(fmt.Sprintf("Limiting S3 connections to %d per host", conf.MaxConnsPerHost))
+	}
+
+	if conf.S3KeepAlives && conf.IdleConnSweepInterval > 0 {
+		go sweepIdleConns(conf.IdleConnSweepInterval)
+		log.Info().Msg(fmt.Sprintf("Closing idle S3 connections every %v", conf.IdleConnSweepInterval))
+	}
+}
+
+// reloadS3Client rebuilds the S3 client from the current settings,
+// rereading the TLS certificate files, and swaps it in for new requests.
+// Requests under way finish on the old one, whose connections are closed
+// as they become idle.
+func reloadS3Client() error {
+	cfg, err := loadTLS()
+	if err != nil {
+		return err
+	}
+	s3TLS.Store(cfg)
+	old := s3Client.Swap(newS3Client())
+	log.Info().Msg("Rebuilt the S3 client")
+	if old != nil {
+		go retireS3Client(old)
+	}
+	return nil
+}
+
+// retireS3Client closes a replaced client's connections once nothing uses
+// them anymore
+func retireS3Client(client *http.Client) {
+	transport := client.Transport.(*countedTransport)
+	for {
+		transport.CloseIdleConnections()
+		if transport.open.Load() == 0 {
+			return
+		}
+		time.Sleep(retireInterval)
+	}
+}
+
+// sweepIdleConns periodically closes the idle connections of the S3
+// client so that they don't pile up during quiet periods
+func sweepIdleConns(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s3Client.Load().CloseIdleConnections()
+		log.Debug().Msg("Closed idle S3 connections")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crunchyroll/go-aws-auth"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// hostSigner records the host each request was signed for, which is how
+// go-aws-auth picks it: from req.Host
+type hostSigner struct {
+	signed []string
+}
+
+func (s *hostSigner) Sign(req *http.Request, region, service string, creds awsauth.Credentials) *http.Request {
+	s.signed = append(s.signed, req.Host)
+	req.Header.Set("Authorization", "signed for "+req.Host+" in "+region)
+	return req
+}
+
+// useSigner signs requests with s, without credentials, until the test
+// ends
+func useSigner(t testing.TB, s Signer) {
+	prevSigner, prevAnon := signer, conf.AnonymousAccess
+	signer, conf.AnonymousAccess = s, true
+	t.Cleanup(func() { signer, conf.AnonymousAccess = prevSigner, prevAnon })
+}
+
+// mockS3 serves the bucket "bucket" from handler in place of S3 until the
+// test ends, by proxying S3 traffic to it, with requests left unsigned.
+// The configuration and the cache are restored afterwards.
+func mockS3(t testing.TB, handler http.Handler) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	prevConf, prevCache, prevProxy := conf, cache, s3Proxy
+	prevClient, prevEndpoints, prevReplicas := s3Client.Load(), endpoints, replicas
+	t.Cleanup(func() {
+		srv.Close()
+		conf, cache, s3Proxy = prevConf, prevCache, prevProxy
+		s3Client.Store(prevClient)
+		endpoints, replicas = prevEndpoints, prevReplicas
+	})
+	useSigner(t, anonymousSigner{})
+	u, _ := url.Parse(srv.URL)
+	s3Proxy = http.ProxyURL(u)
+	conf.S3Bucket = "bucket"
+	conf.S3Region = "us-east-1"
+	conf.S3Timeout = 5 * time.Second
+	conf.S3Retries = RetryConfig{Timeout: 2, Server: 2, Connection: 2}
+	conf.LogSampleRate = 1
+	cache, endpoints, replicas = nil, nil, nil
+	s3Client.Store(newS3Client())
+	return srv
+}
+
+// serve sends a client request through forwardToS3
+func serve(method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	forwardToS3(w, r)
+	return w
+}
+
+func TestPartNumberForwarded(t *testing.T) {
+	var query string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte("part"))
+	}))
+
+	w := serve("GET", "/show/ep1.mp4?partNumber=2&x-id=GetObject", nil)
+	if w.Code != http.StatusOK || query != "partNumber=2" {
+		t.Errorf("got %d with S3 query %q, want only partNumber=2", w.Code, query)
+	}
+
+	for _, pn := range []string{"0", "10001", "two"} {
+		query = ""
+		if w := serve("GET", "/show/ep1.mp4?partNumber="+pn, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("partNumber=%s got %d, want a 400", pn, w.Code)
+		}
+		if query != "" {
+			t.Errorf("partNumber=%s reached S3", pn)
+		}
+	}
+}
+
+func TestVersionIdForwarded(t *testing.T) {
+	var query string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("X-Amz-Version-Id", "abc")
+		w.Write([]byte("v"))
+	}))
+
+	w := serve("GET", "/show/ep1.ts?versionId=abc", nil)
+	if query != "versionId=abc" {
+		t.Errorf("S3 query %q, want versionId=abc", query)
+	}
+	if v := w.Header().Get("X-Amz-Version-Id"); v != "abc" {
+		t.Errorf("X-Amz-Version-Id %q, want abc", v)
+	}
+}
+
+func TestResponseOverridesForwarded(t *testing.T) {
+	var query string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Disposition", r.URL.Query().Get("response-content-disposition"))
+		w.Write([]byte("v"))
+	}))
+
+	w := serve("GET", "/show/ep1.mp4?response-content-disposition=attachment%3B%20filename%3D%22ep%201.mp4%22", nil)
+	if query != "response-content-disposition=attachment%3B%20filename%3D%22ep%201.mp4%22" {
+		t.Errorf("S3 query %q", query)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="ep 1.mp4"` {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+
+	for _, q := range []string{
+		"response-content-disposition=evil",
+		"response-content-disposition=attachment%3B%20filename",
+		"response-content-type=text%2F",
+	} {
+		query = ""
+		if w := serve("GET", "/show/ep1.mp4?"+q, nil); w.Code != http.StatusBadRequest || query != "" {
+			t.Errorf("%s got %d, want a 400 without asking S3", q, w.Code)
+		}
+	}
+}
+
+func TestKeyEscaped(t *testing.T) {
+	var path, rawPath, query string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, rawPath, query = r.URL.Path, r.URL.EscapedPath(), r.URL.RawQuery
+	}))
+
+	w := serve("GET", "/show/ep%201;v=2%25.ts", nil)
+	if w.Code != http.StatusOK || path != "/bucket/show/ep 1;v=2%.ts" || query != "" {
+		t.Errorf("got %d with S3 path %q query %q", w.Code, path, query)
+	}
+	if rawPath != "/bucket/show/ep%201%3Bv=2%25.ts" {
+		t.Errorf("S3 got escaped path %q", rawPath)
+	}
+}
+
+func TestQueryInKeyRejected(t *testing.T) {
+	var calls int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	prev := queryForward
+	t.Cleanup(func() { queryForward = prev })
+	if err := setQueryForward([]string{"partNumber"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a ListObjects of the bucket, and a versionId ForwardQueryParams drops
+	for _, target := range []string{"/%3Flist-type=2", "/seg.ts%3FversionId=abc", "/seg.ts%23frag"} {
+		if w := serve("GET", target, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want a 400", target, w.Code)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("S3 got %d requests", calls)
+	}
+}
+
+// regionSigner marks requests with the region they were signed for
+type regionSigner struct{}
+
+func (regionSigner) Sign(req *http.Request, region, service string, creds awsauth.Credentials) *http.Request {
+	req.Header.Set("Authorization", "signed in "+region)
+	return req
+}
+
+func TestRedirectsResigned(t *testing.T) {
+	var signed []string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed = append(signed, r.Host+" "+r.Header.Get("Authorization"))
+		if r.URL.Path == "/bucket/show/old.ts" {
+			w.Header().Set("Location", "http://s3.eu-west-1.amazonaws.com/bucket/show/new.ts")
+			w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte("moved"))
+	}))
+	useSigner(t, regionSigner{})
+	conf.S3MaxRedirects = 3
+	s3Client.Store(newS3Client())
+
+	w := serve("GET", "/show/old.ts", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "moved" {
+		t.Errorf("got %d %q, want the redirect followed", w.Code, w.Body.String())
+	}
+	if len(signed) != 2 || signed[1] != "s3.eu-west-1.amazonaws.com signed in eu-west-1" {
+		t.Errorf("S3 got %q, want the hop signed for the bucket's region", signed)
+	}
+}
+
+func TestRedirectsDisallowed(t *testing.T) {
+	var fetches int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		http.Redirect(w, r, "/bucket/show/new.ts", http.StatusTemporaryRedirect)
+	}))
+	conf.S3MaxRedirects = 0
+	s3Client.Store(newS3Client())
+
+	w := serve("GET", "/show/old.ts", nil)
+	if w.Code != http.StatusTemporaryRedirect || fetches != 1 {
+		t.Errorf("got %d after %d fetches, want S3's redirect passed on untouched", w.Code, fetches)
+	}
+}
+
+func TestAccelerateEndpoint(t *testing.T) {
+	var host, path string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, path = r.Host, r.URL.Path
+	}))
+	conf.S3Accelerate = true
+
+	serve("GET", "/show/ep1.ts", nil)
+	if host != "bucket.s3-accelerate.amazonaws.com" || path != "/show/ep1.ts" {
+		t.Errorf("S3 asked for %s%s, want the bucket's accelerate endpoint", host, path)
+	}
+
+	if err := checkAccelerate(); err != nil {
+		t.Errorf("bucket refused: %v", err)
+	}
+	conf.S3Bucket = "media.example.com"
+	if err := checkAccelerate(); err == nil {
+		t.Error("bucket with dots accepted")
+	}
+	conf.S3Bucket, conf.S3Endpoint = "bucket", "http://minio.internal:9000"
+	if err := checkAccelerate(); err == nil {
+		t.Error("custom endpoint accepted")
+	}
+}
+
+// initTestS3Client sets up the shared S3 client for the test
+func initTestS3Client(t testing.TB) {
+	prev := s3Client.Load()
+	s3Client.Store(newS3Client())
+	t.Cleanup(func() { s3Client.Store(prev) })
+}
+
+func TestRedirectSignedForNewHost(t *testing.T) {
+	s := &hostSigner{}
+	useSigner(t, s)
+	defer func(n int) { conf.S3MaxRedirects = n }(conf.S3MaxRedirects)
+	conf.S3MaxRedirects = 3
+
+	prev, _ := http.NewRequest("GET", "http://s3.us-east-1.amazonaws.com/bucket/key", nil)
+	// the client leaves Host empty on a hop to another host
+	u, _ := url.Parse("http://s3.eu-west-1.amazonaws.com/bucket/key")
+	req := &http.Request{Method: "GET", URL: u, Header: http.Header{}, Response: &http.Response{
+		Header: http.Header{"X-Amz-Bucket-Region": {"eu-west-1"}},
+	}}
+	if err := s3CheckRedirect(req, []*http.Request{prev}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.signed) != 1 || s.signed[0] != u.Host {
+		t.Errorf("signed for %q, want %q", s.signed, u.Host)
+	}
+	if got := req.Header.Get("Authorization"); got != "signed for "+u.Host+" in eu-west-1" {
+		t.Errorf("Authorization = %q", got)
+	}
+}
+
+func TestReloadWhileBuildingClients(t *testing.T) {
+	mockS3(t, http.NotFoundHandler())
+	conf.S3MinTLSVersion = "1.2"
+	prev := s3TLS.Load()
+	t.Cleanup(func() { s3TLS.Store(prev) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			newS3Client()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := reloadS3Client(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if s3TLS.Load().MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x after reload", s3TLS.Load().MinVersion)
+	}
+}
+
+// BenchmarkForwardGet measures the allocations of a plain GET of a
+// manifest, the bulk of our requests, through to a mock S3
+func BenchmarkForwardGet(b *testing.B) {
+	mockS3(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Content-Length", "24")
+		w.Write([]byte("#EXTM3U\n#EXT-X-ENDLIST\n\n"))
+	}))
+	prevLogger := log.Logger
+	b.Cleanup(func() { log.Logger = prevLogger })
+	log.Logger = zerolog.New(io.Discard).With().Timestamp().Logger()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if w := serve("GET", "/show/ep1/index.m3u8", nil); w.Code != http.StatusOK {
+			b.Fatalf("got %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errS3Busy is returned by doS3 when MaxS3Concurrency fetches are
+// outstanding and no slot came free in time
+var errS3Busy = errors.New("too many concurrent S3 fetches")
+
+// Slots for the fetches from S3 under way, both requests and their
+// bodies, nil when MaxS3Concurrency is off
+var s3Slots chan struct{}
+
+// Fetches waiting for a slot, up to MaxS3Queue
+var s3Waiting atomic.Int64
+
+// initS3Slots sets up the bound on concurrent S3 fetches
+func initS3Slots() {
+	if conf.MaxS3Concurrency <= 0 {
+		return
+	}
+	s3Slots = make(chan struct{}, conf.MaxS3Concurrency)
+	log.Info().Msg(fmt.Sprintf("Limiting S3 to %d concurrent fetches, %d more queued",
+		conf.MaxS3Concurrency, conf.MaxS3Queue))
+}
+
+// acquireS3Slot takes a slot for a fetch from S3, returning a function to
+// give it back.  When they are all taken it waits up to S3Timeout if
+// fewer than MaxS3Queue are waiting already, and fails with errS3Busy
+// otherwise.
+func acquireS3Slot(req *http.Request) (func(), error) {
+	if s3Slots == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		<-s3Slots
+		metricS3Outstanding.Add(-1)
+	}
+	select {
+	case s3Slots <- struct{}{}:
+		metricS3Outstanding.Add(1)
+		return release, nil
+	default:
+	}
+
+	if s3Waiting.Add(1) > int64(conf.MaxS3Queue) {
+		s3Waiting.Add(-1)
+		metricS3Shed.Add(1)
+		return nil, errS3Busy
+	}
+	defer s3Waiting.Add(-1)
+	metricS3Queued.Add(1)
+	defer metricS3Queued.Add(-1)
+
+	var timeout <-chan time.Time
+	if conf.S3Timeout > 0 {
+		timer := time.NewTimer(conf.S3Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case s3Slots <- struct{}{}:
+		metricS3Outstanding.Add(1)
+		return release, nil
+	case <-timeout:
+	case <-req.Context().Done():
+	}
+	metricS3Shed.Add(1)
+	return nil, errS3Busy
+}
+
+// slotBody gives a fetch's slot back once its body is closed
+type slotBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
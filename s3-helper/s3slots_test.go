@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestS3ConcurrencyCapped(t *testing.T) {
+	unblock := make(chan struct{})
+	var fetches atomic.Int32
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.URL.Path == "/bucket/show/slow.ts" {
+			<-unblock
+		}
+		w.Write([]byte("ok"))
+	}))
+	prev := s3Slots
+	t.Cleanup(func() { s3Slots = prev })
+	conf.MaxS3Concurrency = 1
+	conf.OverloadStatus = http.StatusServiceUnavailable
+	conf.OverloadRetryAfter = 2 * time.Second
+	initS3Slots()
+
+	// slowFetch takes the only slot until unblocked
+	slowFetch := func() chan int {
+		done := make(chan int)
+		go func() { done <- serve("GET", "/show/slow.ts", nil).Code }()
+		for len(s3Slots) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return done
+	}
+
+	// with no queue a fetch over the limit is shed, and not retried
+	slow := slowFetch()
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("got %d with Retry-After %q, want a 503 after 2s", w.Code, w.Header().Get("Retry-After"))
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("S3 asked %d times, want only the slow fetch", n)
+	}
+	unblock <- struct{}{}
+	<-slow
+
+	// a queued one waits for the slot
+	conf.MaxS3Queue = 1
+	slow = slowFetch()
+	queued := make(chan int)
+	go func() { queued <- serve("GET", "/show/ep1.ts", nil).Code }()
+	for metricS3Queued.Value() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	unblock <- struct{}{}
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("slow fetch got %d", code)
+	}
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("queued fetch got %d", code)
+	}
+	if len(s3Slots) != 0 {
+		t.Errorf("%d slots still held", len(s3Slots))
+	}
+}
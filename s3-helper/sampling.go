@@ -0,0 +1,12 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// logSampled decides whether a request is logged in full, which happens
+// for a LogSampleRate share of them.  Warnings, errors and error responses
+// are logged for every request regardless.
+func logSampled() bool {
+	return conf.LogSampleRate >= 1 || rand.Float64() < conf.LogSampleRate
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUnsampledRequestsLogFailuresOnly(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/missing.ts" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	prev := accessLog
+	t.Cleanup(func() { accessLog = prev })
+	accessLog = &accessLogger{records: make(chan accessRecord, 10)}
+	logs := captureLog(t)
+	conf.LogSampleRate = 0
+
+	serve("GET", "/show/ep1.ts", nil)
+	serve("GET", "/missing.ts", nil)
+	if fields := logged(logs, "Request started"); fields != nil {
+		t.Errorf("unsampled request logged at info: %v", fields)
+	}
+	if len(accessLog.records) != 1 {
+		t.Fatalf("%d access records, want only the failure", len(accessLog.records))
+	}
+	if rec := <-accessLog.records; rec.Status != http.StatusNotFound {
+		t.Errorf("access logged a %d, want the 404", rec.Status)
+	}
+
+	conf.LogSampleRate = 1
+	serve("GET", "/show/ep1.ts", nil)
+	if logged(logs, "Request started") == nil || len(accessLog.records) != 1 {
+		t.Error("sampled request not logged in full")
+	}
+}
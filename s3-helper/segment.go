@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// segmentRoute lets clients on matching paths ask for a fixed size slice
+// of an object by index, "?segment=N", instead of by byte range.  Size is
+// the slice size in bytes; when zero the client has to pass "&size=M".
+type segmentRoute struct {
+	Pattern string
+	Size    int64
+}
+
+// parseSegmentRoutes parses a comma separated list of pattern=size pairs,
+// a pattern on its own leaves the size to the client
+func parseSegmentRoutes(s string) ([]segmentRoute, error) {
+	var routes []segmentRoute
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sr := segmentRoute{Pattern: item}
+		if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+			size, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid segment size %q", kv[1])
+			}
+			sr = segmentRoute{Pattern: strings.TrimSpace(kv[0]), Size: size}
+		}
+		if _, err := path.Match(sr.Pattern, ""); err != nil || sr.Pattern == "" {
+			return nil, fmt.Errorf("invalid pattern %q", sr.Pattern)
+		}
+		routes = append(routes, sr)
+	}
+	return routes, nil
+}
+
+// segmentByteRange turns segment index n of size bytes into a byte range
+func segmentByteRange(n, size int64) (string, error) {
+	if n > (math.MaxInt64-size)/size {
+		return "", fmt.Errorf("segment %d out of bounds", n)
+	}
+	first := n * size
+	return fmt.Sprintf("bytes=%d-%d", first, first+size-1), nil
+}
+
+// segmentRange translates the segment index of a request on a segment
+// route into a byte range.  It returns "" when the request doesn't ask for
+// a segment.  On failure the status to answer with is returned as well:
+// 400 for malformed requests, 416 for indices out of bounds.
+func segmentRange(upath string, query url.Values, byterange string) (string, int, error) {
+	seg := query.Get("segment")
+	if seg == "" {
+		return "", 0, nil
+	}
+	var route *segmentRoute
+	for i := range conf.SegmentRoutes {
+		if pathMatch(conf.SegmentRoutes[i].Pattern, upath) {
+			route = &conf.SegmentRoutes[i]
+			break
+		}
+	}
+	if route == nil {
+		return "", 0, nil
+	}
+	if byterange != "" {
+		return "", http.StatusBadRequest, fmt.Errorf("segment and Range can't be combined")
+	}
+
+	size := route.Size
+	if s := query.Get("size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return "", http.StatusBadRequest, fmt.Errorf("invalid segment size %q", s)
+		}
+		size = n
+	}
+	if size <= 0 {
+		return "", http.StatusBadRequest, fmt.Errorf("no segment size")
+	}
+	n, err := strconv.ParseInt(seg, 10, 64)
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid segment %q", seg)
+	}
+	if n < 0 {
+		return "", http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("segment %d out of bounds", n)
+	}
+	rng, err := segmentByteRange(n, size)
+	if err != nil {
+		return "", http.StatusRequestedRangeNotSatisfiable, err
+	}
+	return rng, 0, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSegmentRoutes(t *testing.T) {
+	var rng string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng = r.Header.Get("Range")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	routes, err := parseSegmentRoutes("/live/=1000, *.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.SegmentRoutes = routes
+
+	for _, tc := range []struct {
+		target string
+		status int
+		rng    string
+	}{
+		{"/live/ch1.ts?segment=2", http.StatusPartialContent, "bytes=2000-2999"},
+		{"/live/ch1.ts?segment=0&size=10", http.StatusPartialContent, "bytes=0-9"},
+		{"/vod/a.bin?segment=3&size=100", http.StatusPartialContent, "bytes=300-399"},
+		{"/vod/a.bin?segment=3", http.StatusBadRequest, ""},
+		{"/live/ch1.ts?segment=two", http.StatusBadRequest, ""},
+		{"/live/ch1.ts?segment=-1", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"/live/ch1.ts?segment=9223372036854775807", http.StatusRequestedRangeNotSatisfiable, ""},
+		// not a segment route, passed on untouched
+		{"/vod/ep1.ts?segment=2", http.StatusPartialContent, ""},
+	} {
+		rng = ""
+		w := serve("GET", tc.target, nil)
+		if w.Code != tc.status || rng != tc.rng {
+			t.Errorf("%s: got %d asking S3 for %q, want %d and %q", tc.target, w.Code, rng, tc.status, tc.rng)
+		}
+	}
+
+	if w := serve("GET", "/live/ch1.ts?segment=1", http.Header{"Range": {"bytes=0-1"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("segment with a Range got %d, want a 400", w.Code)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTiming collects how long the phases of a request took, for the
+// Server-Timing header browser devtools show
+type serverTiming struct {
+	mu    sync.Mutex
+	start time.Time
+	// getting a connection to S3 over all attempts, including the dial
+	// and TLS handshake when there was no idle one to reuse
+	connect time.Duration
+	// from the final attempt being sent to its first response byte
+	ttfb time.Duration
+
+	getConn, wrote time.Time
+}
+
+func newServerTiming(start time.Time) *serverTiming {
+	return &serverTiming{start: start}
+}
+
+// trace returns req with the S3 phases being timed
+func (st *serverTiming) trace(req *http.Request) *http.Request {
+	ct := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			st.mu.Lock()
+			st.getConn = time.Now()
+			st.mu.Unlock()
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			st.mu.Lock()
+			st.connect += time.Since(st.getConn)
+			st.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			st.mu.Lock()
+			st.wrote = time.Now()
+			st.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			st.mu.Lock()
+			st.ttfb = time.Since(st.wrote)
+			st.mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), ct))
+}
+
+// serverTimingDur formats d as a Server-Timing duration in milliseconds
+func serverTimingDur(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d)/float64(time.Millisecond))
+}
+
+// header formats the timings so far.  The body is still to be copied when
+// the header goes out, so total runs up to the response header.
+func (st *serverTiming) header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return strings.Join([]string{
+		serverTimingDur("s3_connect", st.connect),
+		serverTimingDur("s3_ttfb", st.ttfb),
+		serverTimingDur("total", time.Since(st.start)),
+	}, ", ")
+}
+
+// setServerTiming adds the Server-Timing header when that is enabled
+func setServerTiming(w http.ResponseWriter, st *serverTiming) {
+	if st != nil {
+		w.Header().Set("Server-Timing", st.header())
+	}
+}
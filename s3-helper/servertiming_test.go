@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestServerTiming(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+
+	if st := serve("GET", "/show/ep1.ts", nil).Header().Get("Server-Timing"); st != "" {
+		t.Errorf("Server-Timing %q sent while disabled", st)
+	}
+
+	conf.ServerTiming = true
+	st := serve("GET", "/show/ep1.ts", nil).Header().Get("Server-Timing")
+	m := regexp.MustCompile(`^s3_connect;dur=[0-9.]+, s3_ttfb;dur=([0-9.]+), total;dur=[0-9.]+$`).FindStringSubmatch(st)
+	if m == nil {
+		t.Fatalf("Server-Timing %q", st)
+	}
+	if ttfb, _ := time.ParseDuration(m[1] + "ms"); ttfb < 20*time.Millisecond {
+		t.Errorf("s3_ttfb %v shorter than S3 took", ttfb)
+	}
+}
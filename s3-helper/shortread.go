@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// shortReadGuarded reports whether a response should be read in full
+// before anything goes to the client, so that one cut short can still
+// be retried.  That is limited to whole objects of a known length up to
+// ShortReadMaxBytes, typically manifests.
+func shortReadGuarded(req *http.Request, resp *http.Response, full bool) bool {
+	return conf.ShortReadMaxBytes > 0 && full && req.Method == "GET" &&
+		resp.StatusCode == http.StatusOK &&
+		resp.ContentLength >= 0 && resp.ContentLength <= conf.ShortReadMaxBytes
+}
+
+// bufferComplete reads the body of resp into memory, failing when it ends
+// before its Content-Length
+func bufferComplete(resp *http.Response) error {
+	b := make([]byte, resp.ContentLength)
+	n, err := io.ReadFull(resp.Body, b)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("short body, got %d of %d bytes: %v", n, resp.ContentLength, err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return nil
+}
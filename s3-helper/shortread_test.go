@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestShortReadRetried(t *testing.T) {
+	var fetches int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Length", "10")
+		if fetches == 1 {
+			// the connection is dropped after half the body
+			w.Write([]byte("01234"))
+			return
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	conf.ShortReadMaxBytes = 100
+
+	w := serve("GET", "/show/index.m3u8", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || fetches != 2 {
+		t.Errorf("got %d %q after %d fetches, want the whole body on the second", w.Code, w.Body.String(), fetches)
+	}
+
+	// beyond the limit the body is streamed, and can't be retried
+	fetches = 0
+	conf.ShortReadMaxBytes = 5
+	expectAbort(t, func() { serve("GET", "/show/index.m3u8", nil) })
+	if fetches != 1 {
+		t.Errorf("%d fetches of a streamed body", fetches)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// shutdown stops the listener and waits up to ShutdownTimeout for the
+// requests under way to finish, so the cache fills they are part of
+// complete rather than being cut off.  With no timeout we stop at once as
+// before.  The watchdog is stopped first, as its checks fail once the
+// listener is closed.
+func shutdown(server *http.Server) {
+	stopWatchdog()
+	if conf.ShutdownTimeout <= 0 {
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("Waiting up to %v for requests under way", conf.ShutdownTimeout))
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Int("inflight", len(inflight.snapshot())).
+			Msg("Gave up on requests still under way")
+		return
+	}
+	log.Info().
+		Dur("took", time.Since(start)).
+		Msg("Requests under way finished")
+}
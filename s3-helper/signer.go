@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/crunchyroll/go-aws-auth"
+	"github.com/rs/zerolog/log"
+)
+
+// Signer signs requests to S3
+type Signer interface {
+	Sign(req *http.Request, region, service string, creds awsauth.Credentials) *http.Request
+}
+
+// v4Signer signs with AWS Signature Version 4
+type v4Signer struct{}
+
+func (v4Signer) Sign(req *http.Request, region, service string, creds awsauth.Credentials) *http.Request {
+	req = awsauth.SignForRegion(req, region, service, creds)
+	logSigningScope(req)
+	return req
+}
+
+// v2Signer signs with the legacy S3 signature, which is all some
+// S3-compatible stores understand.  It has no notion of region.
+type v2Signer struct{}
+
+func (v2Signer) Sign(req *http.Request, region, service string, creds awsauth.Credentials) *http.Request {
+	return awsauth.SignS3(req, creds)
+}
+
+// anonymousSigner leaves requests unsigned, for public buckets
+type anonymousSigner struct{}
+
+func (anonymousSigner) Sign(req *http.Request, region, service string, creds awsauth.Credentials) *http.Request {
+	return req
+}
+
+// The signer used for all S3 requests, set up by initSigner
+var signer Signer = v4Signer{}
+
+// newSigner returns the signer for a signature version
+func newSigner(version string) (Signer, error) {
+	switch version {
+	case "", "v4":
+		return v4Signer{}, nil
+	case "v2":
+		return v2Signer{}, nil
+	case "v4a":
+		return v4aSigner{}, nil
+	}
+	return nil, fmt.Errorf("unknown signature version %q", version)
+}
+
+// initSigner selects the signer for the configured signature version
+func initSigner() {
+	if conf.AnonymousAccess {
+		signer = anonymousSigner{}
+		log.Info().Msg("Anonymous access, S3 requests are not signed")
+		return
+	}
+	s, err := newSigner(conf.SignatureVersion)
+	if err != nil {
+		exitConfig("S3_SIGNATURE_VERSION", err)
+	}
+	signer = s
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/crunchyroll/go-aws-auth"
+)
+
+func TestAnonymousAccess(t *testing.T) {
+	var auth []string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+	}))
+	defer func(s Signer) { signer = s }(signer)
+	defer func(cs *credentialStore) { credentials = cs }(credentials)
+	credentials = &credentialStore{}
+	credentials.set(awsauth.Credentials{AccessKeyID: "id", SecretAccessKey: "secret"})
+	conf.AnonymousAccess = false
+
+	conf.SignatureVersion = "v4"
+	initSigner()
+	serve("GET", "/show/ep1.ts", nil)
+
+	conf.AnonymousAccess = true
+	initSigner()
+	serve("GET", "/show/ep1.ts", nil)
+
+	if len(auth) != 2 || auth[0] == "" || auth[1] != "" {
+		t.Errorf("Authorization %q, want a signed request then an unsigned one", auth)
+	}
+}
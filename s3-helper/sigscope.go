@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// logSigningScope logs at debug level what a SigV4 signature of req was
+// made over: the credential scope, the signed headers and the hash of the
+// canonical request.  S3 puts the hash of its own canonical request last
+// in the StringToSign of a SignatureDoesNotMatch error, so comparing the
+// two tells a region or header mismatch from bad keys.  Neither the keys
+// nor the signature are logged.
+func logSigningScope(req *http.Request) {
+	e := log.Debug()
+	if !e.Enabled() {
+		return
+	}
+	scope, signed, ok := parseV4Authorization(req.Header.Get("Authorization"))
+	if !ok {
+		return
+	}
+	e.Str("method", req.Method).
+		Str("object", req.URL.Path).
+		Str("scope", scope).
+		Str("signed-headers", signed).
+		Str("canonical-request-hash", canonicalRequestHash(req, signed)).
+		Msg("Signed S3 request")
+}
+
+// parseV4Authorization picks the credential scope, without the access key,
+// and the signed headers out of a SigV4 Authorization header
+func parseV4Authorization(auth string) (string, string, bool) {
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return "", "", false
+	}
+	var scope, signed string
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Credential":
+			// key/date/region/service/aws4_request
+			if i := strings.Index(kv[1], "/"); i >= 0 {
+				scope = kv[1][i+1:]
+			}
+		case "SignedHeaders":
+			signed = kv[1]
+		}
+	}
+	return scope, signed, scope != "" && signed != ""
+}
+
+// canonicalRequestHash rebuilds the SigV4 canonical request of a signed
+// request as S3 does and hashes it
+func canonicalRequestHash(req *http.Request, signed string) string {
+	var headers strings.Builder
+	for _, name := range strings.Split(signed, ";") {
+		value := req.Header.Get(name)
+		if name == "host" {
+			if value = req.Host; value == "" {
+				value = req.URL.Host
+			}
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		sum := sha256.Sum256(nil)
+		payload = hex.EncodeToString(sum[:])
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL.Query()),
+		headers.String(),
+		signed,
+		payload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalURI encodes a path the way SigV4 does for S3, each segment
+// once
+func canonicalURI(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, s := range segments {
+		segments[i] = sigV4Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery sorts and encodes a query the way SigV4 does
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, sigV4Escape(name)+"="+sigV4Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// sigV4Escape percent-encodes everything but the unreserved characters
+func sigV4Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
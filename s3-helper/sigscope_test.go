@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestParseV4Authorization(t *testing.T) {
+	auth := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20261015/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=abcdef"
+	scope, signed, ok := parseV4Authorization(auth)
+	if !ok || scope != "20261015/us-east-1/s3/aws4_request" || signed != "host;x-amz-content-sha256;x-amz-date" {
+		t.Errorf("got %q, %q, %v", scope, signed, ok)
+	}
+	if _, _, ok := parseV4Authorization("AWS AKIDEXAMPLE:sig"); ok {
+		t.Error("parsed a v2 signature")
+	}
+}
+
+func TestSigningScopeOnlyAtDebug(t *testing.T) {
+	var buf bytes.Buffer
+	prevLogger, prevLevel, prevConf := log.Logger, zerolog.GlobalLevel(), conf.LogLevel
+	defer func() {
+		log.Logger, conf.LogLevel = prevLogger, prevConf
+		zerolog.SetGlobalLevel(prevLevel)
+	}()
+	log.Logger = zerolog.New(&buf)
+
+	req, _ := http.NewRequest("GET", "http://s3.us-east-1.amazonaws.com/bucket/key", nil)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20261015/us-east-1/s3/aws4_request, "+
+		"SignedHeaders=host, Signature=abcdef")
+
+	for _, tt := range []struct {
+		level  string
+		logged bool
+	}{{"info", false}, {"debug", true}} {
+		buf.Reset()
+		conf.LogLevel = tt.level
+		initLogLevel()
+		logSigningScope(req)
+		if logged := buf.Len() > 0; logged != tt.logged {
+			t.Errorf("at %s: logged %v, want %v", tt.level, logged, tt.logged)
+		}
+		if bytes.Contains(buf.Bytes(), []byte("AKIDEXAMPLE")) || bytes.Contains(buf.Bytes(), []byte("abcdef")) {
+			t.Errorf("at %s: logged the key or signature: %s", tt.level, buf.String())
+		}
+	}
+}
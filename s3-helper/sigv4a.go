@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crunchyroll/go-aws-auth"
+	"github.com/rs/zerolog/log"
+)
+
+// SigV4a signs with an ECDSA P-256 key derived from the secret key rather
+// than with an HMAC of it, over a scope without a region.  The regions the
+// signature is good for go in X-Amz-Region-Set instead, which is what
+// lets S3 Multi-Region Access Points take it.
+const sigV4aAlgorithm = "AWS4-ECDSA-P256-SHA256"
+
+// v4aSigner signs with AWS Signature Version 4a
+type v4aSigner struct{}
+
+func (v4aSigner) Sign(req *http.Request, region, service string, creds awsauth.Credentials) *http.Request {
+	if err := signV4a(req, region, service, creds, time.Now()); err != nil {
+		// S3 answers the unsigned request with a 403
+		log.Error().
+			Str("object", req.URL.Path).
+			Str("error", err.Error()).
+			Msg("Failed to sign S3 request with SigV4a")
+	}
+	return req
+}
+
+// signV4a adds the SigV4a headers for a request made at now to req
+func signV4a(req *http.Request, region, service string, creds awsauth.Credentials, now time.Time) error {
+	key, err := sigV4aKeys.get(creds.AccessKeyID, creds.SecretAccessKey)
+	if err != nil {
+		return err
+	}
+	payload, err := payloadHash(req)
+	if err != nil {
+		return err
+	}
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Region-Set", region)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if creds.SecurityToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SecurityToken)
+	}
+
+	signed := sigV4aSignedHeaders(req)
+	scope := now.Format("20060102") + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		sigV4aAlgorithm,
+		req.Header.Get("X-Amz-Date"),
+		scope,
+		canonicalRequestHash(req, signed),
+	}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4aAlgorithm, creds.AccessKeyID, scope, signed, hex.EncodeToString(sig)))
+	return nil
+}
+
+// payloadHash hashes the body of req, leaving it to be read again.  A
+// body that can't be had twice is sent unsigned.
+func payloadHash(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	if req.GetBody == nil {
+		return "UNSIGNED-PAYLOAD", nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sigV4aSignedHeaders lists the headers a SigV4a signature covers: the
+// host, the content type and MD5 when there are any, and every x-amz-*
+// header, as S3 insists those are all signed
+func sigV4aSignedHeaders(req *http.Request) string {
+	names := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "content-md5" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// sigV4aKeyCache holds the key derived for the current credentials, so
+// it is only derived again when they rotate
+type sigV4aKeyCache struct {
+	mu        sync.Mutex
+	accessKey string
+	secretKey string
+	key       *ecdsa.PrivateKey
+}
+
+var sigV4aKeys = &sigV4aKeyCache{}
+
+// get returns the signing key for a key pair, deriving it when it isn't
+// the one cached
+func (c *sigV4aKeyCache) get(accessKey, secretKey string) (*ecdsa.PrivateKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key != nil && c.accessKey == accessKey && c.secretKey == secretKey {
+		return c.key, nil
+	}
+	key, err := deriveSigV4aKey(accessKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	c.accessKey, c.secretKey, c.key = accessKey, secretKey, key
+	return key, nil
+}
+
+// deriveSigV4aKey derives the ECDSA key of a key pair as AWS does: a NIST
+// SP 800-108 counter mode HMAC-SHA256 KDF of the secret key, with the
+// access key and a counter as context, is tried until it gives a number
+// below the curve order less two, and that plus one is the private key
+func deriveSigV4aKey(accessKey, secretKey string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	max := new(big.Int).Sub(curve.Params().N, big.NewInt(2))
+	secret := []byte("AWS4A" + secretKey)
+	for counter := 1; counter < 255; counter++ {
+		var input bytes.Buffer
+		input.WriteString(sigV4aAlgorithm)
+		input.WriteByte(0)
+		input.WriteString(accessKey)
+		input.WriteByte(byte(counter))
+		binary.Write(&input, binary.BigEndian, uint32(256))
+
+		mac := hmac.New(sha256.New, secret)
+		binary.Write(mac, binary.BigEndian, uint32(1))
+		mac.Write(input.Bytes())
+		d := new(big.Int).SetBytes(mac.Sum(nil))
+		if d.Cmp(max) >= 0 {
+			continue
+		}
+		d.Add(d, big.NewInt(1))
+		key := &ecdsa.PrivateKey{D: d}
+		key.PublicKey.Curve = curve
+		key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, 32)))
+		return key, nil
+	}
+	return nil, fmt.Errorf("no SigV4a key could be derived for %s", accessKey)
+}
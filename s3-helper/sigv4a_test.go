@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crunchyroll/go-aws-auth"
+)
+
+func TestDeriveSigV4aKey(t *testing.T) {
+	// the key pair and public key of the AWS SDKs' own test
+	key, err := deriveSigV4aKey("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := fmt.Sprintf("%064X", key.PublicKey.X)
+	y := fmt.Sprintf("%064X", key.PublicKey.Y)
+	if x != "15D242CEEBF8D8169FD6A8B5A746C41140414C3B07579038DA06AF89190FFFCB" ||
+		y != "0515242CEDD82E94799482E4C0514B505AFCCF2C0C98D6A553BF539F424C5EC0" {
+		t.Errorf("public key %s, %s", x, y)
+	}
+}
+
+func TestSignV4a(t *testing.T) {
+	creds := awsauth.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SecurityToken: "token"}
+	req, _ := http.NewRequest("PUT", "https://s3.amazonaws.com/bucket/a%20b.ts?partNumber=1&uploadId=u1",
+		strings.NewReader("part"))
+	req.Header.Set("Content-Type", "video/mp2t")
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	if err := signV4a(req, "us-east-1", "s3", creds, now); err != nil {
+		t.Fatal(err)
+	}
+
+	body := sha256.Sum256([]byte("part"))
+	canonical := "PUT\n" +
+		"/bucket/a%20b.ts\n" +
+		"partNumber=1&uploadId=u1\n" +
+		"content-type:video/mp2t\n" +
+		"host:s3.amazonaws.com\n" +
+		"x-amz-content-sha256:" + hex.EncodeToString(body[:]) + "\n" +
+		"x-amz-date:20261015T120000Z\n" +
+		"x-amz-region-set:us-east-1\n" +
+		"x-amz-security-token:token\n" +
+		"\n" +
+		"content-type;host;x-amz-content-sha256;x-amz-date;x-amz-region-set;x-amz-security-token\n" +
+		hex.EncodeToString(body[:])
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-ECDSA-P256-SHA256\n20261015T120000Z\n20261015/s3/aws4_request\n" +
+		hex.EncodeToString(canonicalHash[:])
+
+	prefix := "AWS4-ECDSA-P256-SHA256 Credential=AKIDEXAMPLE/20261015/s3/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date;x-amz-region-set;x-amz-security-token, " +
+		"Signature="
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		t.Fatalf("Authorization %q", auth)
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(auth, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := deriveSigV4aKey("AKIDEXAMPLE", "secret")
+	digest := sha256.Sum256([]byte(stringToSign))
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+		t.Error("signature doesn't verify")
+	}
+}
+
+func TestSignerVersions(t *testing.T) {
+	for version, want := range map[string]Signer{"": v4Signer{}, "v4": v4Signer{}, "v4a": v4aSigner{}, "v2": v2Signer{}} {
+		if s, err := newSigner(version); err != nil || s != want {
+			t.Errorf("%q: got %T, %v", version, s, err)
+		}
+	}
+	if _, err := newSigner("v3"); err == nil {
+		t.Error("v3 accepted")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// logSlowRequest warns about a request that took longer than
+// SlowRequestThreshold, whether or not it was sampled for logging
+func logSlowRequest(logger zerolog.Logger, sw *statusWriter, start time.Time, nretries map[string]int) {
+	took := time.Since(start)
+	if conf.SlowRequestThreshold <= 0 || took < conf.SlowRequestThreshold {
+		return
+	}
+	retries := 0
+	for _, n := range nretries {
+		retries += n
+	}
+	metricSlowRequests.Add(1)
+	logger.Warn().
+		Dur("duration", took).
+		Int64("bytes", sw.bytes).
+		Int("statuscode", sw.status).
+		Int("retries", retries).
+		Msg(fmt.Sprintf("Slow request took %v", took.Round(time.Millisecond)))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestLogged(t *testing.T) {
+	var fetches int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if fetches == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	logs := captureLog(t)
+	conf.LogSampleRate = 0
+	conf.SlowRequestThreshold = 10 * time.Millisecond
+	before := metricSlowRequests.Value()
+
+	serve("GET", "/show/ep1.ts", http.Header{"Range": {"bytes=0-3"}})
+	var fields map[string]interface{}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "Slow request took") {
+			json.Unmarshal([]byte(line), &fields)
+		}
+	}
+	if fields == nil || fields["object"] != "/show/ep1.ts" || fields["range"] != "bytes=0-3" ||
+		fields["statuscode"] != 200.0 || fields["bytes"] != 4.0 || fields["retries"] != 1.0 {
+		t.Errorf("slow request logged as %v", fields)
+	}
+	if metricSlowRequests.Value()-before != 1 {
+		t.Error("slow request not counted")
+	}
+
+	conf.SlowRequestThreshold = time.Minute
+	logs.Reset()
+	serve("GET", "/show/ep1.ts", nil)
+	if strings.Contains(logs.String(), "Slow request took") {
+		t.Error("fast request logged as slow")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The type S3 gives objects uploaded without one
+const genericContentType = "application/octet-stream"
+
+// sniffable reports whether the type of a full GET response should be
+// sniffed from its body, because S3 only has the generic type for it
+func sniffable(resp *http.Response) bool {
+	if !conf.SniffContentType || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	ct := strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	if ct != "" && !strings.EqualFold(ct, genericContentType) {
+		return false
+	}
+	return resp.ContentLength >= 0 && (conf.SniffMaxBytes <= 0 || resp.ContentLength <= conf.SniffMaxBytes)
+}
+
+// sniffContentType reads the first 512 bytes of the body, all that
+// http.DetectContentType looks at, and sets the type they suggest when it
+// is more specific than the generic one.  The bytes read are put back in
+// front of the rest of the body.
+func sniffContentType(resp *http.Response) (string, bool) {
+	prefix := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, prefix)
+	prefix = prefix[:n]
+	resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body), Closer: resp.Body}
+	if n == 0 || (err != nil && err != io.ErrUnexpectedEOF) {
+		return "", false
+	}
+	ct := http.DetectContentType(prefix)
+	if strings.HasPrefix(ct, genericContentType) {
+		return "", false
+	}
+	resp.Header.Set("Content-Type", ct)
+	return ct, true
+}
+
+// prefixedBody is a response body with bytes already read put back
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
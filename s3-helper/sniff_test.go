@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + "rest of the image"
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/typed.png":
+			w.Header().Set("Content-Type", "image/x-custom")
+		case "/bucket/encoded.png":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Encoding", "identity")
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		w.Write([]byte(png))
+	}))
+	conf.SniffContentType = true
+	conf.SniffMaxBytes = 1 << 20
+
+	w := serve("GET", "/untyped.png", nil)
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("got Content-Type %q, want the sniffed image/png", ct)
+	}
+	if w.Body.String() != png {
+		t.Errorf("got body %q, want the whole object", w.Body.String())
+	}
+
+	for _, c := range []struct {
+		name, method, target, want string
+	}{
+		{"typed object", "GET", "/typed.png", "image/x-custom"},
+		{"encoded object", "GET", "/encoded.png", "application/octet-stream"},
+		{"HEAD", "HEAD", "/untyped.png", "application/octet-stream"},
+	} {
+		w := serve(c.method, c.target, nil)
+		if ct := w.Header().Get("Content-Type"); ct != c.want {
+			t.Errorf("%s: got Content-Type %q, want %q", c.name, ct, c.want)
+		}
+	}
+
+	conf.SniffMaxBytes = 4
+	w = serve("GET", "/untyped.png", nil)
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("over sniff_max_bytes: got Content-Type %q", ct)
+	}
+}
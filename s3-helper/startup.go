@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/url"
+	"runtime"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// redactedConfig returns a copy of the config that is safe to log.  Any
+// of its URLs can carry credentials, in their userinfo or in the query
+// as for a presigned access log sink.
+func redactedConfig() Config {
+	c := conf
+	c.S3ProxyURL = redactConfigURL(c.S3ProxyURL)
+	c.S3Endpoint = redactConfigURL(c.S3Endpoint)
+	c.AccessLogSink = redactConfigURL(c.AccessLogSink)
+	if c.S3Endpoints != nil {
+		c.S3Endpoints = make([]string, len(conf.S3Endpoints))
+		for i, ep := range conf.S3Endpoints {
+			c.S3Endpoints[i] = redactConfigURL(ep)
+		}
+	}
+	if target, ok := strings.CutPrefix(c.RootResponse, rootRedirect); ok {
+		c.RootResponse = rootRedirect + redactConfigURL(target)
+	}
+	return c
+}
+
+// redactConfigURL masks the userinfo and query values of a URL.
+// Anything that isn't a URL with a scheme, e.g. a file name, is returned
+// as is.
+func redactConfigURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "xxxxx"
+	}
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			query.Set(name, "xxxxx")
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// logStartup emits a single record of the effective configuration
+func logStartup() {
+	log.Info().
+		Str("event", "startup").
+		Str("version", version).
+		Str("go", runtime.Version()).
+		Int("gomaxprocs", runtime.GOMAXPROCS(0)).
+		Str("listen", conf.Listen).
+		Str("admin_listen", conf.AdminListen).
+		Interface("config", redactedConfig()).
+		Msg("Startup configuration")
+}
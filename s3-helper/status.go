@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Response statuses counted as success unless configured otherwise
+const successStatusesDefault = "2xx,304"
+
+// statusSet is a set of response status codes
+type statusSet map[int]bool
+
+// parseStatusSet parses a comma separated list of status codes and
+// classes, e.g. "2xx,304"
+func parseStatusSet(s string) (statusSet, error) {
+	set := statusSet{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] >= '1' && item[0] <= '5' {
+			base := int(item[0]-'0') * 100
+			for code := base; code < base+100; code++ {
+				set[code] = true
+			}
+			continue
+		}
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status %q", item)
+		}
+		set[code] = true
+	}
+	return set, nil
+}
+
+// Codes that should still stand out as errors in logs and metrics
+var successStatuses statusSet
+
+// successStatus reports whether an upstream status counts as success
+func successStatus(code int) bool {
+	return successStatuses[code]
+}
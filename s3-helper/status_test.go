@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseStatusSet(t *testing.T) {
+	set, err := parseStatusSet("2xx, 304,404")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[int]bool{200: true, 206: true, 299: true, 304: true, 404: true, 301: false, 403: false, 500: false} {
+		if set[code] != want {
+			t.Errorf("%d in set is %v, want %v", code, set[code], want)
+		}
+	}
+
+	for _, bad := range []string{"6xx", "x04", "99", "600", "ok"} {
+		if _, err := parseStatusSet(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestUpstreamErrorsCounted(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	prev := successStatuses
+	t.Cleanup(func() { successStatuses = prev })
+
+	successStatuses, _ = parseStatusSet(successStatusesDefault)
+	errors := metricUpstreamErrors.Value()
+	serve("GET", "/show/missing.ts", nil)
+	if metricUpstreamErrors.Value() != errors+1 {
+		t.Error("404 not counted as an upstream error")
+	}
+
+	// expected misses don't count once configured as success
+	successStatuses, _ = parseStatusSet("2xx,304,404")
+	errors = metricUpstreamErrors.Value()
+	if w := serve("GET", "/show/missing.ts", nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d, want S3's 404", w.Code)
+	}
+	if metricUpstreamErrors.Value() != errors {
+		t.Error("404 counted as an error while configured as success")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TLS settings for connections to S3, set up by initTLS and replaced by
+// reloadS3Client while requests may be building clients from them
+var s3TLS atomic.Pointer[tls.Config]
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion maps a version such as "1.2" onto its tls constant
+func parseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.TrimSpace(s), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+// parseCipherSuites maps a comma separated list of cipher suite names,
+// e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", onto their IDs.  Only
+// suites Go considers secure are accepted.
+func parseCipherSuites(s string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// tlsSettingError ties a failure to set up TLS to the setting behind it
+type tlsSettingError struct {
+	name string
+	err  error
+}
+
+func (e tlsSettingError) Error() string { return e.name + ": " + e.err.Error() }
+
+// loadTLS builds the TLS settings for S3 connections, reading the
+// certificate files afresh
+func loadTLS() (*tls.Config, error) {
+	min, err := parseTLSVersion(conf.S3MinTLSVersion)
+	if err != nil {
+		return nil, tlsSettingError{"S3_MIN_TLS_VERSION", err}
+	}
+	cfg := &tls.Config{MinVersion: min}
+
+	if conf.S3CipherSuites != "" {
+		suites, err := parseCipherSuites(conf.S3CipherSuites)
+		if err != nil {
+			return nil, tlsSettingError{"S3_CIPHER_SUITES", err}
+		}
+		cfg.CipherSuites = suites
+	}
+
+	if conf.S3ClientCertFile == "" && conf.S3ClientKeyFile == "" && conf.S3CACertFile == "" {
+		return cfg, nil
+	}
+	if conf.S3Endpoint == "" {
+		log.Warn().Msg("Client certificates only apply to a custom S3 endpoint, ignoring them")
+		return cfg, nil
+	}
+
+	if conf.S3ClientCertFile != "" || conf.S3ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.S3ClientCertFile, conf.S3ClientKeyFile)
+		if err != nil {
+			return nil, tlsSettingError{"S3_CLIENT_CERT_FILE", err}
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		log.Info().Msg(fmt.Sprintf("Using client certificate %s for S3 connections", conf.S3ClientCertFile))
+	}
+
+	if conf.S3CACertFile != "" {
+		pem, err := os.ReadFile(conf.S3CACertFile)
+		if err != nil {
+			return nil, tlsSettingError{"S3_CA_CERT_FILE", err}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, tlsSettingError{"S3_CA_CERT_FILE", fmt.Errorf("no certificates found in %s", conf.S3CACertFile)}
+		}
+		cfg.RootCAs = pool
+		log.Info().Msg(fmt.Sprintf("Using CA certificates from %s for S3 connections", conf.S3CACertFile))
+	}
+	return cfg, nil
+}
+
+// initTLS validates the TLS settings for S3 connections
+func initTLS() {
+	cfg, err := loadTLS()
+	if err != nil {
+		e := err.(tlsSettingError)
+		exitConfig(e.name, e.err)
+	}
+	s3TLS.Store(cfg)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert creates a self-signed client certificate and its key in
+// dir, returning their paths and the certificate
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "s3-helper"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile, cert
+}
+
+func TestMutualTLSEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeClientCert(t, dir)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/show/ep1.ts" {
+			t.Errorf("endpoint asked for %s", r.URL.Path)
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	prevConf, prevCache, prevProxy := conf, cache, s3Proxy
+	prevClient, prevTLS := s3Client.Load(), s3TLS.Load()
+	t.Cleanup(func() {
+		conf, cache, s3Proxy = prevConf, prevCache, prevProxy
+		s3Client.Store(prevClient)
+		s3TLS.Store(prevTLS)
+	})
+	conf.S3Endpoint = srv.URL
+	conf.S3Bucket = "bucket"
+	conf.S3Timeout = 5 * time.Second
+	conf.S3MinTLSVersion = "1.2"
+	conf.S3ClientCertFile, conf.S3ClientKeyFile, conf.S3CACertFile = certFile, keyFile, caFile
+	cache, s3Proxy = nil, nil
+	useSigner(t, anonymousSigner{})
+	initTLS()
+	s3Client.Store(newS3Client())
+
+	w := serve("GET", "/show/ep1.ts", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("got %d %q, want the object over mutual TLS", w.Code, w.Body.String())
+	}
+
+	// the endpoint turns away a client without the certificate
+	conf.S3ClientCertFile, conf.S3ClientKeyFile = "", ""
+	conf.S3Retries = RetryConfig{}
+	initTLS()
+	s3Client.Store(newS3Client())
+	if w := serve("GET", "/show/ep1.ts", nil); w.Code == http.StatusOK {
+		t.Error("got a 200 without a client certificate")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// W3C trace context header carrying the trace a request belongs to
+const traceparentHeader = "traceparent"
+
+// parseTraceparent returns the trace ID of a "00-<trace>-<span>-<flags>"
+// traceparent header
+func parseTraceparent(s string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	for _, p := range parts[:4] {
+		if _, err := hex.DecodeString(p); err != nil || strings.ToLower(p) != p {
+			return "", false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestTraceID returns the trace a client request belongs to, continuing
+// the client's when it sent a traceparent and starting one otherwise.  It
+// is empty when tracing is off.
+func requestTraceID(r *http.Request) string {
+	if !conf.TracingEnabled {
+		return ""
+	}
+	if id, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		return id
+	}
+	return randomHex(16)
+}
+
+// propagateTrace passes the trace on to S3 with a span of our own, S3
+// ignores it but a proxy in between may not
+func propagateTrace(req *http.Request, traceID string) {
+	if traceID != "" {
+		req.Header.Set(traceparentHeader, "00-"+traceID+"-"+randomHex(8)+"-01")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceExemplars(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parent = "00-" + traceID + "-00f067aa0ba902b7-01"
+	var upstream string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("traceparent")
+	}))
+	prev := requestLatency
+	t.Cleanup(func() { requestLatency = prev })
+	requestLatency = newLatencyHistogram()
+	conf.MetricsEnabled = true
+	conf.TracingEnabled = true
+	conf.MetricsNamespace = "s3helper"
+	logs := captureLog(t)
+
+	serve("GET", "/show/ep1.ts", http.Header{"Traceparent": {parent}})
+	if !strings.HasPrefix(upstream, "00-"+traceID+"-") || upstream == parent {
+		t.Errorf("S3 got traceparent %q, want the trace continued with our own span", upstream)
+	}
+	if fields := logged(logs, "Request started"); fields == nil || fields["trace-id"] != traceID {
+		t.Errorf("request logged as %v", fields)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/debug/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text")
+	openMetricsHandler(w, r)
+	metrics := w.Body.String()
+	if !strings.Contains(metrics, `# {trace_id="`+traceID+`"}`) ||
+		!strings.Contains(metrics, "s3helper_request_duration_seconds_count 1\n") ||
+		!strings.HasSuffix(metrics, "# EOF\n") {
+		t.Errorf("metrics:\n%s", metrics)
+	}
+
+	// a malformed traceparent starts a fresh trace
+	serve("GET", "/show/ep1.ts", http.Header{"Traceparent": {"00-" + strings.ToUpper(traceID) + "-00f067aa0ba902b7-01"}})
+	if strings.Contains(upstream, traceID) || len(upstream) != 55 {
+		t.Errorf("S3 got traceparent %q, want a new trace", upstream)
+	}
+}
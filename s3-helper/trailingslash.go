@@ -0,0 +1,22 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// stripTrailingSlash drops a single trailing slash from a key that looks
+// like a file, "/file.ts/" being asked for as "/file.ts", when
+// StripTrailingSlash is set.  A key whose last segment has no extension
+// looks like a directory and is left alone, as is "/", so a directory
+// listing or a root response is never turned into an object fetch.
+func stripTrailingSlash(upath string) string {
+	if !conf.StripTrailingSlash || upath == "/" || !strings.HasSuffix(upath, "/") {
+		return upath
+	}
+	trimmed := strings.TrimSuffix(upath, "/")
+	if strings.HasSuffix(trimmed, "/") || path.Ext(trimmed) == "" {
+		return upath
+	}
+	return trimmed
+}
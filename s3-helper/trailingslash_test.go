@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTrailingSlashStripped(t *testing.T) {
+	var got string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Path
+	}))
+	conf.StripTrailingSlash = true
+
+	for target, want := range map[string]string{
+		"/show/ep1.ts/":  "/bucket/show/ep1.ts",
+		"/show/ep1.ts//": "/bucket/show/ep1.ts//",
+		"/show/":         "/bucket/show/",
+		"/show/ep1.ts":   "/bucket/show/ep1.ts",
+	} {
+		got = ""
+		serve("GET", target, nil)
+		if got != want {
+			t.Errorf("%s: S3 got %q, want %q", target, got, want)
+		}
+	}
+
+	conf.StripTrailingSlash = false
+	serve("GET", "/show/ep1.ts/", nil)
+	if got != "/bucket/show/ep1.ts/" {
+		t.Errorf("stripped while off: S3 got %q", got)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Request headers passed on to S3 with an upload, besides the x-amz-*
+// ones
+var uploadHeaders = []string{"Content-Type", "Content-MD5", "Content-Encoding", "Content-Disposition",
+	"Content-Language", "Cache-Control", "Expires"}
+
+// Query parameters of the multipart upload API, the only ones passed on
+// with uploads
+var uploadQuery = map[string]bool{"uploads": true, "uploadId": true, "partNumber": true}
+
+// Request headers that turn a PUT into a copy of another object
+var copySourceHeaders = []string{"X-Amz-Copy-Source", "X-Amz-Copy-Source-Range"}
+
+// Clients allowed to upload
+var uploadAllow []*net.IPNet
+
+// initUploads sets up the clients allowed to upload
+func initUploads() {
+	if !conf.AllowUploads {
+		return
+	}
+	nets, err := parseCIDRs(conf.UploadCIDRs)
+	if err != nil {
+		exitConfig("S3_UPLOAD_CIDRS", err)
+	}
+	if len(nets) == 0 {
+		exitConfig("S3_UPLOAD_CIDRS", fmt.Errorf("uploads are allowed but no clients are"))
+	}
+	uploadAllow = nets
+	log.Info().Msg(fmt.Sprintf("Accepting uploads from %s", conf.UploadCIDRs))
+}
+
+// isUpload reports whether r is an upload we handle
+func isUpload(r *http.Request) bool {
+	return conf.AllowUploads && (r.Method == "PUT" || r.Method == "POST")
+}
+
+// uploadOperation works out the query for the S3 operation r stands for,
+// refusing anything but writing an object: a PutObject, an UploadPart, or
+// the POSTs starting and completing a multipart upload.  Other query
+// parameters would make a PUT or POST of ACLs, tags or the like, and a
+// copy source header a copy of an object the client may not be allowed
+// to read.
+func uploadOperation(r *http.Request) (url.Values, error) {
+	for _, name := range copySourceHeaders {
+		if r.Header.Get(name) != "" {
+			return nil, fmt.Errorf("%s not allowed", name)
+		}
+	}
+	query := url.Values{}
+	for name, values := range r.URL.Query() {
+		if !uploadQuery[name] {
+			return nil, fmt.Errorf("query parameter %q not allowed", name)
+		}
+		query.Set(name, values[0])
+	}
+	_, uploads := query["uploads"]
+	uploadID, partNumber := query.Get("uploadId"), query.Get("partNumber")
+	switch {
+	case r.Method == "PUT" && len(query) == 0:
+	case r.Method == "PUT" && !uploads && uploadID != "" && partNumber != "":
+		if n, err := strconv.Atoi(partNumber); err != nil || n < 1 || n > 10000 {
+			return nil, fmt.Errorf("invalid partNumber %q", partNumber)
+		}
+	case r.Method == "POST" && len(query) == 1 && (uploads || uploadID != ""):
+	default:
+		return nil, fmt.Errorf("%s with query %q is not an upload", r.Method, r.URL.RawQuery)
+	}
+	return query, nil
+}
+
+// serveUpload passes a PUT, or a POST of the multipart upload API, on to
+// S3 and answers with S3's response.  Only uploadOperation's operations
+// go to S3, on the escaped key.  The signature covers a hash of the
+// payload and the signer can't sign it in chunks as it streams, so the
+// body is read in full first, up to UploadMaxBytes.  That also turns a
+// chunked body of unknown length into one S3 takes, as it insists on a
+// Content-Length.
+func serveUpload(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	logger := log.With().Str("object", upath).Str("method", r.Method).Str("client", clientIP(r)).Logger()
+
+	if !ipAllowed(uploadAllow, clientIP(r)) {
+		w.WriteHeader(http.StatusForbidden)
+		logger.Warn().Msg("Rejected upload from a client not allowed to")
+		return
+	}
+	if err := checkObjectKey(upath); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("Rejected upload")
+		return
+	}
+	query, err := uploadOperation(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("Rejected upload")
+		return
+	}
+	if r.ContentLength > conf.UploadMaxBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		logger.Warn().
+			Int64("content-length", r.ContentLength).
+			Msg("Rejected oversized upload")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, conf.UploadMaxBytes+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("Failed to read upload body")
+		return
+	}
+	if int64(len(body)) > conf.UploadMaxBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		logger.Warn().Msg("Rejected oversized upload")
+		return
+	}
+
+	req, err := newUploadRequest(r, query, body)
+	if err == errNoCredentials {
+		credentialsUnavailable(w)
+		logger.Warn().Msg("No valid credentials, asked client to retry")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("Rejected upload")
+		return
+	}
+	resp, err := doS3Once(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		logger.Error().
+			Str("error", err.Error()).
+			Msg("Failed to upload to S3")
+		return
+	}
+	defer resp.Body.Close()
+
+	relayResponse(w, resp)
+
+	metricUploads.Add(1)
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		// cached copies are of the object as it was before
+		cache.delete(upath)
+		metricUploadBytes.Add(int64(len(body)))
+		logger.Info().
+			Int("statuscode", resp.StatusCode).
+			Int("content-length", len(body)).
+			Msg("Uploaded to S3")
+		return
+	}
+	logger.Error().
+		Int("statuscode", resp.StatusCode).
+		Msg("S3 refused upload")
+}
+
+// relayResponse answers with S3's response to a write as it is
+func relayResponse(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Header {
+		if name == "Connection" || name == "Keep-Alive" || name == "Transfer-Encoding" {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// newUploadRequest creates the signed S3 request for an upload with the
+// query uploadOperation worked out, the client's body and the headers S3
+// stores with the object
+func newUploadRequest(r *http.Request, query url.Values, body []byte) (*http.Request, error) {
+	r2, err := http.NewRequest(r.Method, s3URL(r.URL.Path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r2.URL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	for _, name := range uploadHeaders {
+		if v := r.Header.Get(name); v != "" {
+			r2.Header.Set(name, v)
+		}
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-") && !isSignatureHeader(name) && len(values) > 0 {
+			r2.Header.Set(name, values[0])
+		}
+	}
+	if r2, err = signRequest(r2); err != nil {
+		return nil, err
+	}
+	r2.Header.Set("Host", r2.URL.Host)
+	return r2, nil
+}
+
+// isSignatureHeader reports whether name is one of signatureHeaders,
+// which a client mustn't be able to set for us
+func isSignatureHeader(name string) bool {
+	for _, h := range signatureHeaders {
+		if http.CanonicalHeaderKey(h) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// allowUploads of up to max bytes from 192.0.2.0/24 until the test ends
+func allowUploads(t *testing.T, max int64) {
+	prev := uploadAllow
+	t.Cleanup(func() { uploadAllow = prev })
+	conf.AllowUploads = true
+	conf.UploadMaxBytes = max
+	uploadAllow, _ = parseCIDRs("192.0.2.0/24")
+}
+
+func TestUploadForwarded(t *testing.T) {
+	var got *http.Request
+	var body string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("ETag", `"e1"`)
+	}))
+	allowUploads(t, 1<<20)
+
+	r := httptest.NewRequest("PUT", "/show/ep1.ts?partNumber=3&uploadId=u1", strings.NewReader("part"))
+	r.Header.Set("Content-Type", "video/mp2t")
+	r.Header.Set("X-Amz-Meta-Show", "one")
+	r.Header.Set("X-Amz-Date", "forged")
+	r.Header.Set("Cookie", "session=1")
+	w := httptest.NewRecorder()
+	forwardToS3(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"e1"` {
+		t.Fatalf("got %d ETag %q, want S3's response", w.Code, w.Header().Get("ETag"))
+	}
+	if got.Method != "PUT" || got.URL.Path != "/bucket/show/ep1.ts" || body != "part" {
+		t.Errorf("S3 got %s %s with body %q", got.Method, got.URL.Path, body)
+	}
+	if q := got.URL.Query(); q.Get("partNumber") != "3" || q.Get("uploadId") != "u1" {
+		t.Errorf("S3 got query %q", got.URL.RawQuery)
+	}
+	if got.Header.Get("Content-Type") != "video/mp2t" || got.Header.Get("X-Amz-Meta-Show") != "one" {
+		t.Errorf("object headers not passed on: %v", got.Header)
+	}
+	if got.Header.Get("X-Amz-Date") == "forged" || got.Header.Get("Cookie") != "" {
+		t.Errorf("client headers passed on: %v", got.Header)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	var calls int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+
+	for _, c := range []struct {
+		name, method, target, remote, body string
+		allow                              bool
+		want                               int
+	}{
+		{"uploads off", "PUT", "/show/ep1.ts", "192.0.2.1:1234", "part", false, 405},
+		{"client not allowed", "PUT", "/show/ep1.ts", "198.51.100.1:1234", "part", true, 403},
+		{"too large", "PUT", "/show/ep1.ts", "192.0.2.1:1234", "parts", true, 413},
+		{"bad part number", "PUT", "/show/ep1.ts?partNumber=0&uploadId=u1", "192.0.2.1:1234", "part", true, 400},
+		{"bucket", "PUT", "/", "192.0.2.1:1234", "part", true, 400},
+		{"prefix", "PUT", "/show/", "192.0.2.1:1234", "part", true, 400},
+		{"query in key", "PUT", "/show/ep1.ts%3Facl", "192.0.2.1:1234", "part", true, 400},
+		{"acl", "PUT", "/show/ep1.ts?acl", "192.0.2.1:1234", "part", true, 400},
+		{"tagging", "PUT", "/show/ep1.ts?tagging", "192.0.2.1:1234", "part", true, 400},
+		{"part without upload", "PUT", "/show/ep1.ts?partNumber=1", "192.0.2.1:1234", "part", true, 400},
+		{"upload without part", "PUT", "/show/ep1.ts?uploadId=u1", "192.0.2.1:1234", "part", true, 400},
+		{"post without query", "POST", "/show/ep1.ts", "192.0.2.1:1234", "part", true, 400},
+		{"post of a part", "POST", "/show/ep1.ts?uploadId=u1&partNumber=1", "192.0.2.1:1234", "part", true, 400},
+		{"restore", "POST", "/show/ep1.ts?restore", "192.0.2.1:1234", "part", true, 400},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conf.AllowUploads = false
+			if c.allow {
+				allowUploads(t, 4)
+			}
+			r := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+			r.RemoteAddr = c.remote
+			w := httptest.NewRecorder()
+			forwardToS3(w, r)
+			if w.Code != c.want {
+				t.Errorf("got %d, want %d", w.Code, c.want)
+			}
+		})
+	}
+	for _, name := range copySourceHeaders {
+		allowUploads(t, 4)
+		r := httptest.NewRequest("PUT", "/show/ep1.ts", nil)
+		r.Header.Set(name, "/other-bucket/secret.ts")
+		w := httptest.NewRecorder()
+		forwardToS3(w, r)
+		if w.Code != 400 {
+			t.Errorf("%s: got %d, want 400", name, w.Code)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("S3 got %d requests", calls)
+	}
+}
+
+func TestUploadKeyEscaped(t *testing.T) {
+	var rawPath, query string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawPath, query = r.URL.EscapedPath(), r.URL.RawQuery
+	}))
+	allowUploads(t, 1<<20)
+	prev := queryForward
+	t.Cleanup(func() { queryForward = prev })
+	queryForward = map[string]bool{"versionId": true}
+
+	r := httptest.NewRequest("POST", "/show/ep%201.ts?uploads", strings.NewReader("part"))
+	w := httptest.NewRecorder()
+	forwardToS3(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if rawPath != "/bucket/show/ep%201.ts" || query != "uploads=" {
+		t.Errorf("S3 got %s?%s", rawPath, query)
+	}
+
+	// a forwarded parameter is still not part of an upload
+	r = httptest.NewRequest("PUT", "/show/ep1.ts?versionId=v1", strings.NewReader("part"))
+	w = httptest.NewRecorder()
+	forwardToS3(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with versionId got %d, want 400", w.Code)
+	}
+}
+
+func TestUploadAdmitted(t *testing.T) {
+	var calls int
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	allowUploads(t, 1<<20)
+	limitTest(t)
+	conf.MaxInflight = 1
+	conf.OverloadStatus = overloadStatusDefault
+	inflightSlots = make(chan struct{}, conf.MaxInflight)
+	inflightSlots <- struct{}{}
+
+	r := httptest.NewRequest("PUT", "/show/ep1.ts", strings.NewReader("part"))
+	w := httptest.NewRecorder()
+	forwardToS3(w, r)
+	if w.Code != http.StatusServiceUnavailable || calls != 0 {
+		t.Errorf("upload over the in-flight limit got %d, S3 got %d requests", w.Code, calls)
+	}
+}
+
+func TestUploadSentOnce(t *testing.T) {
+	var attempts atomic.Int32
+	var got string
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	allowUploads(t, 1<<20)
+
+	r := httptest.NewRequest("POST", "/show/ep1.ts?uploads", strings.NewReader("part"))
+	r.RemoteAddr = "192.0.2.1:40000"
+	w := httptest.NewRecorder()
+	forwardToS3(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want S3's 503", w.Code)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("upload sent %d times", n)
+	}
+	if got != "part" {
+		t.Errorf("S3 got body %q", got)
+	}
+}
+
+func TestUploadNotFailedOver(t *testing.T) {
+	var first, second atomic.Int32
+	srv := mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	// the endpoints are reached directly rather than through the mock
+	s3Proxy = nil
+	s3Client.Store(newS3Client())
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		second.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer other.Close()
+	conf.EndpointDownFor = time.Minute
+	endpoints = newEndpointPool([]string{srv.URL, other.URL})
+	allowUploads(t, 1<<20)
+
+	// whichever endpoint the key maps to, the other one never sees it
+	r := httptest.NewRequest("PUT", "/show/ep1.ts", strings.NewReader("data"))
+	r.RemoteAddr = "192.0.2.1:40000"
+	forwardToS3(httptest.NewRecorder(), r)
+	if n := first.Load() + second.Load(); n != 1 {
+		t.Errorf("upload sent %d times", n)
+	}
+}
+
+func TestUploadInvalidatesCache(t *testing.T) {
+	mockS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	allowUploads(t, 1<<20)
+	cache = newObjectCache(time.Hour, 1<<20, 1<<20, 0)
+	cache.set("/show/ep1.ts", "", http.StatusOK, http.Header{"Etag": {`"old"`}}, []byte("old"))
+
+	r := httptest.NewRequest("PUT", "/show/ep1.ts", strings.NewReader("new"))
+	r.RemoteAddr = "192.0.2.1:40000"
+	w := httptest.NewRecorder()
+	forwardToS3(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if _, ok := cache.lookup("/show/ep1.ts"); ok {
+		t.Error("old copy still cached after upload")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Sentinel key the watchdog requests, answered with watchdogFixture
+// without going to S3
+const (
+	watchdogPath    = "/__s3helper/watchdog"
+	watchdogFixture = "ok\n"
+)
+
+// The watchdog gives up on the process after this many failed checks in
+// a row
+const watchdogMaxFailures = 3
+
+// serveWatchdog answers the watchdog's self-request
+func serveWatchdog(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", fmt.Sprint(len(watchdogFixture)))
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, watchdogFixture)
+}
+
+// watchdogURL is where the watchdog reaches our own listener
+func watchdogURL(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "http://" + listen + watchdogPath
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + watchdogPath
+}
+
+// watchdogCheck requests the sentinel key through the listener and the
+// full handler path
+func watchdogCheck(client *http.Client, u string) error {
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != watchdogFixture {
+		return fmt.Errorf("Response Status Code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Closed by stopWatchdog to end the checks
+var (
+	watchdogStop     = make(chan struct{})
+	watchdogStopOnce sync.Once
+)
+
+// stopWatchdog ends the checks, before the listener is closed on shutdown
+// so a drain isn't taken for a hang
+func stopWatchdog() {
+	watchdogStopOnce.Do(func() { close(watchdogStop) })
+}
+
+// runWatchdog checks every interval that requests are still being served,
+// and exits so the orchestrator restarts us once they repeatedly aren't,
+// e.g. after a deadlock
+func runWatchdog(listen string, interval time.Duration) {
+	u := watchdogURL(listen)
+	// never through a proxy, and never waiting longer than a check period
+	client := &http.Client{Timeout: interval, Transport: &http.Transport{DisableKeepAlives: true}}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-watchdogStop:
+			return
+		case <-ticker.C:
+		}
+		err := watchdogCheck(client, u)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		// the listener may have closed under a check on shutdown
+		if watchdogStopped() {
+			return
+		}
+		failures++
+		log.Error().
+			Str("error", err.Error()).
+			Int("failures", failures).
+			Msg("Watchdog check failed")
+		if failures >= watchdogMaxFailures {
+			log.Fatal().Msg(fmt.Sprintf("Watchdog failed %d checks in a row, exiting", failures))
+		}
+	}
+}
+
+// watchdogStopped reports whether stopWatchdog was called
+func watchdogStopped() bool {
+	select {
+	case <-watchdogStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// initWatchdog starts the watchdog when enabled
+func initWatchdog() {
+	if conf.WatchdogInterval <= 0 {
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("Watchdog checking %s every %v", watchdogURL(conf.Listen), conf.WatchdogInterval))
+	go runWatchdog(conf.Listen, conf.WatchdogInterval)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchdogURL(t *testing.T) {
+	tests := map[string]string{
+		"0.0.0.0:8080":   "http://127.0.0.1:8080" + watchdogPath,
+		":8080":          "http://127.0.0.1:8080" + watchdogPath,
+		"[::]:8080":      "http://127.0.0.1:8080" + watchdogPath,
+		"10.0.0.5:8080":  "http://10.0.0.5:8080" + watchdogPath,
+		"localhost:9000": "http://localhost:9000" + watchdogPath,
+	}
+	for listen, want := range tests {
+		if got := watchdogURL(listen); got != want {
+			t.Errorf("watchdogURL(%q) = %q, want %q", listen, got, want)
+		}
+	}
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(forwardToS3))
+	defer srv.Close()
+	client := &http.Client{Timeout: time.Second}
+	if err := watchdogCheck(client, srv.URL+watchdogPath); err != nil {
+		t.Errorf("check of a serving listener failed: %v", err)
+	}
+	srv.Close()
+	if err := watchdogCheck(client, srv.URL+watchdogPath); err == nil {
+		t.Error("check of a closed listener passed")
+	}
+}
+
+func TestWatchdogStops(t *testing.T) {
+	// a listener that is already closed, as during a drain
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		runWatchdog(srv.Listener.Addr().String(), 10*time.Millisecond)
+		close(done)
+	}()
+	stopWatchdog()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog still running after stopWatchdog")
+	}
+}